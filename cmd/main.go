@@ -9,6 +9,7 @@ import (
 )
 
 var configFile string
+var configFormat string
 var version string = "dev"
 
 func main() {
@@ -29,6 +30,7 @@ and plugin support for advanced routing capabilities.`,
 	}
 
 	cmd.Flags().StringVarP(&configFile, "config", "c", "./static.yaml", "Path to configuration file")
+	cmd.Flags().StringVar(&configFormat, "config-format", "", "Format of the configuration file: yaml, json or toml (detected from the extension by default)")
 	// Set default from environment variable
 	if envConfig := os.Getenv("ARP_CONFIG"); envConfig != "" {
 		configFile = envConfig
@@ -47,7 +49,7 @@ and plugin support for advanced routing capabilities.`,
 func runARP(cmd *cobra.Command, args []string) error {
 	ctx := cmd.Context()
 
-	app, err := arp.NewARP(configFile)
+	app, err := arp.NewARP(configFile, configFormat)
 	if err != nil {
 		return fmt.Errorf("failed to initialize ARP: %w", err)
 	}
@@ -0,0 +1,70 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/discovery/manager"
+	"github.com/Revolyssup/arp/pkg/logger"
+)
+
+// DiscoveryStatus reports the status of the services watched through discovery.
+type DiscoveryStatus interface {
+	Status() []manager.ServiceStatus
+	Healthy() bool
+}
+
+// Server reports the health of the proxy:
+//
+//	GET /health     200 when no discovered service is stale, 503 otherwise
+//	GET /discovery  the status of every service watched through discovery
+type Server struct {
+	server    *http.Server
+	discovery DiscoveryStatus
+	log       *logger.Logger
+}
+
+func NewServer(cfg config.AdminConfig, discovery DiscoveryStatus, log *logger.Logger) *Server {
+	s := &Server{
+		discovery: discovery,
+		log:       log.WithComponent("admin"),
+	}
+	s.server = &http.Server{Addr: cfg.Address, Handler: s.Handler()}
+	return s
+}
+
+// Handler returns the handler serving the admin endpoints.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		healthy := s.discovery.Healthy()
+		status := http.StatusOK
+		if !healthy {
+			status = http.StatusServiceUnavailable
+		}
+		s.respond(w, status, map[string]bool{"healthy": healthy})
+	})
+	mux.HandleFunc("GET /discovery", func(w http.ResponseWriter, r *http.Request) {
+		s.respond(w, http.StatusOK, s.discovery.Status())
+	})
+	return mux
+}
+
+func (s *Server) Start() error {
+	s.log.Infof("admin server listening on %s", s.server.Addr)
+	return s.server.ListenAndServe()
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func (s *Server) respond(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		s.log.Errorf("Failed to write admin response: %v", err)
+	}
+}
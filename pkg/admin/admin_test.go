@@ -0,0 +1,64 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/discovery/manager"
+	"github.com/Revolyssup/arp/pkg/logger"
+)
+
+type fakeDiscoveryStatus []manager.ServiceStatus
+
+func (f fakeDiscoveryStatus) Status() []manager.ServiceStatus {
+	return f
+}
+
+func (f fakeDiscoveryStatus) Healthy() bool {
+	for _, s := range f {
+		if s.Stale {
+			return false
+		}
+	}
+	return true
+}
+
+func TestServer(t *testing.T) {
+	statuses := fakeDiscoveryStatus{
+		{Type: "dns", Service: "web.internal", LastUpdate: time.Now(), Nodes: 2},
+		{Type: "dns", Service: "api.internal"},
+	}
+	get := func(status fakeDiscoveryStatus, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		server := NewServer(config.AdminConfig{Address: ":0"}, status, logger.New(logger.LevelInfo))
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	if rec := get(statuses, "/health"); rec.Code != http.StatusOK {
+		t.Errorf("Expected healthy discovery to return 200, got %d", rec.Code)
+	}
+
+	rec := get(statuses, "/discovery")
+	var reported []map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&reported); err != nil {
+		t.Fatalf("Failed to decode discovery status: %v", err)
+	}
+	if len(reported) != 2 || reported[0]["service"] != "web.internal" || reported[0]["nodes"] != float64(2) {
+		t.Errorf("Unexpected discovery status %v", reported)
+	}
+	if _, exists := reported[1]["lastUpdate"]; exists {
+		t.Errorf("Expected services not reported yet to have no lastUpdate, got %v", reported[1])
+	}
+
+	statuses[1].Stale = true
+	rec = get(statuses, "/health")
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "{\"healthy\":false}\n" {
+		t.Errorf("Expected stale discovery to return 503, got %d %s", rec.Code, rec.Body.String())
+	}
+}
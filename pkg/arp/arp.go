@@ -6,20 +6,23 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"reflect"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/Revolyssup/arp/pkg/admin"
 	"github.com/Revolyssup/arp/pkg/config"
 	"github.com/Revolyssup/arp/pkg/discovery/manager"
 	"github.com/Revolyssup/arp/pkg/eventbus"
 	"github.com/Revolyssup/arp/pkg/listener"
 	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/plugin"
+	"github.com/Revolyssup/arp/pkg/proxy"
 	"github.com/Revolyssup/arp/pkg/route"
 	"github.com/Revolyssup/arp/pkg/upstream"
 	"github.com/Revolyssup/arp/pkg/utils"
 	"github.com/Revolyssup/arp/pkg/watcher"
-	"gopkg.in/yaml.v3"
 )
 
 // ASCII Art for ARP banner
@@ -45,17 +48,35 @@ func printBanner() {
 
 // ARP represents the main application instance
 type ARP struct {
-	config     *config.Static
-	log        *logger.Logger
-	listeners  map[string]*listener.Listener
-	watcher    *watcher.Watcher
-	cancelFunc context.CancelFunc
-	wg         sync.WaitGroup
+	config       *config.Static
+	configFile   string
+	configFormat config.Format
+	log          *logger.Logger
+	listeners    map[string]*listener.Listener
+	// listenersMu guards listeners against the listeners drained in the background
+	listenersMu sync.Mutex
+	watcher     *watcher.Watcher
+	admin       *admin.Server
+	cancelFunc  context.CancelFunc
+	wg          sync.WaitGroup
+
+	// Components shared by the listeners, kept to create listeners when the static config is reloaded
+	configBus    *eventbus.EventBus[config.Dynamic]
+	routeFactory *route.Factory
+	upstreams    *upstream.Registry
+	proxyService *proxy.Service
+	discovery    *manager.DiscoveryManager
+	processor    *listener.ListenerProcessor
 }
 
-// NewARP creates a new ARP instance with the given configuration file
-func NewARP(configFile string) (*ARP, error) {
-	staticConfig, err := loadStaticConfig(configFile)
+// NewARP creates a new ARP instance with the given configuration file, whose format is detected from its
+// extension when configFormat is empty
+func NewARP(configFile, configFormat string) (*ARP, error) {
+	format, err := config.ParseFormat(configFormat)
+	if err != nil {
+		return nil, err
+	}
+	staticConfig, err := loadStaticConfig(configFile, format)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load config: %w", err)
 	}
@@ -63,8 +84,10 @@ func NewARP(configFile string) (*ARP, error) {
 	log := logger.New(level).WithComponent("arp")
 
 	return &ARP{
-		config: staticConfig,
-		log:    log,
+		config:       staticConfig,
+		configFile:   configFile,
+		configFormat: format,
+		log:          log,
 	}, nil
 }
 
@@ -84,7 +107,7 @@ func (a *ARP) Run(ctx context.Context) error {
 
 	a.log.Infof("ARP server started successfully with %d listeners", len(a.listeners))
 
-	// Wait for shutdown signal
+	// Wait for shutdown signal, reloading the static config on SIGHUP
 	a.waitForShutdown(ctx)
 
 	// Perform graceful shutdown
@@ -94,24 +117,55 @@ func (a *ARP) Run(ctx context.Context) error {
 }
 
 func (a *ARP) init(ctx context.Context) error {
-	configBus := eventbus.NewEventBus[config.Dynamic](a.log.WithComponent("config_bus"))
+	a.configBus = eventbus.NewEventBus[config.Dynamic](a.log.WithComponent("config_bus"))
 	discoveryManager, err := manager.NewDiscoveryManager(a.log)
 	if err != nil {
 		return fmt.Errorf("failed to initialize discovery manager: %w", err)
 	}
-	discoveryManager.InitDiscovery(ctx, a.config.DiscoveryConfigs)
-	routeFactory := route.NewFactory()
-	upstreamFactory := upstream.NewFactory()
+	if err := discoveryManager.InitDiscovery(ctx, a.config.DiscoveryConfigs); err != nil {
+		return fmt.Errorf("failed to start discovery: %w", err)
+	}
+	a.discovery = discoveryManager
+	a.routeFactory = route.NewFactory()
+	proxyService := proxy.NewService(a.log)
+	a.proxyService = proxyService
+	a.upstreams = upstream.NewRegistry(upstream.NewFactory(), discoveryManager, a.log)
+	// Connections are pooled per upstream, so that draining a node of an upstream leaves the connections
+	// other upstreams have to the same host untouched. Pooled connections of removed nodes are closed once
+	// the node finished draining, and the ones of removed upstreams right away.
+	a.upstreams.OnUpstreamCreated(func(up *upstream.Upstream) {
+		proxyService.OpenScope(up.ID())
+	})
+	a.upstreams.OnNodeDrained(func(up *upstream.Upstream, node *upstream.Node) {
+		a.log.Infof("Node %s of upstream %s drained", node.URL, up.Name())
+		proxyService.CloseTarget(up.ID(), node.URL)
+	})
+	a.upstreams.OnUpstreamRemoved(func(up *upstream.Upstream) {
+		proxyService.CloseScope(up.ID())
+	})
 
 	a.listeners = make(map[string]*listener.Listener)
 	for _, lc := range a.config.Listeners {
-		l := listener.NewListener(lc, discoveryManager, configBus, routeFactory, upstreamFactory, a.log.WithComponent("listener_"+lc.Name))
-		a.listeners[lc.Name] = l
+		a.listeners[lc.Name] = a.newListener(lc)
 	}
 
 	dynamicValidator := config.NewDynamicValidator()
-	listenerProcessor := listener.NewListenerProcessor(configBus, dynamicValidator, a.log.WithComponent("listener_processor"))
-	a.watcher = watcher.NewWatcher(a.config.Providers, listenerProcessor, a.log.WithComponent("watcher"))
+	dynamicValidator.SetListeners(a.config.Listeners)
+	dynamicValidator.SetPluginValidator(plugin.Registry.Validate)
+	dynamicValidator.SetDiscoveryReferenceValidator(discoveryManager.ValidateReference)
+	a.processor = listener.NewListenerProcessor(a.configBus, dynamicValidator, a.log.WithComponent("listener_processor"))
+	a.watcher = watcher.NewWatcher(a.config.Providers, a.processor, a.log.WithComponent("watcher"))
+	if a.watcher != nil {
+		providerValidator := config.NewDynamicValidator()
+		providerValidator.SetPluginValidator(plugin.Registry.Validate)
+		providerValidator.SetDiscoveryReferenceValidator(discoveryManager.ValidateReference)
+		a.watcher.SetValidator(providerValidator)
+		a.watcher.SetDiscoveryReferenceValidator(discoveryManager.ValidateReference)
+		a.watcher.SetListeners(a.config.Listeners)
+	}
+	if a.config.Admin != nil {
+		a.admin = admin.NewServer(*a.config.Admin, discoveryManager, a.log)
+	}
 
 	return nil
 }
@@ -129,38 +183,184 @@ func (a *ARP) start(ctx context.Context) error {
 
 	// Start listeners
 	for name, l := range a.listeners {
+		a.startListener(name, l)
+	}
+
+	if a.admin != nil {
 		a.wg.Add(1)
-		// for compatibility with older go versions
-		name := name
-		l := l
 		utils.GoWithRecover(func() {
 			defer a.wg.Done()
-			a.log.Infof("Starting listener: %s", name)
-
-			if err := l.Start(); err != nil && err != http.ErrServerClosed {
-				a.log.Errorf("Listener %s failed: %v", name, err)
-			} else {
-				a.log.Infof("Listener %s stopped", name)
+			if err := a.admin.Start(); err != nil && err != http.ErrServerClosed {
+				a.log.Errorf("Admin server failed: %v", err)
 			}
 		}, func(err any) {
-			a.log.Errorf("panic in listener %s: %v", name, err)
+			a.log.Errorf("panic in admin server: %v", err)
 		})
 	}
 
 	return nil
 }
 
-// waitForShutdown waits for a shutdown signal
+func (a *ARP) newListener(lc config.ListenerConfig) *listener.Listener {
+	return listener.NewListener(lc, a.configBus, a.routeFactory, a.upstreams, a.proxyService, a.log.WithComponent("listener_"+lc.Name))
+}
+
+func (a *ARP) startListener(name string, l *listener.Listener) {
+	a.wg.Add(1)
+	utils.GoWithRecover(func() {
+		defer a.wg.Done()
+		a.log.Infof("Starting listener: %s", name)
+
+		if err := l.Start(); err != nil && err != http.ErrServerClosed {
+			a.log.Errorf("Listener %s failed: %v", name, err)
+		} else {
+			a.log.Infof("Listener %s stopped", name)
+		}
+	}, func(err any) {
+		a.log.Errorf("panic in listener %s: %v", name, err)
+	})
+}
+
+// waitForShutdown waits for a shutdown signal, reloading the static configuration on SIGHUP
 func (a *ARP) waitForShutdown(ctx context.Context) {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+	defer signal.Stop(sigChan)
+
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				a.log.Infof("Received signal: %v, reloading static configuration from %s", sig, a.configFile)
+				a.reload(ctx)
+				continue
+			}
+			a.log.Infof("Received signal: %v", sig)
+		case <-ctx.Done():
+			a.log.Infof("Context cancelled: %v", ctx.Err())
+		}
+		return
+	}
+}
 
-	select {
-	case sig := <-sigChan:
-		a.log.Infof("Received signal: %v", sig)
-	case <-ctx.Done():
-		a.log.Infof("Context cancelled: %v", ctx.Err())
+// reload applies the static configuration read again from the config file. Listeners are diffed by name: new
+// ones are started, removed ones are drained in the background and changed ones are replaced, unchanged listeners
+// and their connections being left untouched. The log level and discovery are updated in place. An invalid
+// configuration is ignored, the running one being kept.
+func (a *ARP) reload(ctx context.Context) {
+	cfg, err := loadStaticConfig(a.configFile, a.configFormat)
+	if err != nil {
+		a.log.Errorf("Failed to reload static configuration, keeping the running one: %v", err)
+		return
+	}
+
+	if cfg.LogLevel != a.config.LogLevel {
+		level := logger.SetLogLevel(cfg.LogLevel)
+		logger.SetGlobalLevel(level)
+		a.log.Infof("Log level set to %s", level)
 	}
+
+	if !reflect.DeepEqual(cfg.DiscoveryConfigs, a.config.DiscoveryConfigs) {
+		if err := a.discovery.Reconcile(ctx, cfg.DiscoveryConfigs); err != nil {
+			// Keep diffing against the previous discovery, so that the next reload retries the failed ones
+			a.log.Errorf("Failed to reload discovery: %v", err)
+			cfg.DiscoveryConfigs = a.config.DiscoveryConfigs
+		} else {
+			a.log.Infof("Discovery reloaded")
+		}
+	}
+
+	if !reflect.DeepEqual(cfg.Providers, a.config.Providers) {
+		// Providers are not reloaded, keep diffing against the running ones
+		a.log.Warnf("Provider changes are only applied on restart")
+		cfg.Providers = a.config.Providers
+	}
+	if !reflect.DeepEqual(cfg.Admin, a.config.Admin) {
+		a.log.Warnf("Admin server changes are only applied on restart")
+		cfg.Admin = a.config.Admin
+	}
+
+	a.reloadListeners(cfg.Listeners)
+	a.config = cfg
+}
+
+func (a *ARP) reloadListeners(listeners []config.ListenerConfig) {
+	current := make(map[string]config.ListenerConfig, len(a.config.Listeners))
+	for _, lc := range a.config.Listeners {
+		current[lc.Name] = lc
+	}
+	configured := make(map[string]bool, len(listeners))
+	for _, lc := range listeners {
+		configured[lc.Name] = true
+	}
+
+	// Removed listeners are drained in the background, their ports being closed right away
+	for name := range current {
+		if !configured[name] {
+			a.drainListener(name, a.listeners[name], true)
+			a.listenersMu.Lock()
+			delete(a.listeners, name)
+			a.listenersMu.Unlock()
+		}
+	}
+	for _, lc := range listeners {
+		previous, exists := current[lc.Name]
+		if exists && reflect.DeepEqual(previous, lc) {
+			continue
+		}
+		l := a.newListener(lc)
+		if exists {
+			// The new listener binds the port before the old one is drained, so that no connection is refused,
+			// and takes over the upstreams of the old one, being their owner under the same name
+			if err := l.Listen(); err != nil {
+				a.log.Warnf("Listener %s can't share its port, stopping the old one first: %v", lc.Name, err)
+				a.stopListener(lc.Name, a.listeners[lc.Name])
+			} else {
+				a.drainListener(lc.Name, a.listeners[lc.Name], false)
+			}
+		}
+		a.listenersMu.Lock()
+		a.listeners[lc.Name] = l
+		a.listenersMu.Unlock()
+		a.startListener(lc.Name, l)
+	}
+
+	// New listeners get the routes referencing them, which were rejected until now
+	if a.watcher != nil {
+		a.watcher.SetListeners(listeners)
+	}
+	a.processor.SetListeners(listeners)
+}
+
+// stopListener gracefully stops the listener, waiting for its connections to be done.
+func (a *ARP) stopListener(name string, l *listener.Listener) {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	a.log.Infof("Stopping listener: %s", name)
+	if err := l.Stop(shutdownCtx); err != nil {
+		a.log.Errorf("Error stopping listener %s: %v", name, err)
+	}
+}
+
+// drainListener stops the listener in the background, so that reloads don't wait for its connections. The upstreams
+// of a removed listener are released once it is drained, unless a listener of the same name was added meanwhile.
+func (a *ARP) drainListener(name string, l *listener.Listener, release bool) {
+	a.wg.Add(1)
+	utils.GoWithRecover(func() {
+		defer a.wg.Done()
+		a.stopListener(name, l)
+		if !release {
+			return
+		}
+		a.listenersMu.Lock()
+		_, readded := a.listeners[name]
+		a.listenersMu.Unlock()
+		if !readded {
+			a.upstreams.Release(name)
+		}
+	}, func(err any) {
+		a.log.Errorf("panic while stopping listener %s: %v", name, err)
+	})
 }
 
 // shutdown performs graceful shutdown of all components
@@ -193,6 +393,12 @@ func (a *ARP) shutdown() {
 		})
 	}
 
+	if a.admin != nil {
+		if err := a.admin.Stop(shutdownCtx); err != nil {
+			a.log.Errorf("Error stopping admin server: %v", err)
+		}
+	}
+
 	// Wait for all listeners to stop
 	done := make(chan struct{})
 	go func() {
@@ -211,18 +417,22 @@ func (a *ARP) shutdown() {
 }
 
 // loadStaticConfig loads the static configuration from file
-func loadStaticConfig(filename string) (*config.Static, error) {
+func loadStaticConfig(filename string, format config.Format) (*config.Static, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
 
+	if format == "" {
+		format = config.FormatOf(filename)
+	}
 	var cfg config.Static
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, fmt.Errorf("failed to parse config YAML: %w", err)
+	if err := config.Decode(data, format, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", format, err)
 	}
 
 	validator := config.NewStaticValidator()
+	validator.SetDiscoveryValidator(manager.Registry.Validate)
 	if err := validator.Validate(&cfg); err != nil {
 		return nil, fmt.Errorf("config validation error: %w", err)
 	}
@@ -3,52 +3,82 @@ package config
 import "github.com/Revolyssup/arp/pkg/plugin/types"
 
 type Dynamic struct {
-	Routes      []RouteConfig       `yaml:"routes"`
-	Upstreams   []UpstreamConfig    `yaml:"upstreams,omitempty"`
-	Plugins     []PluginConfig      `yaml:"plugins,omitempty"`
-	StreamRoute []StreamRouteConfig `yaml:"streamRoutes,omitempty"`
+	Routes      []RouteConfig       `yaml:"routes" json:"routes" toml:"routes"`
+	Upstreams   []UpstreamConfig    `yaml:"upstreams,omitempty" json:"upstreams,omitempty" toml:"upstreams,omitempty"`
+	Plugins     []PluginConfig      `yaml:"plugins,omitempty" json:"plugins,omitempty" toml:"plugins,omitempty"`
+	StreamRoute []StreamRouteConfig `yaml:"streamRoutes,omitempty" json:"streamRoutes,omitempty" toml:"streamRoutes,omitempty"`
 }
 
 type StreamRouteConfig struct {
-	Name     string          `yaml:"name"`
-	Listener string          `yaml:"listener"`
-	Plugins  []PluginConfig  `yaml:"plugins,omitempty"`
-	Upstream *UpstreamConfig `yaml:"upstream,omitempty"`
+	Name     string          `yaml:"name" json:"name" toml:"name"`
+	Listener string          `yaml:"listener" json:"listener" toml:"listener"`
+	Plugins  []PluginConfig  `yaml:"plugins,omitempty" json:"plugins,omitempty" toml:"plugins,omitempty"`
+	Upstream *UpstreamConfig `yaml:"upstream,omitempty" json:"upstream,omitempty" toml:"upstream,omitempty"`
 }
 
 type RouteConfig struct {
-	Name     string          `yaml:"name"`
-	Listener string          `yaml:"listener"`
-	Matches  []Match         `yaml:"matches"`
-	Plugins  []PluginConfig  `yaml:"plugins,omitempty"`
-	Upstream *UpstreamConfig `yaml:"upstream,omitempty"`
+	Name     string          `yaml:"name" json:"name" toml:"name"`
+	Listener string          `yaml:"listener" json:"listener" toml:"listener"`
+	Matches  []Match         `yaml:"matches" json:"matches" toml:"matches"`
+	Plugins  []PluginConfig  `yaml:"plugins,omitempty" json:"plugins,omitempty" toml:"plugins,omitempty"`
+	Upstream *UpstreamConfig `yaml:"upstream,omitempty" json:"upstream,omitempty" toml:"upstream,omitempty"`
 }
 
 type Match struct {
-	Path    string            `yaml:"path,omitempty"`
-	Headers map[string]string `yaml:"headers,omitempty"`
-	Method  string            `yaml:"method,omitempty"`
+	Path    string            `yaml:"path,omitempty" json:"path,omitempty" toml:"path,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty" json:"headers,omitempty" toml:"headers,omitempty"`
+	Method  string            `yaml:"method,omitempty" json:"method,omitempty" toml:"method,omitempty"`
 }
 
 type UpstreamConfig struct {
-	Name      string       `yaml:"name"`
-	Type      string       `yaml:"type"`
-	Nodes     []Node       `yaml:"nodes,omitempty"`
-	Service   string       `yaml:"service,omitempty"`
-	Discovery DiscoveryRef `yaml:"discovery,omitempty"`
+	Name string `yaml:"name" json:"name" toml:"name"`
+	Type string `yaml:"type" json:"type" toml:"type"`
+	// Nodes of an upstream using discovery are used until the discovery reports, and whenever it reports no node.
+	Nodes          []Node                `yaml:"nodes,omitempty" json:"nodes,omitempty" toml:"nodes,omitempty"`
+	Service        string                `yaml:"service,omitempty" json:"service,omitempty" toml:"service,omitempty"`
+	Discovery      DiscoveryRef          `yaml:"discovery,omitempty" json:"discovery,omitempty" toml:"discovery,omitempty"`
+	Retries        int                   `yaml:"retries,omitempty" json:"retries,omitempty" toml:"retries,omitempty"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker,omitempty" json:"circuitBreaker,omitempty" toml:"circuitBreaker,omitempty"`
+	// SlowStart is the duration over which a newly added node ramps up to its full weight.
+	SlowStart string `yaml:"slowStart,omitempty" json:"slowStart,omitempty" toml:"slowStart,omitempty"`
+	// DrainTimeout bounds how long a removed node waits for its in-flight requests before its connections are closed.
+	DrainTimeout string          `yaml:"drainTimeout,omitempty" json:"drainTimeout,omitempty" toml:"drainTimeout,omitempty"`
+	Locality     *LocalityConfig `yaml:"locality,omitempty" json:"locality,omitempty" toml:"locality,omitempty"`
+}
+
+// LocalityConfig makes an upstream prefer nodes in the proxy's own zone.
+type LocalityConfig struct {
+	Zone string `yaml:"zone" json:"zone" toml:"zone"`
+	// MinHealthyPercent is the share of local nodes that must be healthy before traffic spills over to other zones.
+	MinHealthyPercent int `yaml:"minHealthyPercent,omitempty" json:"minHealthyPercent,omitempty" toml:"minHealthyPercent,omitempty"`
+}
+
+// CircuitBreakerConfig holds the thresholds after which requests to an upstream fail fast.
+// A zero value for any threshold means it is not enforced.
+type CircuitBreakerConfig struct {
+	MaxConnections           int `yaml:"maxConnections,omitempty" json:"maxConnections,omitempty" toml:"maxConnections,omitempty"`
+	MaxPendingRequests       int `yaml:"maxPendingRequests,omitempty" json:"maxPendingRequests,omitempty" toml:"maxPendingRequests,omitempty"`
+	MaxRetries               int `yaml:"maxRetries,omitempty" json:"maxRetries,omitempty" toml:"maxRetries,omitempty"`
+	MaxRequestsPerConnection int `yaml:"maxRequestsPerConnection,omitempty" json:"maxRequestsPerConnection,omitempty" toml:"maxRequestsPerConnection,omitempty"`
 }
 
 type Node struct {
-	URL string `yaml:"url"`
+	URL    string `yaml:"url" json:"url" toml:"url"`
+	Weight int    `yaml:"weight,omitempty" json:"weight,omitempty" toml:"weight,omitempty"`
+	Zone   string `yaml:"zone,omitempty" json:"zone,omitempty" toml:"zone,omitempty"`
+	// Priority groups nodes into failover levels, 0 being the highest. Lower levels only get traffic
+	// when no node of a higher level is healthy.
+	Priority int               `yaml:"priority,omitempty" json:"priority,omitempty" toml:"priority,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty" json:"labels,omitempty" toml:"labels,omitempty"`
 }
 
 type DiscoveryRef struct {
-	Type   string            `yaml:"type"`
-	Params map[string]string `yaml:"params,omitempty"`
+	Type   string            `yaml:"type" json:"type" toml:"type"`
+	Params map[string]string `yaml:"params,omitempty" json:"params,omitempty" toml:"params,omitempty"`
 }
 
 type PluginConfig struct {
-	Name   string           `yaml:"name"`
-	Type   string           `yaml:"type"`
-	Config types.PluginConf `yaml:"config"`
+	Name   string           `yaml:"name" json:"name" toml:"name"`
+	Type   string           `yaml:"type" json:"type" toml:"type"`
+	Config types.PluginConf `yaml:"config" json:"config" toml:"config"`
 }
@@ -4,11 +4,25 @@ import (
 	"fmt"
 	"net/url"
 	"strings"
+	"time"
 )
 
-// TODO: Make dynamic validation's validator registerable by each component (e.g., plugins, discovery, etc.). (maybe jsonschema validation?)
+// PluginValidator validates the configuration of a plugin type, failing for unknown types.
+type PluginValidator func(typ string, cfg map[string]any) error
+
+// DiscoveryReferenceValidator validates the service and params of an upstream referencing a discovery type,
+// failing for unknown types.
+type DiscoveryReferenceValidator func(typ, service string, params map[string]string) error
+
+// DynamicValidator validates dynamic configurations. Plugin configurations and discovery references are validated
+// by the hooks registered by each plugin and discovery type, when set.
 type DynamicValidator struct {
 	errors []ValidationError
+	// listeners holds the names of the static listeners, nil when listener references aren't checked
+	listeners                   map[string]bool
+	pluginValidator             PluginValidator
+	discoveryReferenceValidator DiscoveryReferenceValidator
+	externalReferences          bool
 }
 
 func NewDynamicValidator() *DynamicValidator {
@@ -17,6 +31,31 @@ func NewDynamicValidator() *DynamicValidator {
 	}
 }
 
+// SetListeners makes the validator check that routes and stream routes reference one of the listeners.
+func (v *DynamicValidator) SetListeners(listeners []ListenerConfig) {
+	v.listeners = make(map[string]bool, len(listeners))
+	for _, listener := range listeners {
+		v.listeners[listener.Name] = true
+	}
+}
+
+// SetPluginValidator makes the validator check plugin configurations against the registered plugin types.
+func (v *DynamicValidator) SetPluginValidator(fn PluginValidator) {
+	v.pluginValidator = fn
+}
+
+// SetDiscoveryReferenceValidator makes the validator check the discovery of upstreams against the registered
+// discovery types.
+func (v *DynamicValidator) SetDiscoveryReferenceValidator(fn DiscoveryReferenceValidator) {
+	v.discoveryReferenceValidator = fn
+}
+
+// AllowExternalReferences skips the upstream and plugin references qualified with a provider name, like
+// auth@api, for configurations validated before being merged with the ones of the other providers.
+func (v *DynamicValidator) AllowExternalReferences() {
+	v.externalReferences = true
+}
+
 func (v *DynamicValidator) Validate(cfg *Dynamic) error {
 	v.errors = make([]ValidationError, 0) // Reset errors
 
@@ -25,6 +64,7 @@ func (v *DynamicValidator) Validate(cfg *Dynamic) error {
 	v.validateUpstreams(cfg.Upstreams)
 	v.validatePlugins(cfg.Plugins)
 	v.validateStreamRoutes(cfg.StreamRoute)
+	v.validateReferences(cfg)
 
 	if len(v.errors) > 0 {
 		return v.ToError()
@@ -146,22 +186,22 @@ func (v *DynamicValidator) validateUpstreams(upstreams []UpstreamConfig) {
 }
 
 func (v *DynamicValidator) validateUpstreamConfig(prefix string, upstream UpstreamConfig) {
+	v.validateUpstreamPolicies(prefix, upstream)
+
 	if upstream.Discovery.Type != "" {
 		if strings.TrimSpace(upstream.Service) == "" {
 			v.addError(prefix+".service",
 				"service cannot be empty when discovery is configured")
 		}
-	} else {
+	} else if len(upstream.Nodes) == 0 {
 		// If no discovery, must have nodes
-		if len(upstream.Nodes) == 0 {
-			v.addError(prefix+".nodes",
-				"upstream must have either discovery or static nodes")
-		}
+		v.addError(prefix+".nodes",
+			"upstream must have either discovery or static nodes")
+	}
 
-		// Validate nodes
-		for j, node := range upstream.Nodes {
-			v.validateNode(prefix+fmt.Sprintf(".nodes[%d]", j), node)
-		}
+	// Validate nodes, which are the fallback of discovered upstreams
+	for j, node := range upstream.Nodes {
+		v.validateNode(prefix+fmt.Sprintf(".nodes[%d]", j), node)
 	}
 }
 
@@ -175,6 +215,61 @@ func (v *DynamicValidator) validateUpstreamReference(prefix string, upstream Ups
 		v.addError(prefix+".service",
 			"service cannot be empty when discovery is configured")
 	}
+
+	v.validateUpstreamPolicies(prefix, upstream)
+}
+
+// validateUpstreamPolicies validates the discovery and traffic policies shared by named and inline upstreams
+func (v *DynamicValidator) validateUpstreamPolicies(prefix string, upstream UpstreamConfig) {
+	// Empty services are reported by the callers
+	if v.discoveryReferenceValidator != nil && upstream.Discovery.Type != "" && strings.TrimSpace(upstream.Service) != "" {
+		if err := v.discoveryReferenceValidator(upstream.Discovery.Type, upstream.Service, upstream.Discovery.Params); err != nil {
+			v.addError(prefix+".discovery", err.Error())
+		}
+	}
+
+	if upstream.Retries < 0 {
+		v.addError(prefix+".retries", "retries cannot be negative")
+	}
+
+	if upstream.SlowStart != "" {
+		if d, err := time.ParseDuration(upstream.SlowStart); err != nil || d < 0 {
+			v.addError(prefix+".slowStart", fmt.Sprintf("invalid duration: %s", upstream.SlowStart))
+		}
+	}
+
+	if upstream.DrainTimeout != "" {
+		if d, err := time.ParseDuration(upstream.DrainTimeout); err != nil || d < 0 {
+			v.addError(prefix+".drainTimeout", fmt.Sprintf("invalid duration: %s", upstream.DrainTimeout))
+		}
+	}
+
+	if locality := upstream.Locality; locality != nil {
+		if strings.TrimSpace(locality.Zone) == "" {
+			v.addError(prefix+".locality.zone", "locality zone cannot be empty")
+		}
+		if locality.MinHealthyPercent < 0 || locality.MinHealthyPercent > 100 {
+			v.addError(prefix+".locality.minHealthyPercent",
+				fmt.Sprintf("invalid percentage: %d (must be between 0-100)", locality.MinHealthyPercent))
+		}
+	}
+
+	if cb := upstream.CircuitBreaker; cb != nil {
+		thresholds := []struct {
+			field string
+			value int
+		}{
+			{"maxConnections", cb.MaxConnections},
+			{"maxPendingRequests", cb.MaxPendingRequests},
+			{"maxRetries", cb.MaxRetries},
+			{"maxRequestsPerConnection", cb.MaxRequestsPerConnection},
+		}
+		for _, t := range thresholds {
+			if t.value < 0 {
+				v.addError(prefix+".circuitBreaker."+t.field, "threshold cannot be negative")
+			}
+		}
+	}
 }
 
 func (v *DynamicValidator) validateNode(prefix string, node Node) {
@@ -197,6 +292,14 @@ func (v *DynamicValidator) validateNode(prefix string, node Node) {
 	if parsedURL.Host == "" {
 		v.addError(prefix+".url", "URL must include host")
 	}
+
+	if node.Weight < 0 {
+		v.addError(prefix+".weight", "weight cannot be negative")
+	}
+
+	if node.Priority < 0 {
+		v.addError(prefix+".priority", "priority cannot be negative")
+	}
 }
 
 func (v *DynamicValidator) validatePlugins(plugins []PluginConfig) {
@@ -243,6 +346,62 @@ func (v *DynamicValidator) validateStreamRoutes(streamRoutes []StreamRouteConfig
 	}
 }
 
+// validateReferences checks that the listeners, upstreams and plugins referenced by the configuration exist, and
+// validates the plugins they define inline. Upstreams and plugins referenced by name must be defined, unless the reference carries its
+// own definition, which is then used as is.
+func (v *DynamicValidator) validateReferences(cfg *Dynamic) {
+	upstreams := make(map[string]bool, len(cfg.Upstreams))
+	for _, upstream := range cfg.Upstreams {
+		upstreams[upstream.Name] = true
+	}
+	pluginTypes := make(map[string]string, len(cfg.Plugins))
+	for i, plugin := range cfg.Plugins {
+		pluginTypes[plugin.Name] = plugin.Type
+		v.validatePluginConfig(fmt.Sprintf("plugins[%d]", i), plugin)
+	}
+
+	check := func(prefix, listener string, upstream *UpstreamConfig, plugins []PluginConfig) {
+		if v.listeners != nil && strings.TrimSpace(listener) != "" && !v.listeners[listener] {
+			v.addError(prefix+".listener", fmt.Sprintf("listener '%s' is not defined", listener))
+		}
+		if upstream != nil && upstream.Name != "" && !upstreams[upstream.Name] && !v.isExternal(upstream.Name) &&
+			len(upstream.Nodes) == 0 && upstream.Discovery.Type == "" {
+			v.addError(prefix+".upstream.name", fmt.Sprintf("upstream '%s' is not defined", upstream.Name))
+		}
+		for j, plugin := range plugins {
+			pluginPrefix := fmt.Sprintf("%s.plugins[%d]", prefix, j)
+			if _, defined := pluginTypes[plugin.Name]; defined || plugin.Name == "" || v.isExternal(plugin.Name) {
+				continue
+			}
+			if plugin.Type == "" {
+				v.addError(pluginPrefix+".name", fmt.Sprintf("plugin '%s' is not defined", plugin.Name))
+				continue
+			}
+			v.validatePluginConfig(pluginPrefix, plugin)
+		}
+	}
+	for i, route := range cfg.Routes {
+		check(fmt.Sprintf("routes[%d]", i), route.Listener, route.Upstream, route.Plugins)
+	}
+	for i, streamRoute := range cfg.StreamRoute {
+		check(fmt.Sprintf("streamRoutes[%d]", i), streamRoute.Listener, streamRoute.Upstream, streamRoute.Plugins)
+	}
+}
+
+func (v *DynamicValidator) validatePluginConfig(prefix string, plugin PluginConfig) {
+	if v.pluginValidator == nil || strings.TrimSpace(plugin.Type) == "" {
+		return
+	}
+	if err := v.pluginValidator(plugin.Type, plugin.Config); err != nil {
+		v.addError(prefix+".config", err.Error())
+	}
+}
+
+// isExternal reports whether the name references an object of another provider, which is skipped when allowed.
+func (v *DynamicValidator) isExternal(name string) bool {
+	return v.externalReferences && strings.Contains(name, "@")
+}
+
 func (v *DynamicValidator) addError(field, message string) {
 	v.errors = append(v.errors, ValidationError{
 		Field:   field,
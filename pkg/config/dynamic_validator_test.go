@@ -1,6 +1,9 @@
 package config
 
-import "testing"
+import (
+	"fmt"
+	"testing"
+)
 
 func TestDynamicValidati(t *testing.T) {
 	validator := NewDynamicValidator()
@@ -102,6 +105,18 @@ func TestDynamicValidati(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "negative circuit breaker threshold",
+			cfg: Dynamic{
+				Routes: []RouteConfig{
+					{Name: "route1", Listener: "listener1", Upstream: &UpstreamConfig{Name: "upstream1"}, Matches: []Match{{Path: "/test"}}},
+				},
+				Upstreams: []UpstreamConfig{
+					{Name: "upstream1", Nodes: []Node{{URL: "http://example.com"}}, CircuitBreaker: &CircuitBreakerConfig{MaxConnections: -1}},
+				},
+			},
+			wantErr: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -113,3 +128,71 @@ func TestDynamicValidati(t *testing.T) {
 		})
 	}
 }
+
+func TestDynamicValidatorReferences(t *testing.T) {
+	validator := NewDynamicValidator()
+	validator.SetListeners([]ListenerConfig{{Name: "http", Port: 8080}})
+	validator.SetPluginValidator(func(typ string, cfg map[string]any) error {
+		if typ != "demo" {
+			return fmt.Errorf("unsupported plugin type: %s", typ)
+		}
+		return nil
+	})
+
+	cfg := Dynamic{
+		Routes: []RouteConfig{
+			{
+				Name: "valid", Listener: "http", Matches: []Match{{Path: "/"}},
+				Upstream: &UpstreamConfig{Name: "backend"},
+				Plugins:  []PluginConfig{{Name: "auth"}, {Name: "inline", Type: "demo"}},
+			},
+			{
+				Name: "inline-upstream", Listener: "http", Matches: []Match{{Path: "/inline"}},
+				Upstream: &UpstreamConfig{Name: "undeclared", Nodes: []Node{{URL: "http://example.com"}}},
+			},
+			{
+				Name: "dangling", Listener: "https", Matches: []Match{{Path: "/dangling"}},
+				Upstream: &UpstreamConfig{Name: "missing"},
+				Plugins:  []PluginConfig{{Name: "nope"}, {Name: "other", Type: "unknown"}, {Name: "cache@file"}},
+			},
+		},
+		Upstreams: []UpstreamConfig{{Name: "backend", Nodes: []Node{{URL: "http://example.com"}}}},
+		Plugins: []PluginConfig{
+			{Name: "auth", Type: "demo"},
+			{Name: "broken", Type: "unregistered"},
+		},
+		StreamRoute: []StreamRouteConfig{{Name: "tcp", Listener: "tcp", Upstream: &UpstreamConfig{Name: "backend"}}},
+	}
+
+	if err := validator.Validate(&cfg); err == nil {
+		t.Fatal("Expected dangling references to fail")
+	}
+	expected := map[string]bool{
+		"plugins[1].config":           true,
+		"routes[2].listener":          true,
+		"routes[2].upstream.name":     true,
+		"routes[2].plugins[0].name":   true,
+		"routes[2].plugins[1].config": true,
+		"routes[2].plugins[2].name":   true,
+		"streamRoutes[0].listener":    true,
+	}
+	for _, err := range validator.GetErrors() {
+		if !expected[err.Field] {
+			t.Errorf("Unexpected error %v", err)
+		}
+		delete(expected, err.Field)
+	}
+	for field := range expected {
+		t.Errorf("Expected an error for %s", field)
+	}
+
+	// References to other providers are left to the validation of the merged configuration
+	validator.AllowExternalReferences()
+	if err := validator.Validate(&cfg); err != nil {
+		for _, err := range validator.GetErrors() {
+			if err.Field == "routes[2].plugins[2].name" {
+				t.Errorf("Expected external reference to be skipped, got %v", err)
+			}
+		}
+	}
+}
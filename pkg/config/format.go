@@ -0,0 +1,120 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is the format of a configuration file. The configuration types carry the same field names for every
+// format.
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatJSON Format = "json"
+	FormatTOML Format = "toml"
+)
+
+// ParseFormat returns the format with the given name, an empty name meaning the format is detected from the
+// file extension.
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return "", nil
+	case "yaml", "yml":
+		return FormatYAML, nil
+	case "json":
+		return FormatJSON, nil
+	case "toml":
+		return FormatTOML, nil
+	}
+	return "", fmt.Errorf("unsupported config format %s", name)
+}
+
+// FormatOf returns the format of the file from its extension, YAML being the default.
+func FormatOf(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatYAML
+}
+
+// Decode parses the content in the given format into v, after interpolating the references of its values:
+//
+//	${NAME}            the environment variable NAME, which must be set
+//	${NAME:-default}   the environment variable NAME, or default when it is unset or empty
+//	${file:/path}      the content of the file, without its trailing newline
+//
+// $${ escapes a reference. Values read from files, and from environment variables whose name contains one of
+// SecretNameParts, are redacted from the logs. References that can't be resolved are reported with their location.
+func Decode(content []byte, format Format, v any) error {
+	document, err := parseDocument(content, format)
+	if err != nil || document == nil {
+		return err
+	}
+	var errs []error
+	interpolateNode(document, "", format != FormatYAML, &errs)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	return document.Decode(v)
+}
+
+// Unmarshal parses the content in the given format into v, without interpolating references. It is meant for
+// configurations that don't come from the local host, which must not read its environment or files.
+func Unmarshal(content []byte, format Format, v any) error {
+	document, err := parseDocument(content, format)
+	if err != nil || document == nil {
+		return err
+	}
+	return document.Decode(v)
+}
+
+// parseDocument turns the content into a YAML document, so that every format is interpolated and decoded the
+// same way, and plugin configs hold the same types whatever their format. It returns nil for empty content.
+func parseDocument(content []byte, format Format) (*yaml.Node, error) {
+	var document yaml.Node
+	switch format {
+	case FormatJSON:
+		if len(bytes.TrimSpace(content)) == 0 {
+			return nil, nil
+		}
+		if !json.Valid(content) {
+			var probe any
+			return nil, fmt.Errorf("invalid JSON: %v", json.Unmarshal(content, &probe))
+		}
+		// JSON being a subset of YAML, lines are kept for errors
+		if err := yaml.Unmarshal(content, &document); err != nil {
+			return nil, err
+		}
+	case FormatTOML:
+		var table map[string]any
+		if err := toml.Unmarshal(content, &table); err != nil {
+			return nil, err
+		}
+		if len(table) == 0 {
+			return nil, nil
+		}
+		if err := document.Encode(table); err != nil {
+			return nil, err
+		}
+	default:
+		if err := yaml.Unmarshal(content, &document); err != nil {
+			return nil, err
+		}
+	}
+	if document.Kind == 0 {
+		return nil, nil
+	}
+	return &document, nil
+}
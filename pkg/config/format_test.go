@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDecodeFormats(t *testing.T) {
+	t.Setenv("ARP_TEST_PORT", "8443")
+
+	contents := map[Format]string{
+		FormatYAML: `
+listeners:
+  - name: https
+    port: ${ARP_TEST_PORT}
+    tls:
+      certFile: cert.pem
+      keyFile: key.pem
+providers:
+  - name: file
+    type: file
+    config:
+      path: dynamic.yaml
+log_level: debug
+`,
+		FormatJSON: `{
+  "listeners": [{"name": "https", "port": "${ARP_TEST_PORT}", "tls": {"certFile": "cert.pem", "keyFile": "key.pem"}}],
+  "providers": [{"name": "file", "type": "file", "config": {"path": "dynamic.yaml"}}],
+  "log_level": "debug"
+}`,
+		FormatTOML: `
+log_level = "debug"
+
+[[listeners]]
+name = "https"
+port = "${ARP_TEST_PORT}"
+tls = { certFile = "cert.pem", keyFile = "key.pem" }
+
+[[providers]]
+name = "file"
+type = "file"
+config = { path = "dynamic.yaml" }
+`,
+	}
+	for format, content := range contents {
+		t.Run(string(format), func(t *testing.T) {
+			var cfg Static
+			if err := Decode([]byte(content), format, &cfg); err != nil {
+				t.Fatalf("Failed to decode: %v", err)
+			}
+			if len(cfg.Listeners) != 1 || cfg.Listeners[0].Port != 8443 || cfg.Listeners[0].TLS == nil || cfg.Listeners[0].TLS.KeyFile != "key.pem" {
+				t.Errorf("Unexpected listeners %+v", cfg.Listeners)
+			}
+			if len(cfg.Providers) != 1 || cfg.Providers[0].Config["path"] != "dynamic.yaml" || cfg.LogLevel != "debug" {
+				t.Errorf("Unexpected config %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestDecodeQuotedReferenceStaysString(t *testing.T) {
+	t.Setenv("ARP_TEST_ZONE", "1")
+
+	var cfg Dynamic
+	content := `{"upstreams": [{"name": "backend", "type": "roundrobin", "nodes": [{"url": "http://a", "zone": "zone-${ARP_TEST_ZONE}"}]}]}`
+	if err := Decode([]byte(content), FormatJSON, &cfg); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	if zone := cfg.Upstreams[0].Nodes[0].Zone; zone != "zone-1" {
+		t.Errorf("Expected zone-1, got %s", zone)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	var cfg Dynamic
+	if err := Decode([]byte(`{"routes": [`), FormatJSON, &cfg); err == nil {
+		t.Error("Expected invalid JSON to fail")
+	}
+	if err := Decode([]byte(`routes = [`), FormatTOML, &cfg); err == nil {
+		t.Error("Expected invalid TOML to fail")
+	}
+	for _, format := range []Format{FormatYAML, FormatJSON, FormatTOML} {
+		if err := Decode([]byte("  \n"), format, &cfg); err != nil {
+			t.Errorf("Expected empty %s content to decode, got %v", format, err)
+		}
+	}
+}
+
+// TestRoundTrip checks that the config types keep the same field names in every format.
+func TestRoundTrip(t *testing.T) {
+	original := Dynamic{
+		Routes: []RouteConfig{{
+			Name:     "web",
+			Listener: "http",
+			Matches:  []Match{{Path: "/api", Headers: map[string]string{"X-Env": "prod"}}},
+			Plugins:  []PluginConfig{{Name: "auth", Type: "jwt", Config: map[string]any{"key": "secret", "ttl": 60}}},
+			Upstream: &UpstreamConfig{Name: "backend"},
+		}},
+		Upstreams: []UpstreamConfig{{
+			Name:           "backend",
+			Type:           "roundrobin",
+			Nodes:          []Node{{URL: "http://10.0.0.1:8080", Weight: 2, Zone: "a", Labels: map[string]string{"version": "v2"}}},
+			CircuitBreaker: &CircuitBreakerConfig{MaxConnections: 100},
+			SlowStart:      "30s",
+		}},
+	}
+
+	encoders := map[Format]func(any) ([]byte, error){
+		FormatYAML: yaml.Marshal,
+		FormatJSON: json.Marshal,
+		FormatTOML: func(v any) ([]byte, error) {
+			var buf bytes.Buffer
+			err := toml.NewEncoder(&buf).Encode(v)
+			return buf.Bytes(), err
+		},
+	}
+	for format, encode := range encoders {
+		t.Run(string(format), func(t *testing.T) {
+			content, err := encode(original)
+			if err != nil {
+				t.Fatalf("Failed to encode: %v", err)
+			}
+			var decoded Dynamic
+			if err := Decode(content, format, &decoded); err != nil {
+				t.Fatalf("Failed to decode %s: %v", content, err)
+			}
+			if !reflect.DeepEqual(decoded, original) {
+				t.Errorf("Round trip mismatch\n got: %+v\nwant: %+v\ncontent: %s", decoded, original, content)
+			}
+		})
+	}
+}
+
+func TestFormatOf(t *testing.T) {
+	for path, expected := range map[string]Format{
+		"static.yaml":       FormatYAML,
+		"conf.d/routes.yml": FormatYAML,
+		"dynamic.JSON":      FormatJSON,
+		"dynamic.toml":      FormatTOML,
+		"dynamic":           FormatYAML,
+	} {
+		if format := FormatOf(path); format != expected {
+			t.Errorf("FormatOf(%s) = %s, want %s", path, format, expected)
+		}
+	}
+	if _, err := ParseFormat("xml"); err == nil {
+		t.Error("Expected unsupported format to fail")
+	}
+}
@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Revolyssup/arp/pkg/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// SecretNameParts mark the environment variables holding secrets, matched case insensitively.
+var SecretNameParts = []string{"SECRET", "TOKEN", "PASSWORD", "PASSWD", "KEY", "CREDENTIAL", "AUTH"}
+
+// interpolateNode interpolates the references of the values of the node, see Decode. Values are typed after
+// interpolation when they are unquoted, or in formats that can't express unquoted references when they are made
+// of a single reference, so that ports and weights can be referenced.
+func interpolateNode(node *yaml.Node, path string, typeReferences bool, errs *[]error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return
+		}
+		single := strings.HasPrefix(node.Value, "${") && strings.Index(node.Value, "}") == len(node.Value)-1
+		value, err := Interpolate(node.Value)
+		if err != nil {
+			if node.Line > 0 {
+				*errs = append(*errs, fmt.Errorf("line %d, %s: %w", node.Line, path, err))
+			} else {
+				*errs = append(*errs, fmt.Errorf("%s: %w", path, err))
+			}
+			return
+		}
+		unquoted := node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle) == 0
+		if node.Tag == "!!str" && (unquoted || (typeReferences && single)) {
+			node.Tag = ""
+			node.Style = 0
+		}
+		node.Value = value
+	case yaml.MappingNode:
+		// Keys are left as is
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			interpolateNode(node.Content[i+1], joinPath(path, node.Content[i].Value), typeReferences, errs)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			interpolateNode(child, fmt.Sprintf("%s[%d]", path, i), typeReferences, errs)
+		}
+	default:
+		for _, child := range node.Content {
+			interpolateNode(child, path, typeReferences, errs)
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Interpolate replaces the references of the value, see Decode.
+func Interpolate(value string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(value, "${")
+		if start < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		if start > 0 && value[start-1] == '$' {
+			b.WriteString(value[:start-1] + "${")
+			value = value[start+2:]
+			continue
+		}
+		end := strings.Index(value[start:], "}")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated reference in %q", value)
+		}
+		resolved, secret, err := resolve(value[start+2 : start+end])
+		if err != nil {
+			return "", err
+		}
+		if secret {
+			logger.Redact(resolved)
+		}
+		b.WriteString(value[:start])
+		b.WriteString(resolved)
+		value = value[start+end+1:]
+	}
+}
+
+// resolve returns the value of the reference, and whether it is a secret.
+func resolve(reference string) (string, bool, error) {
+	if path, ok := strings.CutPrefix(reference, "file:"); ok {
+		if path == "" {
+			return "", false, fmt.Errorf("empty file reference")
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read secret file: %v", err)
+		}
+		return strings.TrimSuffix(strings.TrimSuffix(string(content), "\n"), "\r"), true, nil
+	}
+
+	name, fallback, hasFallback := strings.Cut(reference, ":-")
+	if name == "" {
+		return "", false, fmt.Errorf("empty environment variable reference")
+	}
+	value, set := os.LookupEnv(name)
+	if hasFallback && value == "" {
+		// Defaults are written in the config, there is nothing to hide
+		return fallback, false, nil
+	}
+	if !set {
+		return "", false, fmt.Errorf("environment variable %s is not set", name)
+	}
+	upper := strings.ToUpper(name)
+	for _, part := range SecretNameParts {
+		if strings.Contains(upper, part) {
+			return value, true, nil
+		}
+	}
+	return value, false, nil
+}
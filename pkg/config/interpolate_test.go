@@ -0,0 +1,64 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeInterpolation(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "jwt")
+	if err := os.WriteFile(secretFile, []byte("s3cr3t-key\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write secret file: %v", err)
+	}
+	t.Setenv("ARP_TEST_HOST", "10.0.0.1")
+	t.Setenv("ARP_TEST_WEIGHT", "3")
+	t.Setenv("ARP_TEST_EMPTY", "")
+
+	content := `
+upstreams:
+  - name: backend
+    nodes:
+      - url: http://${ARP_TEST_HOST}:${ARP_TEST_PORT:-8080}
+        weight: ${ARP_TEST_WEIGHT}
+        zone: "${ARP_TEST_EMPTY:-a}"
+plugins:
+  - name: auth
+    type: jwt
+    config:
+      key: ${file:` + secretFile + `}
+      literal: $${NOT_INTERPOLATED}
+`
+	var cfg Dynamic
+	if err := Decode([]byte(content), FormatYAML, &cfg); err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+	node := cfg.Upstreams[0].Nodes[0]
+	if node.URL != "http://10.0.0.1:8080" || node.Weight != 3 || node.Zone != "a" {
+		t.Errorf("Unexpected interpolated node %+v", node)
+	}
+	if cfg.Plugins[0].Config["key"] != "s3cr3t-key" || cfg.Plugins[0].Config["literal"] != "${NOT_INTERPOLATED}" {
+		t.Errorf("Unexpected interpolated plugin config %v", cfg.Plugins[0].Config)
+	}
+}
+
+func TestDecodeInterpolationErrors(t *testing.T) {
+	content := `
+routes:
+  - name: web
+    listener: ${ARP_TEST_UNSET}
+    matches:
+      - path: ${file:/nonexistent/secret}
+`
+	var cfg Dynamic
+	err := Decode([]byte(content), FormatYAML, &cfg)
+	if err == nil {
+		t.Fatal("Expected unresolved references to fail")
+	}
+	for _, expected := range []string{"line 4, routes[0].listener: environment variable ARP_TEST_UNSET is not set", "line 6, routes[0].matches[0].path: failed to read secret file"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to contain %q, got %v", expected, err)
+		}
+	}
+}
@@ -1,31 +1,40 @@
 package config
 
 type Static struct {
-	Listeners        []ListenerConfig  `yaml:"listeners"`
-	Providers        []ProviderConfig  `yaml:"providers"`
-	DiscoveryConfigs []DiscoveryConfig `yaml:"discovery"`
-	LogLevel         string            `yaml:"log_level"`
+	Listeners        []ListenerConfig  `yaml:"listeners" json:"listeners" toml:"listeners"`
+	Providers        []ProviderConfig  `yaml:"providers" json:"providers" toml:"providers"`
+	DiscoveryConfigs []DiscoveryConfig `yaml:"discovery" json:"discovery" toml:"discovery"`
+	LogLevel         string            `yaml:"log_level" json:"log_level" toml:"log_level"`
+	Admin            *AdminConfig      `yaml:"admin,omitempty" json:"admin,omitempty" toml:"admin,omitempty"`
+}
+
+// AdminConfig configures the server reporting the health of the proxy.
+type AdminConfig struct {
+	Address string `yaml:"address" json:"address" toml:"address"`
 }
 
 type ListenerConfig struct {
-	Name  string     `yaml:"name"`
-	Port  int        `yaml:"port"`
-	TLS   *TLSConfig `yaml:"tls,omitempty"`
-	HTTP2 bool       `yaml:"http2,omitempty"`
+	Name  string     `yaml:"name" json:"name" toml:"name"`
+	Port  int        `yaml:"port" json:"port" toml:"port"`
+	TLS   *TLSConfig `yaml:"tls,omitempty" json:"tls,omitempty" toml:"tls,omitempty"`
+	HTTP2 bool       `yaml:"http2,omitempty" json:"http2,omitempty" toml:"http2,omitempty"`
 }
 
 type TLSConfig struct {
-	CertFile string `yaml:"certFile"`
-	KeyFile  string `yaml:"keyFile"`
+	CertFile string `yaml:"certFile" json:"certFile" toml:"certFile"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile" toml:"keyFile"`
 }
 
 type ProviderConfig struct {
-	Name   string                 `yaml:"name"`
-	Type   string                 `yaml:"type"`
-	Config map[string]interface{} `yaml:"config"`
+	Name   string                 `yaml:"name" json:"name" toml:"name"`
+	Type   string                 `yaml:"type" json:"type" toml:"type"`
+	Config map[string]interface{} `yaml:"config" json:"config" toml:"config"`
 }
 
 type DiscoveryConfig struct {
-	Type   string                 `yaml:"type"`
-	Config map[string]interface{} `yaml:"config"`
+	Type   string                 `yaml:"type" json:"type" toml:"type"`
+	Config map[string]interface{} `yaml:"config" json:"config" toml:"config"`
+	// StaleAfter marks a service stale when the discovery hasn't published it for that long.
+	// Only meaningful for discoveries publishing periodically.
+	StaleAfter string `yaml:"staleAfter,omitempty" json:"staleAfter,omitempty" toml:"staleAfter,omitempty"`
 }
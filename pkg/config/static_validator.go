@@ -3,6 +3,7 @@ package config
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // ValidationError represents a configuration validation error
@@ -18,8 +19,12 @@ func (e ValidationError) Error() string {
 	return fmt.Sprintf("validation error: %s", e.Message)
 }
 
+// DiscoveryValidator validates the configuration of a discovery type, failing for unknown types.
+type DiscoveryValidator func(typ string, cfg map[string]any) error
+
 type StaticValidator struct {
-	errors []ValidationError
+	errors             []ValidationError
+	discoveryValidator DiscoveryValidator
 }
 
 func NewStaticValidator() *StaticValidator {
@@ -28,6 +33,11 @@ func NewStaticValidator() *StaticValidator {
 	}
 }
 
+// SetDiscoveryValidator makes the validator check discovery configurations against the registered discovery types.
+func (v *StaticValidator) SetDiscoveryValidator(fn DiscoveryValidator) {
+	v.discoveryValidator = fn
+}
+
 // Validate performs all validation checks on the static configuration
 func (v *StaticValidator) Validate(cfg *Static) error {
 	v.errors = make([]ValidationError, 0) // Reset errors
@@ -35,6 +45,9 @@ func (v *StaticValidator) Validate(cfg *Static) error {
 	v.validateListeners(cfg.Listeners)
 	v.validateProviders(cfg.Providers)
 	v.validateDiscoveryConfigs(cfg.DiscoveryConfigs)
+	if cfg.Admin != nil && strings.TrimSpace(cfg.Admin.Address) == "" {
+		v.addError("admin.address", "admin address cannot be empty")
+	}
 
 	if len(v.errors) > 0 {
 		return v.ToError()
@@ -102,6 +115,11 @@ func (v *StaticValidator) validateProviders(providers []ProviderConfig) {
 			v.addError(fmt.Sprintf("providers[%d].name", i), "provider name cannot be empty")
 		}
 
+		// The provider name qualifies the names of the objects it provides, like route@file
+		if strings.Contains(provider.Name, "@") {
+			v.addError(fmt.Sprintf("providers[%d].name", i), "provider name cannot contain '@'")
+		}
+
 		// Check for duplicate names
 		if seenNames[provider.Name] {
 			v.addError(fmt.Sprintf("providers[%d].name", i),
@@ -132,6 +150,19 @@ func (v *StaticValidator) validateDiscoveryConfigs(discoveries []DiscoveryConfig
 				fmt.Sprintf("duplicate discovery type: %s", discovery.Type))
 		}
 		seenTypes[discovery.Type] = true
+
+		if discovery.StaleAfter != "" {
+			if d, err := time.ParseDuration(discovery.StaleAfter); err != nil || d <= 0 {
+				v.addError(fmt.Sprintf("discovery[%d].staleAfter", i),
+					fmt.Sprintf("invalid duration: %s", discovery.StaleAfter))
+			}
+		}
+
+		if v.discoveryValidator != nil && strings.TrimSpace(discovery.Type) != "" {
+			if err := v.discoveryValidator(discovery.Type, discovery.Config); err != nil {
+				v.addError(fmt.Sprintf("discovery[%d]", i), err.Error())
+			}
+		}
 	}
 }
 
@@ -0,0 +1,270 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/discovery"
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+)
+
+const (
+	DefaultAddress       = "http://127.0.0.1:8500"
+	DefaultWait          = 5 * time.Minute
+	DefaultRetryInterval = 5 * time.Second
+
+	// TagLabelPrefix prefixes the labels set for every tag of a service instance, with "true" as value.
+	// Service metadata is copied to the labels as is.
+	TagLabelPrefix = "tag."
+	// MetaZone is the service metadata key holding the zone of an instance
+	MetaZone = "zone"
+	// MetaScheme is the service metadata key overriding the scheme used for an instance
+	MetaScheme = "scheme"
+
+	indexHeader = "X-Consul-Index"
+	tokenHeader = "X-Consul-Token"
+)
+
+// ConsulDiscovery tracks the passing instances of the services referenced by upstreams through the
+// health API, using blocking queries so that changes are published as soon as Consul knows about them.
+//
+// Upstreams can set the tag param to a comma separated list of tags the instances must have, and the
+// datacenter param to query another datacenter than the configured one.
+type ConsulDiscovery struct {
+	address       string
+	token         string
+	datacenter    string
+	wait          time.Duration
+	retryInterval time.Duration
+	client        *http.Client
+
+	mu      sync.Mutex
+	ctx     context.Context
+	name    string
+	eb      *eventbus.EventBus[[]*upstream.Node]
+	watches *discovery.Watches
+	log     *logger.Logger
+}
+
+// serviceEntry is an entry of the /v1/health/service/:service response.
+type serviceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Tags    []string          `json:"Tags"`
+		Meta    map[string]string `json:"Meta"`
+		Weights struct {
+			Passing int `json:"Passing"`
+		} `json:"Weights"`
+	} `json:"Service"`
+}
+
+func New(cfg map[string]any, log *logger.Logger) (discovery.Discovery, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	d := &ConsulDiscovery{
+		address:       DefaultAddress,
+		wait:          DefaultWait,
+		retryInterval: DefaultRetryInterval,
+		watches:       discovery.NewWatches(),
+		log:           log.WithComponent("consul_discovery"),
+	}
+	if address, ok := cfg["address"].(string); ok {
+		d.address = address
+	}
+	if token, ok := cfg["token"].(string); ok {
+		d.token = token
+	}
+	if datacenter, ok := cfg["datacenter"].(string); ok {
+		d.datacenter = datacenter
+	}
+	if wait, ok := cfg["wait"].(string); ok {
+		d.wait, _ = time.ParseDuration(wait)
+	}
+	if interval, ok := cfg["retryInterval"].(string); ok {
+		d.retryInterval, _ = time.ParseDuration(interval)
+	}
+	// Blocking queries are held by Consul for up to wait plus a jitter of wait/16
+	d.client = &http.Client{Timeout: d.wait + d.wait/16 + 10*time.Second}
+	return d, nil
+}
+
+func ValidateConfig(cfg map[string]any) error {
+	for _, key := range []string{"address", "token", "datacenter", "wait", "retryInterval"} {
+		if value, exists := cfg[key]; exists {
+			if _, ok := value.(string); !ok {
+				return fmt.Errorf("%s must be a string", key)
+			}
+		}
+	}
+	if address, ok := cfg["address"].(string); ok {
+		if u, err := url.Parse(address); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid address %s", address)
+		}
+	}
+	for _, key := range []string{"wait", "retryInterval"} {
+		if value, ok := cfg[key].(string); ok {
+			if dur, err := time.ParseDuration(value); err != nil || dur <= 0 {
+				return fmt.Errorf("invalid %s %s", key, value)
+			}
+		}
+	}
+	return nil
+}
+
+func (d *ConsulDiscovery) Start(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node], cfg map[string]any) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ctx = ctx
+	d.name = name
+	d.eb = eb
+	d.log.Infof("Starting Consul discovery using %s", d.address)
+	return nil
+}
+
+// WatchService tracks the service until every upstream referencing it has stopped watching.
+func (d *ConsulDiscovery) WatchService(service string, params map[string]string) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	topic := types.ServiceDiscoveryParamsEventKey(d.name, service, params)
+	q := serviceQuery{service: service, datacenter: d.datacenter, selector: discovery.Selector(params, "tag", "datacenter")}
+	if tags := params["tag"]; tags != "" {
+		q.tags = strings.Split(tags, ",")
+	}
+	if datacenter := params["datacenter"]; datacenter != "" {
+		q.datacenter = datacenter
+	}
+	return d.watches.Start(d.ctx, topic, func(ctx context.Context) { d.watch(ctx, topic, q) })
+}
+
+// serviceQuery is a service queried with the params of an upstream.
+type serviceQuery struct {
+	service    string
+	tags       []string
+	datacenter string
+	selector   map[string]string
+}
+
+func (d *ConsulDiscovery) watch(ctx context.Context, topic string, q serviceQuery) {
+	service := q.service
+	var index uint64
+	for {
+		entries, newIndex, err := d.health(ctx, q, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			// The last nodes are kept until Consul answers again
+			d.log.Errorf("Failed to query service %s, retrying in %s: %v", service, d.retryInterval, err)
+			index = 0
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(d.retryInterval):
+			}
+			continue
+		}
+		if newIndex == index {
+			// The blocking query timed out without changes
+			continue
+		}
+		if newIndex < index {
+			// The index went backwards, e.g. after a snapshot restore. Start over as advised by Consul.
+			index = 0
+		} else {
+			index = newIndex
+		}
+
+		nodes := make([]*upstream.Node, 0, len(entries))
+		for _, entry := range entries {
+			nodes = append(nodes, newNode(service, entry))
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].URL.String() < nodes[j].URL.String() })
+		d.log.Debugf("Consul discovery publishing %d nodes for service %s at index %d", len(nodes), service, index)
+		d.eb.Publish(topic, discovery.FilterNodes(nodes, q.selector))
+	}
+}
+
+// health runs a blocking query for the passing instances of the service, returning once the index changed
+// or the wait time elapsed.
+func (d *ConsulDiscovery) health(ctx context.Context, q serviceQuery, index uint64) ([]serviceEntry, uint64, error) {
+	query := url.Values{}
+	query.Set("passing", "true")
+	for _, tag := range q.tags {
+		query.Add("tag", tag)
+	}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", d.wait.String())
+	}
+	if q.datacenter != "" {
+		query.Set("dc", q.datacenter)
+	}
+	reqURL := d.address + "/v1/health/service/" + url.PathEscape(q.service) + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.token != "" {
+		req.Header.Set(tokenHeader, d.token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	newIndex, err := strconv.ParseUint(resp.Header.Get(indexHeader), 10, 64)
+	if err != nil || newIndex == 0 {
+		return nil, 0, fmt.Errorf("invalid %s header %q", indexHeader, resp.Header.Get(indexHeader))
+	}
+	var entries []serviceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, fmt.Errorf("invalid response: %v", err)
+	}
+	return entries, newIndex, nil
+}
+
+func newNode(service string, entry serviceEntry) *upstream.Node {
+	address := entry.Service.Address
+	if address == "" {
+		address = entry.Node.Address
+	}
+	labels := make(map[string]string, len(entry.Service.Meta)+len(entry.Service.Tags))
+	for key, value := range entry.Service.Meta {
+		labels[key] = value
+	}
+	for _, tag := range entry.Service.Tags {
+		labels[TagLabelPrefix+tag] = "true"
+	}
+	scheme := "http"
+	if s := entry.Service.Meta[MetaScheme]; s != "" {
+		scheme = s
+	}
+	return &upstream.Node{
+		ServiceName: service,
+		URL:         &url.URL{Scheme: scheme, Host: net.JoinHostPort(address, strconv.Itoa(entry.Service.Port))},
+		Weight:      entry.Service.Weights.Passing,
+		Zone:        entry.Service.Meta[MetaZone],
+		Labels:      labels,
+	}
+}
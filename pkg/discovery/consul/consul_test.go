@@ -0,0 +1,167 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+)
+
+// fakeConsul implements blocking queries of the health endpoint for a single service.
+type fakeConsul struct {
+	mu      sync.Mutex
+	index   uint64
+	entries []map[string]any
+	changed chan struct{}
+	queries int
+	failing bool
+}
+
+func newFakeConsul(t *testing.T) (*fakeConsul, string) {
+	t.Helper()
+	fake := &fakeConsul{index: 1, changed: make(chan struct{})}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/web" || r.URL.Query().Get("passing") != "true" || r.Header.Get(tokenHeader) != "secret" {
+		http.NotFound(w, r)
+		return
+	}
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+
+	f.mu.Lock()
+	f.queries++
+	changed := f.changed
+	blocking := index > 0 && index >= f.index
+	f.mu.Unlock()
+	if blocking {
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failing {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(indexHeader, strconv.FormatUint(f.index, 10))
+	json.NewEncoder(w).Encode(f.entries)
+}
+
+func (f *fakeConsul) set(entries ...map[string]any) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = entries
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+func (f *fakeConsul) queryCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.queries
+}
+
+func entry(address string, port int, tags []string, meta map[string]string) map[string]any {
+	return map[string]any{
+		"Node": map[string]any{"Address": "192.168.0.1"},
+		"Service": map[string]any{
+			"Address": address,
+			"Port":    port,
+			"Tags":    tags,
+			"Meta":    meta,
+			"Weights": map[string]any{"Passing": 2, "Warning": 1},
+		},
+	}
+}
+
+func expectNodes(t *testing.T, ch <-chan []*upstream.Node, check func([]*upstream.Node) bool) []*upstream.Node {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case nodes := <-ch:
+			if check(nodes) {
+				return nodes
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for expected nodes")
+			return nil
+		}
+	}
+}
+
+func TestConsulDiscovery(t *testing.T) {
+	fake, address := newFakeConsul(t)
+	fake.set(entry("10.0.0.1", 8080, []string{"primary"}, map[string]string{"zone": "a", "version": "v2"}))
+
+	log := logger.New(logger.LevelInfo)
+	cfg := map[string]any{"address": address, "token": "secret", "wait": "2s", "retryInterval": "100ms"}
+	d, err := New(cfg, log)
+	if err != nil {
+		t.Fatalf("Failed to create consul discovery: %v", err)
+	}
+	eb := eventbus.NewEventBus[[]*upstream.Node](log)
+	if err := d.Start(t.Context(), "consul", eb, cfg); err != nil {
+		t.Fatalf("Failed to start consul discovery: %v", err)
+	}
+	ch := eb.Subscribe(types.ServiceDiscoveryEventKey("consul", "web"))
+	stop := d.(*ConsulDiscovery).WatchService("web", nil)
+	defer stop()
+
+	nodes := expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+	node := nodes[0]
+	if node.URL.String() != "http://10.0.0.1:8080" || node.Weight != 2 || node.Zone != "a" {
+		t.Errorf("Expected node from service entry, got %+v", node)
+	}
+	if node.Labels["tag.primary"] != "true" || node.Labels["version"] != "v2" {
+		t.Errorf("Expected tags and metadata as labels, got %v", node.Labels)
+	}
+
+	// Changes are picked up by the pending blocking query
+	queries := fake.queryCount()
+	fake.set(
+		entry("10.0.0.1", 8080, nil, nil),
+		entry("", 9090, nil, nil),
+	)
+	nodes = expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 2 })
+	if nodes[1].URL.String() != "http://192.168.0.1:9090" {
+		t.Errorf("Expected node address when the service has none, got %s", nodes[1].URL)
+	}
+	if fake.queryCount() != queries+1 {
+		t.Errorf("Expected the change to be delivered by the blocking query, got %d queries", fake.queryCount()-queries)
+	}
+
+	// Failures keep the last nodes
+	fake.mu.Lock()
+	fake.failing = true
+	fake.mu.Unlock()
+	fake.set()
+	select {
+	case nodes := <-ch:
+		t.Errorf("Expected no update while Consul fails, got %d nodes", len(nodes))
+	case <-time.After(300 * time.Millisecond):
+	}
+	fake.mu.Lock()
+	fake.failing = false
+	fake.mu.Unlock()
+	expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 0 })
+}
@@ -2,6 +2,7 @@ package demo
 
 import (
 	"context"
+	"fmt"
 	"net/url"
 	"time"
 
@@ -12,12 +13,28 @@ import (
 	"github.com/Revolyssup/arp/pkg/upstream"
 )
 
-func New(cfg map[string]any, log *logger.Logger) discovery.Discovery {
+func New(cfg map[string]any, log *logger.Logger) (discovery.Discovery, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
 	return &DemoDiscovery{
 		eb:  eventbus.NewEventBus[[]*upstream.Node](log.WithComponent("demo_discovery")),
 		cfg: cfg,
 		log: log.WithComponent("demo_discovery"),
+	}, nil
+}
+
+func ValidateConfig(cfg map[string]any) error {
+	if interval, exists := cfg["interval"]; exists {
+		str, ok := interval.(string)
+		if !ok {
+			return fmt.Errorf("interval must be a duration string")
+		}
+		if _, err := time.ParseDuration(str); err != nil {
+			return fmt.Errorf("invalid interval %s: %v", str, err)
+		}
 	}
+	return nil
 }
 
 type DemoDiscovery struct {
@@ -2,11 +2,119 @@ package discovery
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
 	"github.com/Revolyssup/arp/pkg/upstream"
 )
 
 type Discovery interface {
 	Start(ctx context.Context, typ string, eb *eventbus.EventBus[[]*upstream.Node], config map[string]any) error
 }
+
+// ServiceWatcher is implemented by discoverers that only look services up once an upstream references them,
+// instead of publishing every service they know about. The nodes are published on the topic given by
+// types.ServiceDiscoveryParamsEventKey.
+type ServiceWatcher interface {
+	// WatchService starts publishing the service's nodes until the returned stop func is called. The params of
+	// the upstream's discovery reference the discoverer doesn't know about select nodes by label.
+	WatchService(service string, params map[string]string) (stop func())
+}
+
+// Selector returns the params that aren't among the discoverer's own, to be matched against node labels.
+func Selector(params map[string]string, own ...string) map[string]string {
+	selector := make(map[string]string, len(params))
+	for k, v := range params {
+		selector[k] = v
+	}
+	for _, k := range own {
+		delete(selector, k)
+	}
+	return selector
+}
+
+// FilterNodes returns the nodes having every label of the selector.
+func FilterNodes(nodes []*upstream.Node, selector map[string]string) []*upstream.Node {
+	if len(selector) == 0 {
+		return nodes
+	}
+	filtered := make([]*upstream.Node, 0, len(nodes))
+	for _, node := range nodes {
+		matches := true
+		for k, v := range selector {
+			if value, exists := node.Labels[k]; !exists || value != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered = append(filtered, node)
+		}
+	}
+	return filtered
+}
+
+// Factory creates a discoverer from its static configuration.
+type Factory func(cfg map[string]any, log *logger.Logger) (Discovery, error)
+
+// ConfigValidator validates the static configuration of a discovery type.
+type ConfigValidator func(cfg map[string]any) error
+
+// ReferenceValidator validates the service and params of the upstreams referencing a discovery type.
+type ReferenceValidator func(service string, params map[string]string) error
+
+type Registry struct {
+	factories           map[string]Factory
+	validators          map[string]ConfigValidator
+	referenceValidators map[string]ReferenceValidator
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		factories:           make(map[string]Factory),
+		validators:          make(map[string]ConfigValidator),
+		referenceValidators: make(map[string]ReferenceValidator),
+	}
+}
+
+// Register adds a discovery type. The validator is optional.
+func (r *Registry) Register(typ string, factory Factory, validator ConfigValidator) {
+	r.factories[typ] = factory
+	if validator != nil {
+		r.validators[typ] = validator
+	}
+}
+
+func (r *Registry) Get(typ string) (Factory, bool) {
+	f, exists := r.factories[typ]
+	return f, exists
+}
+
+// Validate checks that the discovery type is registered and its configuration is valid.
+func (r *Registry) Validate(typ string, cfg map[string]any) error {
+	if _, exists := r.factories[typ]; !exists {
+		return fmt.Errorf("unsupported discovery type: %s", typ)
+	}
+	if validate, exists := r.validators[typ]; exists {
+		return validate(cfg)
+	}
+	return nil
+}
+
+// RegisterReferenceValidator sets the validator of the upstreams referencing the discovery type.
+func (r *Registry) RegisterReferenceValidator(typ string, validator ReferenceValidator) {
+	r.referenceValidators[typ] = validator
+}
+
+// ValidateReference checks that the discovery type is registered and the service and params of an upstream
+// referencing it are valid.
+func (r *Registry) ValidateReference(typ, service string, params map[string]string) error {
+	if _, exists := r.factories[typ]; !exists {
+		return fmt.Errorf("unsupported discovery type: %s", typ)
+	}
+	if validate, exists := r.referenceValidators[typ]; exists {
+		return validate(service, params)
+	}
+	return nil
+}
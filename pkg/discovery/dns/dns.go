@@ -0,0 +1,434 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/discovery"
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DefaultInterval = 30 * time.Second
+	DefaultMinTTL   = time.Second
+	DefaultTimeout  = 2 * time.Second
+	DefaultPort     = 80
+
+	// OnFailureKeep keeps publishing the last resolved nodes when a lookup fails
+	OnFailureKeep = "keep"
+	// OnFailureClear publishes an empty node list when a lookup fails
+	OnFailureClear = "clear"
+
+	fallbackResolver = "127.0.0.1:53"
+	resolvConf       = "/etc/resolv.conf"
+)
+
+// DNSDiscovery resolves the services referenced by upstreams. Service names starting with an underscore,
+// like _http._tcp.service.internal, are looked up as SRV records whose priority, weight and port are
+// mapped to the nodes. Any other name is looked up as A and AAAA records, with an optional port suffix
+// (service.internal:8080). Services are resolved again when the shortest TTL of their records expires.
+//
+// Upstreams can set the port and scheme params to override the configured defaults.
+type DNSDiscovery struct {
+	resolver  string
+	interval  time.Duration
+	minTTL    time.Duration
+	timeout   time.Duration
+	port      string
+	scheme    string
+	onFailure string
+
+	mu      sync.Mutex
+	ctx     context.Context
+	name    string
+	eb      *eventbus.EventBus[[]*upstream.Node]
+	watches *discovery.Watches
+	log     *logger.Logger
+}
+
+func New(cfg map[string]any, log *logger.Logger) (discovery.Discovery, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	d := &DNSDiscovery{
+		resolver:  defaultResolver(),
+		interval:  DefaultInterval,
+		minTTL:    DefaultMinTTL,
+		timeout:   DefaultTimeout,
+		port:      strconv.Itoa(DefaultPort),
+		scheme:    "http",
+		onFailure: OnFailureKeep,
+		watches:   discovery.NewWatches(),
+		log:       log.WithComponent("dns_discovery"),
+	}
+	if resolver, ok := cfg["resolver"].(string); ok {
+		d.resolver = resolver
+	}
+	if interval, ok := cfg["interval"].(string); ok {
+		d.interval, _ = time.ParseDuration(interval)
+	}
+	if minTTL, ok := cfg["minTTL"].(string); ok {
+		d.minTTL, _ = time.ParseDuration(minTTL)
+	}
+	if timeout, ok := cfg["timeout"].(string); ok {
+		d.timeout, _ = time.ParseDuration(timeout)
+	}
+	if port, ok := toInt(cfg["port"]); ok {
+		d.port = strconv.Itoa(port)
+	}
+	if scheme, ok := cfg["scheme"].(string); ok {
+		d.scheme = scheme
+	}
+	if onFailure, ok := cfg["onFailure"].(string); ok {
+		d.onFailure = onFailure
+	}
+	return d, nil
+}
+
+func ValidateConfig(cfg map[string]any) error {
+	for _, key := range []string{"resolver", "interval", "minTTL", "timeout", "scheme", "onFailure"} {
+		if value, exists := cfg[key]; exists {
+			if _, ok := value.(string); !ok {
+				return fmt.Errorf("%s must be a string", key)
+			}
+		}
+	}
+	if resolver, ok := cfg["resolver"].(string); ok {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			return fmt.Errorf("invalid resolver %s: %v", resolver, err)
+		}
+	}
+	for _, key := range []string{"interval", "minTTL", "timeout"} {
+		if value, ok := cfg[key].(string); ok {
+			if dur, err := time.ParseDuration(value); err != nil || dur <= 0 {
+				return fmt.Errorf("invalid %s %s", key, value)
+			}
+		}
+	}
+	if port, exists := cfg["port"]; exists {
+		if p, ok := toInt(port); !ok || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port %v", port)
+		}
+	}
+	if onFailure, ok := cfg["onFailure"].(string); ok && onFailure != OnFailureKeep && onFailure != OnFailureClear {
+		return fmt.Errorf("onFailure must be %s or %s, got %s", OnFailureKeep, OnFailureClear, onFailure)
+	}
+	return nil
+}
+
+// ValidateReference validates the port and scheme params overriding the ones of the discovery. Resolved nodes have
+// no label to select them by, so other params are rejected.
+func ValidateReference(service string, params map[string]string) error {
+	for key := range params {
+		if key != "port" && key != "scheme" {
+			return fmt.Errorf("unknown param %s, dns discovery only supports port and scheme", key)
+		}
+	}
+	if port, exists := params["port"]; exists {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port %s", port)
+		}
+	}
+	return nil
+}
+
+func (d *DNSDiscovery) Start(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node], cfg map[string]any) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ctx = ctx
+	d.name = name
+	d.eb = eb
+	d.log.Infof("Starting DNS discovery using resolver %s", d.resolver)
+	return nil
+}
+
+// WatchService resolves the service until every upstream referencing it has stopped watching.
+func (d *DNSDiscovery) WatchService(service string, params map[string]string) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	topic := types.ServiceDiscoveryParamsEventKey(d.name, service, params)
+	l := lookup{service: service, port: d.port, scheme: d.scheme}
+	if port := params["port"]; port != "" {
+		l.port = port
+	}
+	if scheme := params["scheme"]; scheme != "" {
+		l.scheme = scheme
+	}
+	return d.watches.Start(d.ctx, topic, func(ctx context.Context) { d.watch(ctx, topic, l) })
+}
+
+// lookup is a service resolved with the params of an upstream.
+type lookup struct {
+	service string
+	port    string
+	scheme  string
+}
+
+func (d *DNSDiscovery) watch(ctx context.Context, topic string, l lookup) {
+	for {
+		delay := d.interval
+		nodes, ttl, err := d.resolve(ctx, l)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			d.log.Errorf("Failed to resolve service %s, retrying in %s: %v", l.service, delay, err)
+			if d.onFailure == OnFailureClear {
+				d.eb.Publish(topic, []*upstream.Node{})
+			}
+		} else {
+			d.log.Debugf("DNS discovery publishing %d nodes for service %s", len(nodes), l.service)
+			d.eb.Publish(topic, nodes)
+			if len(nodes) > 0 {
+				delay = min(max(ttl, d.minTTL), d.interval)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// resolve returns the nodes of the service and the shortest TTL of the records they were resolved from.
+func (d *DNSDiscovery) resolve(ctx context.Context, l lookup) ([]*upstream.Node, time.Duration, error) {
+	var nodes []*upstream.Node
+	var ttl uint32
+	var err error
+	if strings.HasPrefix(l.service, "_") {
+		nodes, ttl, err = d.resolveSRV(ctx, l)
+	} else {
+		host, port, splitErr := net.SplitHostPort(l.service)
+		if splitErr != nil {
+			host, port = l.service, l.port
+		}
+		var ips []net.IP
+		ips, ttl, err = d.lookupHost(ctx, host, nil)
+		for _, ip := range ips {
+			nodes = append(nodes, newNode(l, ip, port))
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if nodes == nil {
+		nodes = []*upstream.Node{}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].URL.String() < nodes[j].URL.String() })
+	return nodes, time.Duration(ttl) * time.Second, nil
+}
+
+func (d *DNSDiscovery) resolveSRV(ctx context.Context, l lookup) ([]*upstream.Node, uint32, error) {
+	msg, err := d.query(ctx, l.service, dnsmessage.TypeSRV)
+	if err != nil {
+		return nil, 0, err
+	}
+	var nodes []*upstream.Node
+	ttl := minTTL(msg.Answers)
+	for _, answer := range msg.Answers {
+		srv, ok := answer.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		ips, hostTTL, err := d.lookupHost(ctx, srv.Target.String(), msg.Additionals)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to resolve SRV target %s: %w", srv.Target, err)
+		}
+		ttl = min(ttl, hostTTL)
+		for _, ip := range ips {
+			node := newNode(l, ip, strconv.Itoa(int(srv.Port)))
+			node.Priority = int(srv.Priority)
+			node.Weight = int(srv.Weight)
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes, ttl, nil
+}
+
+// lookupHost returns the addresses of the host, taking them from the additional records of a previous
+// response when present.
+func (d *DNSDiscovery) lookupHost(ctx context.Context, host string, additionals []dnsmessage.Resource) ([]net.IP, uint32, error) {
+	var records []dnsmessage.Resource
+	for _, additional := range additionals {
+		if strings.EqualFold(additional.Header.Name.String(), fqdn(host)) {
+			records = append(records, additional)
+		}
+	}
+	if len(records) == 0 {
+		for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+			msg, err := d.query(ctx, host, qtype)
+			if err != nil {
+				return nil, 0, err
+			}
+			records = append(records, msg.Answers...)
+		}
+	}
+
+	var ips []net.IP
+	var addressRecords []dnsmessage.Resource
+	for _, record := range records {
+		switch body := record.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		addressRecords = append(addressRecords, record)
+	}
+	return ips, minTTL(addressRecords), nil
+}
+
+// query sends the question to the resolver over UDP, falling back to TCP for truncated responses.
+// A name that doesn't exist yields a response without answers.
+func (d *DNSDiscovery) query(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	qname, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, fmt.Errorf("invalid name %s: %v", name, err)
+	}
+	req := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query for %s: %v", name, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	resp, err := d.exchange(ctx, "udp", packed, req.ID)
+	if err == nil && resp.Truncated {
+		resp, err = d.exchange(ctx, "tcp", packed, req.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query %s %s: %w", qtype, name, err)
+	}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+		return resp, nil
+	case dnsmessage.RCodeNameError:
+		return &dnsmessage.Message{Header: resp.Header}, nil
+	default:
+		return nil, fmt.Errorf("query %s %s failed with %s", qtype, name, resp.RCode)
+	}
+}
+
+func (d *DNSDiscovery) exchange(ctx context.Context, network string, packed []byte, id uint16) (*dnsmessage.Message, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, d.resolver)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	buf := make([]byte, 65535)
+	var n int
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(packed)))); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(buf[:2]))
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		if n, err = conn.Read(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(buf[:n]); err != nil {
+		return nil, fmt.Errorf("invalid response: %v", err)
+	}
+	if resp.ID != id {
+		return nil, errors.New("response ID doesn't match the query")
+	}
+	return &resp, nil
+}
+
+func newNode(l lookup, ip net.IP, port string) *upstream.Node {
+	return &upstream.Node{
+		ServiceName: l.service,
+		URL:         &url.URL{Scheme: l.scheme, Host: net.JoinHostPort(ip.String(), port)},
+	}
+}
+
+func minTTL(records []dnsmessage.Resource) uint32 {
+	var ttl uint32
+	for i, record := range records {
+		if i == 0 || record.Header.TTL < ttl {
+			ttl = record.Header.TTL
+		}
+	}
+	return ttl
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// defaultResolver returns the first nameserver of the system configuration.
+func defaultResolver() string {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return fallbackResolver
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53")
+		}
+	}
+	return fallbackResolver
+}
+
+func toInt(value any) (int, bool) {
+	switch v := value.(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	case float64:
+		return int(v), v == float64(int(v))
+	}
+	return 0, false
+}
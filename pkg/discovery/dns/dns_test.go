@@ -0,0 +1,228 @@
+package dns
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS answers queries over UDP from a fixed set of records.
+type fakeDNS struct {
+	mu      sync.Mutex
+	records map[string][]dnsmessage.Resource
+	failing bool
+}
+
+func newFakeDNS(t *testing.T) (*fakeDNS, string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fake := &fakeDNS{records: make(map[string][]dnsmessage.Resource)}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := fake.answer(buf[:n]); resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return fake, conn.LocalAddr().String()
+}
+
+func (f *fakeDNS) answer(packet []byte) []byte {
+	var req dnsmessage.Message
+	if err := req.Unpack(packet); err != nil || len(req.Questions) != 1 {
+		return nil
+	}
+	q := req.Questions[0]
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: req.ID, Response: true},
+		Questions: req.Questions,
+	}
+	switch {
+	case f.failing:
+		resp.RCode = dnsmessage.RCodeServerFailure
+	default:
+		for _, record := range f.records[q.Name.String()] {
+			if record.Header.Type == q.Type {
+				resp.Answers = append(resp.Answers, record)
+			}
+		}
+	}
+	packed, _ := resp.Pack()
+	return packed
+}
+
+func (f *fakeDNS) set(name string, records ...dnsmessage.Resource) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range records {
+		records[i].Header.Name = dnsmessage.MustNewName(name)
+		records[i].Header.Class = dnsmessage.ClassINET
+	}
+	f.records[name] = records
+}
+
+func (f *fakeDNS) setFailing(failing bool) {
+	f.mu.Lock()
+	f.failing = failing
+	f.mu.Unlock()
+}
+
+func a(ip string, ttl uint32) dnsmessage.Resource {
+	var addr [4]byte
+	copy(addr[:], net.ParseIP(ip).To4())
+	return dnsmessage.Resource{Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeA, TTL: ttl}, Body: &dnsmessage.AResource{A: addr}}
+}
+
+func srv(target string, port, priority, weight uint16) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Type: dnsmessage.TypeSRV, TTL: 60},
+		Body:   &dnsmessage.SRVResource{Target: dnsmessage.MustNewName(target), Port: port, Priority: priority, Weight: weight},
+	}
+}
+
+func startDiscovery(t *testing.T, resolver string, service string, cfg map[string]any) <-chan []*upstream.Node {
+	t.Helper()
+	log := logger.New(logger.LevelInfo)
+	cfg["resolver"] = resolver
+	d, err := New(cfg, log)
+	if err != nil {
+		t.Fatalf("Failed to create DNS discovery: %v", err)
+	}
+	eb := eventbus.NewEventBus[[]*upstream.Node](log)
+	if err := d.Start(t.Context(), "dns", eb, cfg); err != nil {
+		t.Fatalf("Failed to start DNS discovery: %v", err)
+	}
+	ch := eb.Subscribe(types.ServiceDiscoveryEventKey("dns", service))
+	t.Cleanup(d.(*DNSDiscovery).WatchService(service, nil))
+	return ch
+}
+
+func expectNodes(t *testing.T, ch <-chan []*upstream.Node, check func([]*upstream.Node) bool) []*upstream.Node {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case nodes := <-ch:
+			if check(nodes) {
+				return nodes
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for expected nodes")
+			return nil
+		}
+	}
+}
+
+func TestDNSDiscoveryHonorsTTL(t *testing.T) {
+	fake, resolver := newFakeDNS(t)
+	fake.set("web.internal.", a("10.0.0.1", 1))
+	ch := startDiscovery(t, resolver, "web.internal:8080", map[string]any{"interval": "1m", "minTTL": "100ms"})
+
+	nodes := expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+	if nodes[0].URL.String() != "http://10.0.0.1:8080" {
+		t.Errorf("Expected node on the service port, got %s", nodes[0].URL)
+	}
+
+	// The record is resolved again once its TTL expires, well before the interval
+	fake.set("web.internal.", a("10.0.0.1", 1), a("10.0.0.2", 1))
+	expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 2 })
+}
+
+func TestDNSDiscoverySRV(t *testing.T) {
+	fake, resolver := newFakeDNS(t)
+	fake.set("_http._tcp.web.internal.", srv("primary.internal.", 8080, 0, 5), srv("backup.internal.", 9090, 1, 1))
+	fake.set("primary.internal.", a("10.0.0.1", 60))
+	fake.set("backup.internal.", a("10.0.0.2", 60))
+	ch := startDiscovery(t, resolver, "_http._tcp.web.internal", map[string]any{})
+
+	nodes := expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 2 })
+	primary, backup := nodes[0], nodes[1]
+	if primary.URL.String() != "http://10.0.0.1:8080" || primary.Priority != 0 || primary.Weight != 5 {
+		t.Errorf("Expected primary node from SRV record, got %+v", primary)
+	}
+	if backup.URL.String() != "http://10.0.0.2:9090" || backup.Priority != 1 || backup.Weight != 1 {
+		t.Errorf("Expected backup node from SRV record, got %+v", backup)
+	}
+}
+
+func TestDNSDiscoveryFailure(t *testing.T) {
+	cfg := func(onFailure string) map[string]any {
+		return map[string]any{"interval": "200ms", "minTTL": "100ms", "timeout": "100ms", "onFailure": onFailure}
+	}
+
+	t.Run("keeps last nodes", func(t *testing.T) {
+		fake, resolver := newFakeDNS(t)
+		fake.set("web.internal.", a("10.0.0.1", 1))
+		ch := startDiscovery(t, resolver, "web.internal", cfg(OnFailureKeep))
+		expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+
+		fake.setFailing(true)
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case nodes := <-ch:
+				if len(nodes) != 1 {
+					t.Fatalf("Expected last nodes to be kept, got %d nodes", len(nodes))
+				}
+			case <-timeout:
+				return
+			}
+		}
+	})
+
+	t.Run("clears nodes", func(t *testing.T) {
+		fake, resolver := newFakeDNS(t)
+		fake.set("web.internal.", a("10.0.0.1", 1))
+		ch := startDiscovery(t, resolver, "web.internal", cfg(OnFailureClear))
+		expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+
+		fake.setFailing(true)
+		expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 0 })
+	})
+}
+
+func TestValidateConfig(t *testing.T) {
+	invalid := []map[string]any{
+		{"resolver": "localhost"},
+		{"interval": "0s"},
+		{"port": 70000},
+		{"onFailure": "retry"},
+	}
+	for _, cfg := range invalid {
+		if err := ValidateConfig(cfg); err == nil {
+			t.Errorf("Expected config %v to be invalid", cfg)
+		}
+	}
+	if err := ValidateConfig(map[string]any{"resolver": "127.0.0.1:53", "port": 8080, "interval": "10s"}); err != nil {
+		t.Errorf("Expected config to be valid, got %v", err)
+	}
+}
+
+func TestValidateReference(t *testing.T) {
+	for _, params := range []map[string]string{{"port": "0"}, {"version": "v2"}, {"prt": "8080"}} {
+		if err := ValidateReference("web.internal", params); err == nil {
+			t.Errorf("Expected params %v to be invalid", params)
+		}
+	}
+	if err := ValidateReference("web.internal", map[string]string{"port": "8080", "scheme": "https"}); err != nil {
+		t.Errorf("Expected params to be valid, got %v", err)
+	}
+}
@@ -3,37 +3,288 @@ package docker
 import (
 	"context"
 	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/Revolyssup/arp/pkg/discovery"
 	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
 	"github.com/Revolyssup/arp/pkg/upstream"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/filters"
 	"github.com/moby/moby/client"
 )
 
+const (
+	DefaultLabelPrefix       = "arp"
+	DefaultReconnectInterval = 5 * time.Second
+)
+
+// Container labels, relative to the label prefix, that describe how a container is discovered.
+const (
+	// LabelService is the service the container belongs to. Only containers having it are discovered.
+	LabelService = "service"
+	// LabelPort is the container port to send traffic to. Defaults to the lowest exposed port.
+	LabelPort = "port"
+	// LabelNetwork is the network whose address is used. Defaults to the discovery's network, or the first one.
+	LabelNetwork  = "network"
+	LabelScheme   = "scheme"
+	LabelWeight   = "weight"
+	LabelZone     = "zone"
+	LabelPriority = "priority"
+)
+
+// DockerDiscovery discovers the running containers of the Docker daemon. The node list of each service
+// is published again whenever a labelled container starts, stops or changes health.
 type DockerDiscovery struct {
-	cli    *client.Client
-	cfg    map[string]any
-	ctx    context.Context
-	cancel context.CancelFunc
+	cli               *client.Client
+	network           string
+	labelPrefix       string
+	reconnectInterval time.Duration
+	// Services published on the last refresh, so that services whose containers are all gone get an empty list
+	published map[string]bool
+	log       *logger.Logger
 }
 
-func New(cfg map[string]any) (discovery.Discovery, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+func New(cfg map[string]any, log *logger.Logger) (discovery.Discovery, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host, ok := cfg["host"].(string); ok && host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
 	if err != nil {
-		cancel()
 		return nil, fmt.Errorf("failed to create Docker client: %v", err)
 	}
 
-	return &DockerDiscovery{
-		cli:    cli,
-		cfg:    cfg,
-		ctx:    ctx,
-		cancel: cancel,
-	}, nil
+	d := &DockerDiscovery{
+		cli:               cli,
+		labelPrefix:       DefaultLabelPrefix,
+		reconnectInterval: DefaultReconnectInterval,
+		published:         make(map[string]bool),
+		log:               log.WithComponent("docker_discovery"),
+	}
+	if network, ok := cfg["network"].(string); ok {
+		d.network = network
+	}
+	if prefix, ok := cfg["labelPrefix"].(string); ok && prefix != "" {
+		d.labelPrefix = prefix
+	}
+	if interval, ok := cfg["reconnectInterval"].(string); ok {
+		d.reconnectInterval, _ = time.ParseDuration(interval)
+	}
+	return d, nil
+}
+
+func ValidateConfig(cfg map[string]any) error {
+	for _, key := range []string{"host", "network", "labelPrefix", "reconnectInterval"} {
+		if value, exists := cfg[key]; exists {
+			if _, ok := value.(string); !ok {
+				return fmt.Errorf("%s must be a string", key)
+			}
+		}
+	}
+	if interval, ok := cfg["reconnectInterval"].(string); ok {
+		if dur, err := time.ParseDuration(interval); err != nil || dur <= 0 {
+			return fmt.Errorf("invalid reconnectInterval %s", interval)
+		}
+	}
+	return nil
 }
 
-// TODO: Implement actual discovery logic
-func (d *DockerDiscovery) Start(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node], config map[string]any) error {
+func (d *DockerDiscovery) Start(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node], cfg map[string]any) error {
+	if err := d.refresh(ctx, name, eb); err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+	go func() {
+		defer d.cli.Close()
+		for {
+			err := d.watchEvents(ctx, name, eb)
+			if ctx.Err() != nil {
+				d.log.Info("Docker discovery stopped")
+				return
+			}
+			d.log.Errorf("Docker event stream failed, reconnecting in %s: %v", d.reconnectInterval, err)
+			select {
+			case <-ctx.Done():
+				d.log.Info("Docker discovery stopped")
+				return
+			case <-time.After(d.reconnectInterval):
+			}
+			// Events may have been missed while disconnected
+			if err := d.refresh(ctx, name, eb); err != nil {
+				d.log.Errorf("Failed to list containers: %v", err)
+			}
+		}
+	}()
 	return nil
 }
+
+// watchEvents refreshes the services on every event of a labelled container until the stream fails.
+func (d *DockerDiscovery) watchEvents(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node]) error {
+	messages, errs := d.cli.Events(ctx, client.EventsListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", "container"),
+			filters.Arg("label", d.label(LabelService)),
+		),
+	})
+	for {
+		select {
+		case msg := <-messages:
+			d.log.Debugf("Docker event %s for container %s", msg.Action, msg.Actor.ID)
+			if err := d.refresh(ctx, name, eb); err != nil {
+				d.log.Errorf("Failed to list containers: %v", err)
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+// refresh lists the running labelled containers and publishes the nodes of every service.
+func (d *DockerDiscovery) refresh(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node]) error {
+	containers, err := d.cli.ContainerList(ctx, client.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", d.label(LabelService))),
+	})
+	if err != nil {
+		return err
+	}
+
+	services := make(map[string][]*upstream.Node)
+	for _, c := range containers {
+		if c.State != container.StateRunning {
+			continue
+		}
+		node, err := d.nodeFromContainer(c)
+		if err != nil {
+			d.log.Warnf("Skipping container %s: %v", c.ID, err)
+			continue
+		}
+		services[node.ServiceName] = append(services[node.ServiceName], node)
+	}
+
+	for service := range d.published {
+		if _, exists := services[service]; !exists {
+			services[service] = []*upstream.Node{}
+		}
+	}
+	d.published = make(map[string]bool, len(services))
+	for service, nodes := range services {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].URL.String() < nodes[j].URL.String() })
+		d.log.Debugf("Docker discovery publishing %d nodes for service %s", len(nodes), service)
+		eb.Publish(types.ServiceDiscoveryEventKey(name, service), nodes)
+		if len(nodes) > 0 {
+			d.published[service] = true
+		}
+	}
+	return nil
+}
+
+func (d *DockerDiscovery) nodeFromContainer(c container.Summary) (*upstream.Node, error) {
+	labels := c.Labels
+	ip, err := d.containerIP(c)
+	if err != nil {
+		return nil, err
+	}
+	port, err := d.containerPort(c)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "http"
+	if s := labels[d.label(LabelScheme)]; s != "" {
+		scheme = s
+	}
+
+	node := &upstream.Node{
+		ServiceName: labels[d.label(LabelService)],
+		URL:         &url.URL{Scheme: scheme, Host: ip + ":" + port},
+		Zone:        labels[d.label(LabelZone)],
+		Labels:      labels,
+		// Containers whose health check hasn't passed yet don't get traffic either
+		Unhealthy: c.Health != nil && (c.Health.Status == container.Unhealthy || c.Health.Status == container.Starting),
+	}
+	if w := labels[d.label(LabelWeight)]; w != "" {
+		if node.Weight, err = strconv.Atoi(w); err != nil {
+			return nil, fmt.Errorf("invalid %s label %q: %v", d.label(LabelWeight), w, err)
+		}
+	}
+	if p := labels[d.label(LabelPriority)]; p != "" {
+		if node.Priority, err = strconv.Atoi(p); err != nil {
+			return nil, fmt.Errorf("invalid %s label %q: %v", d.label(LabelPriority), p, err)
+		}
+	}
+	return node, nil
+}
+
+// containerIP returns the container's address on the network set by label, or on the discovery's network.
+func (d *DockerDiscovery) containerIP(c container.Summary) (string, error) {
+	network := c.Labels[d.label(LabelNetwork)]
+	if network == "" {
+		network = d.network
+	}
+	return ContainerIP(c, network)
+}
+
+// containerPort returns the port set by label, or the lowest port exposed by the container.
+func (d *DockerDiscovery) containerPort(c container.Summary) (string, error) {
+	port, err := ContainerPort(c, c.Labels[d.label(LabelPort)])
+	if err != nil {
+		return "", fmt.Errorf("%v, check the %s label", err, d.label(LabelPort))
+	}
+	return port, nil
+}
+
+// ContainerIP returns the container's address on the network, or on its first network when empty.
+func ContainerIP(c container.Summary, network string) (string, error) {
+	if c.NetworkSettings == nil || len(c.NetworkSettings.Networks) == 0 {
+		return "", fmt.Errorf("container is not attached to any network")
+	}
+	if network != "" {
+		endpoint, ok := c.NetworkSettings.Networks[network]
+		if !ok || endpoint == nil || endpoint.IPAddress == "" {
+			return "", fmt.Errorf("container has no address on network %s", network)
+		}
+		return endpoint.IPAddress, nil
+	}
+
+	names := make([]string, 0, len(c.NetworkSettings.Networks))
+	for name := range c.NetworkSettings.Networks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if endpoint := c.NetworkSettings.Networks[name]; endpoint != nil && endpoint.IPAddress != "" {
+			return endpoint.IPAddress, nil
+		}
+	}
+	return "", fmt.Errorf("container has no network address")
+}
+
+// ContainerPort validates the port when set, and returns the lowest port exposed by the container otherwise.
+func ContainerPort(c container.Summary, port string) (string, error) {
+	if port != "" {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", fmt.Errorf("invalid port %q", port)
+		}
+		return port, nil
+	}
+	var lowest uint16
+	for _, p := range c.Ports {
+		if lowest == 0 || p.PrivatePort < lowest {
+			lowest = p.PrivatePort
+		}
+	}
+	if lowest == 0 {
+		return "", fmt.Errorf("container exposes no port")
+	}
+	return strconv.Itoa(int(lowest)), nil
+}
+
+func (d *DockerDiscovery) label(name string) string {
+	return d.labelPrefix + "." + name
+}
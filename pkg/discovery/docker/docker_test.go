@@ -0,0 +1,162 @@
+package docker
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/api/types/network"
+)
+
+// fakeDocker implements the parts of the Docker Engine API used by the discovery.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []container.Summary
+	events     chan events.Message
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, string) {
+	t.Helper()
+	fake := &fakeDocker{events: make(chan events.Message, 10)}
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+	server := &http.Server{Handler: fake}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return fake, "unix://" + socket
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_ping"):
+		w.Header().Set("Api-Version", "1.52")
+		w.Write([]byte("OK"))
+	case strings.HasSuffix(r.URL.Path, "/containers/json"):
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		json.NewEncoder(w).Encode(f.containers)
+	case strings.HasSuffix(r.URL.Path, "/events"):
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case msg := <-f.events:
+				json.NewEncoder(w).Encode(msg)
+				w.(http.Flusher).Flush()
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeDocker) setContainers(containers ...container.Summary) {
+	f.mu.Lock()
+	f.containers = containers
+	f.mu.Unlock()
+}
+
+func (f *fakeDocker) emit(action events.Action) {
+	f.events <- events.Message{Type: events.ContainerEventType, Action: action}
+}
+
+func newContainer(id, ip string, labels map[string]string, health container.HealthStatus) container.Summary {
+	c := container.Summary{
+		ID:     id,
+		State:  container.StateRunning,
+		Labels: labels,
+		Ports:  []container.PortSummary{{PrivatePort: 8080}, {PrivatePort: 9090}},
+		NetworkSettings: &container.NetworkSettingsSummary{
+			Networks: map[string]*network.EndpointSettings{
+				"backend": {IPAddress: ip},
+				"bridge":  {IPAddress: "172.17.0.99"},
+			},
+		},
+	}
+	if health != "" {
+		c.Health = &container.HealthSummary{Status: health}
+	}
+	return c
+}
+
+func expectNodes(t *testing.T, ch <-chan []*upstream.Node, check func([]*upstream.Node) bool) []*upstream.Node {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case nodes := <-ch:
+			if check(nodes) {
+				return nodes
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for expected nodes")
+			return nil
+		}
+	}
+}
+
+func TestDockerDiscovery(t *testing.T) {
+	fake, host := newFakeDocker(t)
+	web1 := newContainer("web1", "10.0.0.1", map[string]string{
+		"arp.service": "web",
+		"arp.weight":  "3",
+		"arp.zone":    "a",
+	}, container.Healthy)
+	fake.setContainers(web1)
+
+	log := logger.New(logger.LevelInfo)
+	d, err := New(map[string]any{"host": host, "network": "backend", "reconnectInterval": "100ms"}, log)
+	if err != nil {
+		t.Fatalf("Failed to create docker discovery: %v", err)
+	}
+	eb := eventbus.NewEventBus[[]*upstream.Node](log)
+	if err := d.Start(t.Context(), "docker", eb, nil); err != nil {
+		t.Fatalf("Failed to start docker discovery: %v", err)
+	}
+	ch := eb.Subscribe(types.ServiceDiscoveryEventKey("docker", "web"))
+
+	nodes := expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+	if nodes[0].URL.String() != "http://10.0.0.1:8080" {
+		t.Errorf("Expected lowest exposed port on the configured network, got %s", nodes[0].URL)
+	}
+	if nodes[0].Weight != 3 || nodes[0].Zone != "a" || nodes[0].Unhealthy {
+		t.Errorf("Expected node metadata from labels, got %+v", nodes[0])
+	}
+
+	web2 := newContainer("web2", "10.0.0.2", map[string]string{
+		"arp.service": "web",
+		"arp.port":    "9090",
+		"arp.network": "bridge",
+	}, container.Starting)
+	fake.setContainers(web1, web2)
+	fake.emit(events.ActionStart)
+	nodes = expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 2 })
+	if nodes[1].URL.String() != "http://172.17.0.99:9090" || !nodes[1].Unhealthy {
+		t.Errorf("Expected starting container on the labelled network and port, got %+v", nodes[1])
+	}
+
+	web2.Health = &container.HealthSummary{Status: container.Healthy}
+	fake.setContainers(web1, web2)
+	fake.emit(events.ActionHealthStatusHealthy)
+	expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 2 && !nodes[1].Unhealthy })
+
+	fake.setContainers()
+	fake.emit(events.ActionDie)
+	expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 0 })
+}
@@ -0,0 +1,153 @@
+package file
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/discovery"
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// FileDiscovery publishes the nodes listed in a YAML or JSON file mapping service names to nodes:
+//
+//	web:
+//	  - url: http://10.0.0.1:8080
+//	    weight: 3
+//	    labels:
+//	      version: v2
+//
+// The file is watched for changes. When it can't be read or parsed, the last published nodes are kept.
+type FileDiscovery struct {
+	filePath string
+	lastHash string
+	// Services published on the last read, so that services removed from the file get an empty list
+	published map[string]bool
+	log       *logger.Logger
+}
+
+func New(cfg map[string]any, log *logger.Logger) (discovery.Discovery, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	absPath, err := filepath.Abs(cfg["path"].(string))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	return &FileDiscovery{
+		filePath:  absPath,
+		published: make(map[string]bool),
+		log:       log.WithComponent("file_discovery"),
+	}, nil
+}
+
+func ValidateConfig(cfg map[string]any) error {
+	path, ok := cfg["path"].(string)
+	if !ok || path == "" {
+		return fmt.Errorf("missing 'path' configuration")
+	}
+	return nil
+}
+
+func (d *FileDiscovery) Start(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node], cfg map[string]any) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	// The directory is watched rather than the file, so that files replaced by a rename are picked up
+	if err := watcher.Add(filepath.Dir(d.filePath)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch directory: %w", err)
+	}
+	if err := d.readAndPublish(name, eb); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				d.log.Info("File discovery stopped")
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Name != d.filePath || !event.Has(fsnotify.Write|fsnotify.Create) {
+					continue
+				}
+				if err := d.readAndPublish(name, eb); err != nil {
+					d.log.Errorf("Failed to read discovery file, keeping last nodes: %v", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				d.log.Errorf("File watcher error: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (d *FileDiscovery) readAndPublish(name string, eb *eventbus.EventBus[[]*upstream.Node]) error {
+	content, err := os.ReadFile(d.filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read discovery file: %w", err)
+	}
+	contentHash := fmt.Sprintf("%x", md5.Sum(content))
+	if contentHash == d.lastHash {
+		return nil
+	}
+
+	// YAML being a superset of JSON, both are parsed the same way
+	var file map[string][]config.Node
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return fmt.Errorf("failed to parse discovery file: %w", err)
+	}
+	services := make(map[string][]*upstream.Node, len(file))
+	for service, nodeConfigs := range file {
+		nodes := make([]*upstream.Node, 0, len(nodeConfigs))
+		for _, nodeConfig := range nodeConfigs {
+			node, err := upstream.NewNode(nodeConfig)
+			if err != nil {
+				return fmt.Errorf("service %s: %w", service, err)
+			}
+			node.ServiceName = service
+			nodes = append(nodes, node)
+		}
+		services[service] = nodes
+	}
+
+	for service := range d.published {
+		if _, exists := services[service]; !exists {
+			services[service] = []*upstream.Node{}
+		}
+	}
+	names := make([]string, 0, len(services))
+	for service := range services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+	d.published = make(map[string]bool, len(services))
+	for _, service := range names {
+		d.log.Debugf("File discovery publishing %d nodes for service %s", len(services[service]), service)
+		eb.Publish(types.ServiceDiscoveryEventKey(name, service), services[service])
+		if len(services[service]) > 0 {
+			d.published[service] = true
+		}
+	}
+	d.lastHash = contentHash
+	return nil
+}
@@ -0,0 +1,91 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+)
+
+func expectNodes(t *testing.T, ch <-chan []*upstream.Node, check func([]*upstream.Node) bool) []*upstream.Node {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case nodes := <-ch:
+			if check(nodes) {
+				return nodes
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for expected nodes")
+			return nil
+		}
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	write := func(content string) {
+		t.Helper()
+		// Replace the file the way most tools do, through a rename
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatalf("Failed to rename file: %v", err)
+		}
+	}
+	write(`
+web:
+  - url: http://10.0.0.1:8080
+    weight: 3
+    zone: a
+    labels:
+      version: v2
+api:
+  - url: http://10.0.0.3:9090
+`)
+
+	log := logger.New(logger.LevelInfo)
+	d, err := New(map[string]any{"path": path}, log)
+	if err != nil {
+		t.Fatalf("Failed to create file discovery: %v", err)
+	}
+	eb := eventbus.NewEventBus[[]*upstream.Node](log)
+	if err := d.Start(t.Context(), "file", eb, nil); err != nil {
+		t.Fatalf("Failed to start file discovery: %v", err)
+	}
+	web := eb.Subscribe(types.ServiceDiscoveryEventKey("file", "web"))
+	api := eb.Subscribe(types.ServiceDiscoveryEventKey("file", "api"))
+
+	nodes := expectNodes(t, web, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+	if nodes[0].ServiceName != "web" || nodes[0].Weight != 3 || nodes[0].Zone != "a" || nodes[0].Labels["version"] != "v2" {
+		t.Errorf("Expected node metadata from file, got %+v", nodes[0])
+	}
+	expectNodes(t, api, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+
+	// JSON works as well, and services removed from the file lose their nodes
+	write(`{"web": [{"url": "http://10.0.0.1:8080"}, {"url": "http://10.0.0.2:8080"}]}`)
+	expectNodes(t, web, func(nodes []*upstream.Node) bool { return len(nodes) == 2 })
+	expectNodes(t, api, func(nodes []*upstream.Node) bool { return len(nodes) == 0 })
+
+	// Invalid content keeps the last nodes
+	write(`web: [`)
+	select {
+	case nodes := <-web:
+		t.Errorf("Expected no update for invalid file, got %d nodes", len(nodes))
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := ValidateConfig(map[string]any{}); err == nil {
+		t.Error("Expected missing path to be invalid")
+	}
+}
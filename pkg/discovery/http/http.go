@@ -0,0 +1,396 @@
+package httpdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/discovery"
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+)
+
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultTimeout  = 5 * time.Second
+)
+
+// Mapping locates the fields of an instance in the polled document. Paths are dot separated keys with
+// optional array indexes, like $.data.instances or addresses[0].ip.
+type Mapping struct {
+	// Items is the path of the instance list, the document itself when empty
+	Items   string
+	Service string
+	// URL is the path of the full instance URL. When empty, the URL is built from Scheme, Host and Port.
+	URL      string
+	Scheme   string
+	Host     string
+	Port     string
+	Weight   string
+	Zone     string
+	Priority string
+	// Labels is the path of an object whose values become node labels
+	Labels string
+	// Healthy is the path of a boolean, instances being unhealthy when it is false
+	Healthy string
+}
+
+var defaultMapping = Mapping{
+	Service:  "service",
+	URL:      "url",
+	Scheme:   "scheme",
+	Host:     "host",
+	Port:     "port",
+	Weight:   "weight",
+	Zone:     "zone",
+	Priority: "priority",
+	Labels:   "labels",
+	Healthy:  "healthy",
+}
+
+// HTTPDiscovery polls a JSON document listing instances and publishes the nodes of every service it lists.
+// Conditional requests with If-None-Match avoid reprocessing unchanged documents. When the endpoint fails,
+// the last published nodes are kept.
+type HTTPDiscovery struct {
+	url      string
+	interval time.Duration
+	headers  map[string]string
+	mapping  Mapping
+	client   *http.Client
+	etag     string
+	// Services published on the last poll, so that services no longer listed get an empty list
+	published map[string]bool
+	log       *logger.Logger
+}
+
+func New(cfg map[string]any, log *logger.Logger) (discovery.Discovery, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	d := &HTTPDiscovery{
+		url:       cfg["url"].(string),
+		interval:  DefaultInterval,
+		headers:   make(map[string]string),
+		mapping:   defaultMapping,
+		published: make(map[string]bool),
+		log:       log.WithComponent("http_discovery"),
+	}
+	timeout := DefaultTimeout
+	var err error
+	if interval, ok := cfg["interval"].(string); ok {
+		if d.interval, err = time.ParseDuration(interval); err != nil {
+			return nil, fmt.Errorf("invalid interval %s: %w", interval, err)
+		}
+	}
+	if t, ok := cfg["timeout"].(string); ok {
+		if timeout, err = time.ParseDuration(t); err != nil {
+			return nil, fmt.Errorf("invalid timeout %s: %w", t, err)
+		}
+	}
+	if headers, ok := cfg["headers"].(map[string]any); ok {
+		for name, value := range headers {
+			header, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("header %s must be a string", name)
+			}
+			d.headers[name] = header
+		}
+	}
+	if mapping, ok := cfg["mapping"].(map[string]any); ok {
+		fields := map[string]*string{
+			"items": &d.mapping.Items, "service": &d.mapping.Service, "url": &d.mapping.URL,
+			"scheme": &d.mapping.Scheme, "host": &d.mapping.Host, "port": &d.mapping.Port,
+			"weight": &d.mapping.Weight, "zone": &d.mapping.Zone, "priority": &d.mapping.Priority,
+			"labels": &d.mapping.Labels, "healthy": &d.mapping.Healthy,
+		}
+		for key, value := range mapping {
+			field, ok := fields[key]
+			if !ok {
+				return nil, fmt.Errorf("unknown mapping field %s", key)
+			}
+			path, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("mapping field %s must be a string", key)
+			}
+			*field = path
+		}
+	}
+	d.client = &http.Client{Timeout: timeout}
+	return d, nil
+}
+
+func ValidateConfig(cfg map[string]any) error {
+	rawURL, ok := cfg["url"].(string)
+	if !ok || rawURL == "" {
+		return fmt.Errorf("missing 'url' configuration")
+	}
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url %s", rawURL)
+	}
+	for _, key := range []string{"interval", "timeout"} {
+		if value, exists := cfg[key]; exists {
+			str, ok := value.(string)
+			if !ok {
+				return fmt.Errorf("%s must be a duration string", key)
+			}
+			if dur, err := time.ParseDuration(str); err != nil || dur <= 0 {
+				return fmt.Errorf("invalid %s %s", key, str)
+			}
+		}
+	}
+	if headers, exists := cfg["headers"]; exists {
+		if err := validateStringMap("headers", headers, nil); err != nil {
+			return err
+		}
+	}
+	if mapping, exists := cfg["mapping"]; exists {
+		known := map[string]bool{
+			"items": true, "service": true, "url": true, "scheme": true, "host": true, "port": true,
+			"weight": true, "zone": true, "priority": true, "labels": true, "healthy": true,
+		}
+		if err := validateStringMap("mapping", mapping, known); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateStringMap(name string, value any, known map[string]bool) error {
+	m, ok := value.(map[string]any)
+	if !ok {
+		return fmt.Errorf("%s must be a map", name)
+	}
+	for key, v := range m {
+		if known != nil && !known[key] {
+			return fmt.Errorf("unknown %s field %s", name, key)
+		}
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s.%s must be a string", name, key)
+		}
+	}
+	return nil
+}
+
+func (d *HTTPDiscovery) Start(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node], cfg map[string]any) error {
+	if err := d.poll(ctx, name, eb); err != nil {
+		return fmt.Errorf("failed to poll %s: %w", d.url, err)
+	}
+	go func() {
+		ticker := time.NewTicker(d.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				d.log.Info("HTTP discovery stopped")
+				return
+			case <-ticker.C:
+				if err := d.poll(ctx, name, eb); err != nil && ctx.Err() == nil {
+					d.log.Errorf("Failed to poll %s, keeping last nodes: %v", d.url, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (d *HTTPDiscovery) poll(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node]) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	for key, value := range d.headers {
+		req.Header.Set(key, value)
+	}
+	if d.etag != "" {
+		req.Header.Set("If-None-Match", d.etag)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	var document any
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	services, err := d.parse(document)
+	if err != nil {
+		return err
+	}
+
+	for service := range d.published {
+		if _, exists := services[service]; !exists {
+			services[service] = []*upstream.Node{}
+		}
+	}
+	d.published = make(map[string]bool, len(services))
+	for service, nodes := range services {
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].URL.String() < nodes[j].URL.String() })
+		d.log.Debugf("HTTP discovery publishing %d nodes for service %s", len(nodes), service)
+		eb.Publish(types.ServiceDiscoveryEventKey(name, service), nodes)
+		if len(nodes) > 0 {
+			d.published[service] = true
+		}
+	}
+	// Only remembered once the document was applied, so that a rejected one is fetched again
+	d.etag = resp.Header.Get("ETag")
+	return nil
+}
+
+// parse maps the instances of the document to nodes grouped by service.
+func (d *HTTPDiscovery) parse(document any) (map[string][]*upstream.Node, error) {
+	items, found := lookup(document, d.mapping.Items)
+	if !found {
+		return nil, fmt.Errorf("no instance list at %q", d.mapping.Items)
+	}
+	list, ok := items.([]any)
+	if !ok {
+		return nil, fmt.Errorf("instance list at %q is not an array", d.mapping.Items)
+	}
+
+	services := make(map[string][]*upstream.Node)
+	for i, item := range list {
+		node, err := d.newNode(item)
+		if err != nil {
+			d.log.Warnf("Skipping instance %d: %v", i, err)
+			continue
+		}
+		services[node.ServiceName] = append(services[node.ServiceName], node)
+	}
+	return services, nil
+}
+
+func (d *HTTPDiscovery) newNode(item any) (*upstream.Node, error) {
+	service := lookupString(item, d.mapping.Service)
+	if service == "" {
+		return nil, fmt.Errorf("no service at %q", d.mapping.Service)
+	}
+	rawURL := lookupString(item, d.mapping.URL)
+	if rawURL == "" {
+		host := lookupString(item, d.mapping.Host)
+		if host == "" {
+			return nil, fmt.Errorf("neither url at %q nor host at %q", d.mapping.URL, d.mapping.Host)
+		}
+		scheme := lookupString(item, d.mapping.Scheme)
+		if scheme == "" {
+			scheme = "http"
+		}
+		rawURL = scheme + "://" + host
+		if port := lookupString(item, d.mapping.Port); port != "" {
+			rawURL += ":" + port
+		}
+	}
+	nodeURL, err := url.Parse(rawURL)
+	if err != nil || nodeURL.Host == "" {
+		return nil, fmt.Errorf("invalid url %s", rawURL)
+	}
+
+	node := &upstream.Node{
+		ServiceName: service,
+		URL:         nodeURL,
+		Zone:        lookupString(item, d.mapping.Zone),
+	}
+	if weight := lookupString(item, d.mapping.Weight); weight != "" {
+		if node.Weight, err = strconv.Atoi(weight); err != nil {
+			return nil, fmt.Errorf("invalid weight %s", weight)
+		}
+	}
+	if priority := lookupString(item, d.mapping.Priority); priority != "" {
+		if node.Priority, err = strconv.Atoi(priority); err != nil {
+			return nil, fmt.Errorf("invalid priority %s", priority)
+		}
+	}
+	if healthy, found := lookupField(item, d.mapping.Healthy); found {
+		node.Unhealthy = healthy == false
+	}
+	if labels, found := lookupField(item, d.mapping.Labels); found {
+		if m, ok := labels.(map[string]any); ok {
+			node.Labels = make(map[string]string, len(m))
+			for key, value := range m {
+				node.Labels[key] = toString(value)
+			}
+		}
+	}
+	return node, nil
+}
+
+// lookup returns the value at the path, made of dot separated keys and array indexes.
+func lookup(value any, path string) (any, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return value, true
+	}
+	for _, segment := range strings.Split(path, ".") {
+		key, indexes, _ := strings.Cut(segment, "[")
+		if key != "" {
+			m, ok := value.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if value, ok = m[key]; !ok {
+				return nil, false
+			}
+		}
+		for indexes != "" {
+			index, rest, found := strings.Cut(indexes, "]")
+			if !found {
+				return nil, false
+			}
+			i, err := strconv.Atoi(index)
+			list, ok := value.([]any)
+			if err != nil || !ok || i < 0 || i >= len(list) {
+				return nil, false
+			}
+			value = list[i]
+			indexes = strings.TrimPrefix(rest, "[")
+		}
+	}
+	return value, true
+}
+
+// lookupField returns the value of an instance field, fields mapped to an empty path being left unset.
+func lookupField(item any, path string) (any, bool) {
+	if path == "" {
+		return nil, false
+	}
+	return lookup(item, path)
+}
+
+func lookupString(item any, path string) string {
+	v, found := lookupField(item, path)
+	if !found {
+		return ""
+	}
+	return toString(v)
+}
+
+func toString(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,180 @@
+package httpdiscovery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+)
+
+// fakeRegistry serves a document with an ETag, answering conditional requests with 304.
+type fakeRegistry struct {
+	mu          sync.Mutex
+	document    string
+	version     int
+	fetches     int
+	notModified int
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	etag := `"v` + string(rune('0'+f.version)) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		f.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	f.fetches++
+	w.Header().Set("ETag", etag)
+	w.Write([]byte(f.document))
+}
+
+func (f *fakeRegistry) set(document string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.document = document
+	f.version++
+}
+
+func expectNodes(t *testing.T, ch <-chan []*upstream.Node, check func([]*upstream.Node) bool) []*upstream.Node {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case nodes := <-ch:
+			if check(nodes) {
+				return nodes
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for expected nodes")
+			return nil
+		}
+	}
+}
+
+func TestHTTPDiscovery(t *testing.T) {
+	registry := &fakeRegistry{}
+	registry.set(`{"data": {"instances": [
+		{"app": "web", "address": {"ip": "10.0.0.1", "ports": [8080]}, "meta": {"zone": "a", "version": "v2"}, "up": true},
+		{"app": "web", "address": {"ip": "10.0.0.2", "ports": [8080]}, "meta": {"zone": "b"}, "up": false},
+		{"app": "api", "address": {"ip": "10.0.0.3", "ports": [9090]}}
+	]}}`)
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	log := logger.New(logger.LevelInfo)
+	cfg := map[string]any{
+		"url":      server.URL,
+		"interval": "50ms",
+		"headers":  map[string]any{"Authorization": "Bearer secret"},
+		"mapping": map[string]any{
+			"items":   "$.data.instances",
+			"service": "app",
+			"host":    "address.ip",
+			"port":    "address.ports[0]",
+			"zone":    "meta.zone",
+			"labels":  "meta",
+			"healthy": "up",
+		},
+	}
+	d, err := New(cfg, log)
+	if err != nil {
+		t.Fatalf("Failed to create http discovery: %v", err)
+	}
+	eb := eventbus.NewEventBus[[]*upstream.Node](log)
+	if err := d.Start(t.Context(), "http", eb, cfg); err != nil {
+		t.Fatalf("Failed to start http discovery: %v", err)
+	}
+	web := eb.Subscribe(types.ServiceDiscoveryEventKey("http", "web"))
+	api := eb.Subscribe(types.ServiceDiscoveryEventKey("http", "api"))
+
+	nodes := expectNodes(t, web, func(nodes []*upstream.Node) bool { return len(nodes) == 2 })
+	if nodes[0].URL.String() != "http://10.0.0.1:8080" || nodes[0].Zone != "a" || nodes[0].Labels["version"] != "v2" || nodes[0].Unhealthy {
+		t.Errorf("Expected node mapped from the instance, got %+v", nodes[0])
+	}
+	if !nodes[1].Unhealthy {
+		t.Errorf("Expected instance that isn't up to be unhealthy, got %+v", nodes[1])
+	}
+	expectNodes(t, api, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+
+	// Unchanged documents aren't fetched again
+	time.Sleep(200 * time.Millisecond)
+	registry.mu.Lock()
+	fetches, notModified := registry.fetches, registry.notModified
+	registry.mu.Unlock()
+	if fetches != 1 || notModified == 0 {
+		t.Errorf("Expected conditional requests, got %d fetches and %d not modified", fetches, notModified)
+	}
+
+	registry.set(`{"data": {"instances": [{"app": "web", "address": {"ip": "10.0.0.1", "ports": [8080]}}]}}`)
+	expectNodes(t, web, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+	expectNodes(t, api, func(nodes []*upstream.Node) bool { return len(nodes) == 0 })
+}
+
+func TestUnmappedFields(t *testing.T) {
+	cfg := map[string]any{
+		"url":     "http://registry.local/instances",
+		"mapping": map[string]any{"items": "$", "labels": "", "healthy": ""},
+	}
+	d, err := New(cfg, logger.New(logger.LevelInfo))
+	if err != nil {
+		t.Fatalf("Failed to create http discovery: %v", err)
+	}
+	document := []any{map[string]any{"service": "web", "url": "http://10.0.0.1:8080", "labels": map[string]any{"version": "v2"}, "healthy": false}}
+	services, err := d.(*HTTPDiscovery).parse(document)
+	if err != nil {
+		t.Fatalf("Failed to parse document: %v", err)
+	}
+	if len(services["web"]) != 1 {
+		t.Fatalf("Expected a single web node, got %v", services)
+	}
+	if node := services["web"][0]; node.Labels != nil || node.Unhealthy {
+		t.Errorf("Expected fields mapped to an empty path to be left unset, got %+v", node)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	document := map[string]any{"a": map[string]any{"b": []any{"first", map[string]any{"c": 1.0}}}}
+	tests := map[string]any{
+		"$.a.b[0]": "first",
+		"a.b[1].c": 1.0,
+	}
+	for path, expected := range tests {
+		if value, found := lookup(document, path); !found || value != expected {
+			t.Errorf("Expected %v at %s, got %v", expected, path, value)
+		}
+	}
+	for _, path := range []string{"a.x", "a.b[2]", "a.b.c"} {
+		if _, found := lookup(document, path); found {
+			t.Errorf("Expected nothing at %s", path)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	invalid := []map[string]any{
+		{},
+		{"url": "ftp://registry"},
+		{"url": "http://registry", "interval": "soon"},
+		{"url": "http://registry", "mapping": map[string]any{"unknown": "x"}},
+	}
+	for _, cfg := range invalid {
+		if err := ValidateConfig(cfg); err == nil {
+			t.Errorf("Expected config %v to be invalid", cfg)
+		}
+		if _, err := New(cfg, logger.New(logger.LevelInfo)); err == nil {
+			t.Errorf("Expected discovery with config %v to fail", cfg)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package kubernetes
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/discovery"
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+)
+
+const (
+	DefaultTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	DefaultCAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	DefaultRetryInterval = 5 * time.Second
+
+	// LabelForZones holds the comma separated zones an endpoint is hinted for by topology aware routing
+	LabelForZones = "hints.forZones"
+	// LabelNodeName holds the Kubernetes node running the endpoint
+	LabelNodeName = "nodeName"
+
+	serviceNameLabel = "kubernetes.io/service-name"
+	watchTimeout     = 5 * time.Minute
+	// minWatchInterval is the first delay before watching again after a watch closed without delivering events
+	minWatchInterval = 100 * time.Millisecond
+	requestTimeout   = 30 * time.Second
+)
+
+// errGone is returned when the resource version being watched is too old and the slices must be listed again.
+var errGone = errors.New("resource version is too old")
+
+// KubernetesDiscovery watches the EndpointSlices of the services referenced by upstreams. Service names
+// have the form namespace/service:port, where port is the name or the number of the endpoint port. It
+// can be omitted when the service has a single port. Only ready endpoints are published.
+//
+// Upstreams can also give the namespace and port as params, the service name then being the bare service.
+type KubernetesDiscovery struct {
+	apiServer     string
+	tokenFile     string
+	retryInterval time.Duration
+	client        *http.Client
+
+	mu      sync.Mutex
+	ctx     context.Context
+	name    string
+	eb      *eventbus.EventBus[[]*upstream.Node]
+	watches *discovery.Watches
+	log     *logger.Logger
+}
+
+type serviceRef struct {
+	namespace string
+	name      string
+	port      string
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type endpointSlice struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Endpoints   []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+		Zone     string `json:"zone"`
+		NodeName string `json:"nodeName"`
+		Hints    *struct {
+			ForZones []struct {
+				Name string `json:"name"`
+			} `json:"forZones"`
+		} `json:"hints"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name        *string `json:"name"`
+		Port        *int    `json:"port"`
+		AppProtocol *string `json:"appProtocol"`
+	} `json:"ports"`
+}
+
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func New(cfg map[string]any, log *logger.Logger) (discovery.Discovery, error) {
+	if err := ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	d := &KubernetesDiscovery{
+		tokenFile:     DefaultTokenFile,
+		retryInterval: DefaultRetryInterval,
+		watches:       discovery.NewWatches(),
+		log:           log.WithComponent("kubernetes_discovery"),
+	}
+	if apiServer, ok := cfg["apiServer"].(string); ok {
+		d.apiServer = strings.TrimSuffix(apiServer, "/")
+	} else {
+		// In cluster configuration
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("apiServer is required when not running in a cluster")
+		}
+		d.apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+	if tokenFile, ok := cfg["tokenFile"].(string); ok {
+		d.tokenFile = tokenFile
+	}
+	if interval, ok := cfg["retryInterval"].(string); ok {
+		d.retryInterval, _ = time.ParseDuration(interval)
+	}
+
+	tlsConfig := &tls.Config{}
+	if insecure, ok := cfg["insecureSkipVerify"].(bool); ok {
+		tlsConfig.InsecureSkipVerify = insecure
+	}
+	caFile, configured := cfg["caFile"].(string)
+	if !configured {
+		caFile = DefaultCAFile
+	}
+	if ca, err := os.ReadFile(caFile); err == nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	} else if configured {
+		return nil, fmt.Errorf("failed to read caFile: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	d.client = &http.Client{Transport: transport}
+	return d, nil
+}
+
+func ValidateConfig(cfg map[string]any) error {
+	for _, key := range []string{"apiServer", "tokenFile", "caFile", "retryInterval"} {
+		if value, exists := cfg[key]; exists {
+			if _, ok := value.(string); !ok {
+				return fmt.Errorf("%s must be a string", key)
+			}
+		}
+	}
+	if apiServer, ok := cfg["apiServer"].(string); ok {
+		if u, err := url.Parse(apiServer); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid apiServer %s", apiServer)
+		}
+	}
+	if value, exists := cfg["insecureSkipVerify"]; exists {
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("insecureSkipVerify must be a boolean")
+		}
+	}
+	if interval, ok := cfg["retryInterval"].(string); ok {
+		if dur, err := time.ParseDuration(interval); err != nil || dur <= 0 {
+			return fmt.Errorf("invalid retryInterval %s", interval)
+		}
+	}
+	return nil
+}
+
+// ValidateReference validates that the service names its namespace, in the service or the namespace param.
+func ValidateReference(service string, params map[string]string) error {
+	_, err := parseServiceName(service, params)
+	return err
+}
+
+func (d *KubernetesDiscovery) Start(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node], cfg map[string]any) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.ctx = ctx
+	d.name = name
+	d.eb = eb
+	d.log.Infof("Starting Kubernetes discovery using %s", d.apiServer)
+	return nil
+}
+
+// WatchService watches the EndpointSlices of the service until every upstream referencing it has stopped watching.
+func (d *KubernetesDiscovery) WatchService(service string, params map[string]string) func() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ref, err := parseServiceName(service, params)
+	if err != nil {
+		d.log.Errorf("Invalid Kubernetes service %s: %v", service, err)
+		return func() {}
+	}
+	topic := types.ServiceDiscoveryParamsEventKey(d.name, service, params)
+	selector := discovery.Selector(params, "namespace", "port")
+	return d.watches.Start(d.ctx, topic, func(ctx context.Context) { d.watch(ctx, topic, service, ref, selector) })
+}
+
+func (d *KubernetesDiscovery) watch(ctx context.Context, topic string, service string, ref serviceRef, selector map[string]string) {
+	publish := func(slices map[string]endpointSlice) {
+		nodes := discovery.FilterNodes(endpointNodes(service, ref.port, slices), selector)
+		d.log.Debugf("Kubernetes discovery publishing %d nodes for service %s", len(nodes), service)
+		d.eb.Publish(topic, nodes)
+	}
+
+	for {
+		// The last nodes are kept while the API server can't be reached
+		slices, resourceVersion, err := d.list(ctx, ref)
+		if err == nil {
+			publish(slices)
+			// Watches the server closes right away are retried with a growing delay, reset by any delivered event
+			var delay time.Duration
+			for err == nil {
+				if delay > 0 {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(delay):
+					}
+				}
+				var delivered bool
+				resourceVersion, delivered, err = d.watchSlices(ctx, ref, resourceVersion, slices, publish)
+				if delivered {
+					delay = 0
+				} else {
+					delay = min(max(2*delay, minWatchInterval), max(d.retryInterval, minWatchInterval))
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errGone) {
+			d.log.Infof("Watch of service %s expired, listing EndpointSlices again", service)
+			continue
+		}
+		d.log.Errorf("Failed to watch EndpointSlices of service %s, retrying in %s: %v", service, d.retryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.retryInterval):
+		}
+	}
+}
+
+func (d *KubernetesDiscovery) list(ctx context.Context, ref serviceRef) (map[string]endpointSlice, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := d.get(ctx, ref, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var list endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", fmt.Errorf("invalid EndpointSlice list: %v", err)
+	}
+	slices := make(map[string]endpointSlice, len(list.Items))
+	for _, slice := range list.Items {
+		slices[slice.Metadata.Name] = slice
+	}
+	return slices, list.Metadata.ResourceVersion, nil
+}
+
+// watchSlices applies the watch events to the slices until the server closes the stream, and returns the
+// resource version to resume watching from and whether any event was delivered.
+func (d *KubernetesDiscovery) watchSlices(ctx context.Context, ref serviceRef, resourceVersion string, slices map[string]endpointSlice, publish func(map[string]endpointSlice)) (string, bool, error) {
+	resp, err := d.get(ctx, ref, url.Values{
+		"watch":               {"true"},
+		"resourceVersion":     {resourceVersion},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {strconv.Itoa(int(watchTimeout.Seconds()))},
+	})
+	if err != nil {
+		return resourceVersion, false, err
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(resp.Body))
+	delivered := false
+	for {
+		var event watchEvent
+		if err := decoder.Decode(&event); err != nil {
+			if ctx.Err() != nil {
+				return resourceVersion, delivered, ctx.Err()
+			}
+			// The server closes the stream once the watch times out, resume from where it stopped
+			d.log.Debugf("Watch of service %s/%s closed: %v", ref.namespace, ref.name, err)
+			return resourceVersion, delivered, nil
+		}
+		delivered = true
+		if event.Type == "ERROR" {
+			var s status
+			json.Unmarshal(event.Object, &s)
+			if s.Code == http.StatusGone {
+				return resourceVersion, delivered, errGone
+			}
+			return resourceVersion, delivered, fmt.Errorf("watch error %d: %s", s.Code, s.Message)
+		}
+
+		var slice endpointSlice
+		if err := json.Unmarshal(event.Object, &slice); err != nil {
+			return resourceVersion, delivered, fmt.Errorf("invalid watch event: %v", err)
+		}
+		resourceVersion = slice.Metadata.ResourceVersion
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			slices[slice.Metadata.Name] = slice
+		case "DELETED":
+			delete(slices, slice.Metadata.Name)
+		default:
+			// Bookmarks only move the resource version forward
+			continue
+		}
+		publish(slices)
+	}
+}
+
+func (d *KubernetesDiscovery) get(ctx context.Context, ref serviceRef, query url.Values) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("labelSelector", serviceNameLabel+"="+ref.name)
+	reqURL := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s",
+		d.apiServer, url.PathEscape(ref.namespace), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Projected service account tokens are rotated, so the file is read on every request
+	if token, err := os.ReadFile(d.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp, nil
+}
+
+func parseServiceName(service string, params map[string]string) (serviceRef, error) {
+	namespace, name, found := strings.Cut(service, "/")
+	if !found {
+		namespace, name = params["namespace"], service
+	}
+	name, port, _ := strings.Cut(name, ":")
+	if port == "" {
+		port = params["port"]
+	}
+	if namespace == "" || name == "" {
+		return serviceRef{}, fmt.Errorf("expected namespace/service:port, or a namespace param")
+	}
+	return serviceRef{namespace: namespace, name: name, port: port}, nil
+}
+
+// endpointNodes returns the ready endpoints of all slices on the selected port.
+func endpointNodes(service string, port string, slices map[string]endpointSlice) []*upstream.Node {
+	seen := make(map[string]bool)
+	nodes := []*upstream.Node{}
+	for _, slice := range slices {
+		if slice.AddressType != "IPv4" && slice.AddressType != "IPv6" {
+			continue
+		}
+		portNumber, scheme, ok := slicePort(slice, port)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			// A missing condition means ready
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			labels := map[string]string{}
+			if endpoint.NodeName != "" {
+				labels[LabelNodeName] = endpoint.NodeName
+			}
+			if endpoint.Hints != nil && len(endpoint.Hints.ForZones) > 0 {
+				zones := make([]string, 0, len(endpoint.Hints.ForZones))
+				for _, zone := range endpoint.Hints.ForZones {
+					zones = append(zones, zone.Name)
+				}
+				labels[LabelForZones] = strings.Join(zones, ",")
+			}
+			for _, address := range endpoint.Addresses {
+				host := net.JoinHostPort(address, strconv.Itoa(portNumber))
+				// Endpoints may be listed by several slices while they are being migrated
+				if seen[host] {
+					continue
+				}
+				seen[host] = true
+				nodes = append(nodes, &upstream.Node{
+					ServiceName: service,
+					URL:         &url.URL{Scheme: scheme, Host: host},
+					Zone:        endpoint.Zone,
+					Labels:      labels,
+				})
+			}
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].URL.String() < nodes[j].URL.String() })
+	return nodes
+}
+
+// slicePort finds the port by name or number, or the only port of the slice when none is given.
+func slicePort(slice endpointSlice, port string) (int, string, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
+		if port == "" && len(slice.Ports) > 1 {
+			return 0, "", false
+		}
+		if port == "" || port == name || port == strconv.Itoa(*p.Port) {
+			scheme := "http"
+			if p.AppProtocol != nil && *p.AppProtocol == "https" {
+				scheme = "https"
+			}
+			return *p.Port, scheme, true
+		}
+	}
+	return 0, "", false
+}
@@ -0,0 +1,235 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/eventbus"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
+	"github.com/Revolyssup/arp/pkg/upstream"
+)
+
+// fakeAPIServer serves the EndpointSlices of the default/web service, streaming events to watchers.
+type fakeAPIServer struct {
+	mu              sync.Mutex
+	slices          map[string]map[string]any
+	resourceVersion int
+	events          chan map[string]any
+	lists           int
+	watches         int
+	// closeWatches makes the server end every watch right away without events
+	closeWatches bool
+}
+
+func newFakeAPIServer(t *testing.T) (*fakeAPIServer, string) {
+	t.Helper()
+	fake := &fakeAPIServer{slices: make(map[string]map[string]any), events: make(chan map[string]any, 10)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" ||
+		r.URL.Query().Get("labelSelector") != "kubernetes.io/service-name=web" ||
+		r.Header.Get("Authorization") != "Bearer token" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Query().Get("watch") != "true" {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.lists++
+		items := []map[string]any{}
+		for _, slice := range f.slices {
+			items = append(items, slice)
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"metadata": map[string]any{"resourceVersion": fmt.Sprint(f.resourceVersion)},
+			"items":    items,
+		})
+		return
+	}
+
+	f.mu.Lock()
+	f.watches++
+	closeWatches := f.closeWatches
+	f.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	if closeWatches {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-f.events:
+			json.NewEncoder(w).Encode(event)
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// apply changes a slice and notifies the watchers, deleting it when slice is nil.
+func (f *fakeAPIServer) apply(eventType string, name string, slice map[string]any) {
+	f.mu.Lock()
+	f.resourceVersion++
+	if slice == nil {
+		slice = f.slices[name]
+		delete(f.slices, name)
+	} else {
+		f.slices[name] = slice
+	}
+	slice["metadata"] = map[string]any{"name": name, "resourceVersion": fmt.Sprint(f.resourceVersion)}
+	f.mu.Unlock()
+	if eventType != "" {
+		f.events <- map[string]any{"type": eventType, "object": slice}
+	}
+}
+
+func (f *fakeAPIServer) listCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lists
+}
+
+func (f *fakeAPIServer) watchCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.watches
+}
+
+func slice(ready bool, addresses ...string) map[string]any {
+	endpoints := []map[string]any{}
+	for _, address := range addresses {
+		endpoints = append(endpoints, map[string]any{
+			"addresses":  []string{address},
+			"conditions": map[string]any{"ready": ready},
+			"zone":       "zone-a",
+			"nodeName":   "node-1",
+			"hints":      map[string]any{"forZones": []map[string]any{{"name": "zone-a"}, {"name": "zone-b"}}},
+		})
+	}
+	return map[string]any{
+		"addressType": "IPv4",
+		"endpoints":   endpoints,
+		"ports": []map[string]any{
+			{"name": "http", "port": 8080},
+			{"name": "metrics", "port": 9090},
+		},
+	}
+}
+
+func expectNodes(t *testing.T, ch <-chan []*upstream.Node, check func([]*upstream.Node) bool) []*upstream.Node {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case nodes := <-ch:
+			if check(nodes) {
+				return nodes
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for expected nodes")
+			return nil
+		}
+	}
+}
+
+func startDiscovery(t *testing.T, apiServer string) (*KubernetesDiscovery, *eventbus.EventBus[[]*upstream.Node]) {
+	t.Helper()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("token\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write token: %v", err)
+	}
+	log := logger.New(logger.LevelInfo)
+	cfg := map[string]any{"apiServer": apiServer, "tokenFile": tokenFile, "retryInterval": "400ms"}
+	d, err := New(cfg, log)
+	if err != nil {
+		t.Fatalf("Failed to create kubernetes discovery: %v", err)
+	}
+	eb := eventbus.NewEventBus[[]*upstream.Node](log)
+	if err := d.Start(t.Context(), "kubernetes", eb, cfg); err != nil {
+		t.Fatalf("Failed to start kubernetes discovery: %v", err)
+	}
+	return d.(*KubernetesDiscovery), eb
+}
+
+func TestKubernetesDiscovery(t *testing.T) {
+	fake, apiServer := newFakeAPIServer(t)
+	fake.apply("", "web-1", slice(true, "10.0.0.1"))
+	d, eb := startDiscovery(t, apiServer)
+	service := "default/web:http"
+	ch := eb.Subscribe(types.ServiceDiscoveryEventKey("kubernetes", service))
+	stop := d.WatchService(service, nil)
+	defer stop()
+
+	nodes := expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+	node := nodes[0]
+	if node.URL.String() != "http://10.0.0.1:8080" || node.Zone != "zone-a" {
+		t.Errorf("Expected node on the named port, got %+v", node)
+	}
+	if node.Labels[LabelForZones] != "zone-a,zone-b" || node.Labels[LabelNodeName] != "node-1" {
+		t.Errorf("Expected zone hints and node name as labels, got %v", node.Labels)
+	}
+
+	fake.apply("ADDED", "web-2", slice(true, "10.0.0.2"))
+	expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 2 })
+
+	// Endpoints that aren't ready are left out
+	fake.apply("MODIFIED", "web-2", slice(false, "10.0.0.2"))
+	expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+
+	fake.apply("DELETED", "web-1", nil)
+	expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 0 })
+
+	// An expired resource version makes the discovery list the slices again
+	lists := fake.listCount()
+	fake.apply("", "web-3", slice(true, "10.0.0.3"))
+	fake.events <- map[string]any{"type": "ERROR", "object": map[string]any{"kind": "Status", "code": 410, "message": "too old resource version"}}
+	expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 1 && nodes[0].URL.Host == "10.0.0.3:8080" })
+	if fake.listCount() != lists+1 {
+		t.Errorf("Expected a single list after the watch expired, got %d", fake.listCount()-lists)
+	}
+}
+
+func TestKubernetesDiscoveryRewatchBackoff(t *testing.T) {
+	fake, apiServer := newFakeAPIServer(t)
+	fake.closeWatches = true
+	fake.apply("", "web-1", slice(true, "10.0.0.1"))
+	d, eb := startDiscovery(t, apiServer)
+	service := "default/web:http"
+	ch := eb.Subscribe(types.ServiceDiscoveryEventKey("kubernetes", service))
+	stop := d.WatchService(service, nil)
+	defer stop()
+	expectNodes(t, ch, func(nodes []*upstream.Node) bool { return len(nodes) == 1 })
+
+	// Watches closed without events are retried after 100ms, 200ms, 400ms, 400ms...
+	time.Sleep(time.Second)
+	if watches := fake.watchCount(); watches < 2 || watches > 5 {
+		t.Errorf("Expected empty watches to back off, got %d watches in a second", watches)
+	}
+}
+
+func TestParseServiceName(t *testing.T) {
+	ref, err := parseServiceName("default/web:8080", nil)
+	if err != nil || ref.namespace != "default" || ref.name != "web" || ref.port != "8080" {
+		t.Errorf("Unexpected service reference %+v: %v", ref, err)
+	}
+	ref, err = parseServiceName("web", map[string]string{"namespace": "default", "port": "http"})
+	if err != nil || ref.namespace != "default" || ref.name != "web" || ref.port != "http" {
+		t.Errorf("Unexpected service reference from params %+v: %v", ref, err)
+	}
+	if _, err := parseServiceName("web", nil); err == nil {
+		t.Error("Expected service without namespace to be invalid")
+	}
+}
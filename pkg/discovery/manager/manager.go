@@ -2,12 +2,22 @@ package manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/Revolyssup/arp/pkg/config"
 	"github.com/Revolyssup/arp/pkg/discovery"
+	"github.com/Revolyssup/arp/pkg/discovery/consul"
 	"github.com/Revolyssup/arp/pkg/discovery/demo"
+	"github.com/Revolyssup/arp/pkg/discovery/dns"
+	"github.com/Revolyssup/arp/pkg/discovery/docker"
+	"github.com/Revolyssup/arp/pkg/discovery/file"
+	httpdiscovery "github.com/Revolyssup/arp/pkg/discovery/http"
+	"github.com/Revolyssup/arp/pkg/discovery/kubernetes"
 	"github.com/Revolyssup/arp/pkg/eventbus"
 	"github.com/Revolyssup/arp/pkg/logger"
 	"github.com/Revolyssup/arp/pkg/types"
@@ -15,71 +25,315 @@ import (
 	"github.com/Revolyssup/arp/pkg/utils"
 )
 
+// Registry holds every discovery type that can be configured. New discovery types only need to be registered here.
+var Registry *discovery.Registry
+
+func init() {
+	Registry = discovery.NewRegistry()
+	Registry.Register("demo", demo.New, demo.ValidateConfig)
+	Registry.Register("docker", docker.New, docker.ValidateConfig)
+	Registry.Register("dns", dns.New, dns.ValidateConfig)
+	Registry.Register("file", file.New, file.ValidateConfig)
+	Registry.Register("consul", consul.New, consul.ValidateConfig)
+	Registry.Register("kubernetes", kubernetes.New, kubernetes.ValidateConfig)
+	Registry.Register("http", httpdiscovery.New, httpdiscovery.ValidateConfig)
+	Registry.RegisterReferenceValidator("dns", dns.ValidateReference)
+	Registry.RegisterReferenceValidator("kubernetes", kubernetes.ValidateReference)
+}
+
+// staleCheckInterval is how often services are checked for staleness
+const staleCheckInterval = time.Second
+
 // Manages all instantiated discovereres and based on the config, gives an event bus to client to subscribe on.
+// Discoverers can be added, reconfigured and removed at runtime with Reconcile.
 type DiscoveryManager struct {
-	discoverers map[string]discovery.Discovery
-	eb          *eventbus.EventBus[[]*upstream.Node]
-	log         *logger.Logger
+	eb        *eventbus.EventBus[[]*upstream.Node]
+	mu        sync.Mutex
+	running   map[string]*runningDiscovery
+	checkOnce sync.Once
+	// Status of every watched service, keyed by the service's params event key
+	status map[string]*serviceStatus
+	log    *logger.Logger
+}
+
+// runningDiscovery is a started discoverer, stopped by cancelling its context.
+type runningDiscovery struct {
+	discovery  discovery.Discovery
+	config     config.DiscoveryConfig
+	staleAfter time.Duration
+	cancel     context.CancelFunc
+}
+
+// ServiceStatus reports what a discovery last published for a watched service.
+type ServiceStatus struct {
+	Type    string            `json:"type"`
+	Service string            `json:"service"`
+	Params  map[string]string `json:"params,omitempty"`
+	// LastUpdate is zero until the discovery reports the service
+	LastUpdate time.Time `json:"lastUpdate,omitzero"`
+	Nodes      int       `json:"nodes"`
+	// Stale is set when the discovery hasn't reported the service within its staleAfter duration
+	Stale bool `json:"stale"`
+}
+
+type serviceStatus struct {
+	ServiceStatus
+	watchers     int
+	watchedSince time.Time
+	// Stops the lookup of the service by a discoverer implementing ServiceWatcher
+	stopWatch func()
 }
 
 func NewDiscoveryManager(parentLogger *logger.Logger) (*DiscoveryManager, error) {
 	discoveryLogger := parentLogger.WithComponent("discovery_manager")
 	mgr := &DiscoveryManager{
-		discoverers: make(map[string]discovery.Discovery),
-		eb:          eventbus.NewEventBus[[]*upstream.Node](discoveryLogger),
-		log:         discoveryLogger,
+		eb:      eventbus.NewEventBus[[]*upstream.Node](discoveryLogger),
+		running: make(map[string]*runningDiscovery),
+		status:  make(map[string]*serviceStatus),
+		log:     discoveryLogger,
 	}
 	return mgr, nil
 }
 
+// InitDiscovery starts the discoverers of the static configuration.
 func (d *DiscoveryManager) InitDiscovery(ctx context.Context, cfg []config.DiscoveryConfig) error {
-	// Start all discoverers from cfg
-	//TODO: Refactor this into registration based data flow.
+	return d.Reconcile(ctx, cfg)
+}
+
+// Reconcile makes the running discoverers match the configuration: new discoverers are started, discoverers
+// whose configuration changed are restarted and the others are stopped. Watched services keep their
+// subscriptions, so upstreams follow a restarted discoverer and keep their last nodes when it is removed.
+// Every discoverer runs with its own context derived from ctx. Errors of all discoverers are returned together.
+func (d *DiscoveryManager) Reconcile(ctx context.Context, cfg []config.DiscoveryConfig) error {
+	d.checkOnce.Do(func() { d.startStaleCheck(ctx) })
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var errs []error
+	configured := make(map[string]bool, len(cfg))
 	for _, dcfg := range cfg {
-		switch dcfg.Type {
-		case "demo":
-			d.discoverers["demo"] = demo.New(dcfg.Config, d.log)
-		default:
-			return fmt.Errorf("unsupported discovery type: %s", dcfg.Type)
+		configured[dcfg.Type] = true
+		if current, exists := d.running[dcfg.Type]; exists && reflect.DeepEqual(current.config, dcfg) {
+			continue
+		}
+		if err := d.startLocked(ctx, dcfg); err != nil {
+			errs = append(errs, err)
 		}
-		d.log.Infof("Starting discovery with config: %v", dcfg)
-		if err := d.discoverers[dcfg.Type].Start(ctx, dcfg.Type, d.eb, dcfg.Config); err != nil {
-			return fmt.Errorf("failed to start discovery %s: %w", dcfg.Type, err)
+	}
+	for typ := range d.running {
+		if !configured[typ] {
+			d.log.Infof("Stopping discovery %s", typ)
+			d.stopLocked(typ)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// startLocked starts the discoverer, replacing the running one of the same type once the new one has started,
+// so that the running one is kept when the new one fails to start.
+func (d *DiscoveryManager) startLocked(ctx context.Context, dcfg config.DiscoveryConfig) error {
+	factory, exists := Registry.Get(dcfg.Type)
+	if !exists {
+		return fmt.Errorf("unsupported discovery type: %s", dcfg.Type)
+	}
+	var staleAfter time.Duration
+	if dcfg.StaleAfter != "" {
+		var err error
+		if staleAfter, err = time.ParseDuration(dcfg.StaleAfter); err != nil {
+			return fmt.Errorf("invalid staleAfter for discovery %s: %w", dcfg.Type, err)
+		}
+	}
+	discoverer, err := factory(dcfg.Config, d.log)
+	if err != nil {
+		return fmt.Errorf("failed to create discovery %s: %w", dcfg.Type, err)
+	}
+
+	d.log.Infof("Starting discovery with config: %v", dcfg)
+	discoveryCtx, cancel := context.WithCancel(ctx)
+	if err := discoverer.Start(discoveryCtx, dcfg.Type, d.eb, dcfg.Config); err != nil {
+		cancel()
+		return fmt.Errorf("failed to start discovery %s: %w", dcfg.Type, err)
+	}
+	if _, exists := d.running[dcfg.Type]; exists {
+		d.log.Infof("Configuration of discovery %s changed, stopping the previous one", dcfg.Type)
+		d.stopLocked(dcfg.Type)
+	}
+	d.running[dcfg.Type] = &runningDiscovery{
+		discovery:  discoverer,
+		config:     dcfg,
+		staleAfter: staleAfter,
+		cancel:     cancel,
+	}
+	// Services already watched are looked up by the new discoverer
+	if watcher, ok := discoverer.(discovery.ServiceWatcher); ok {
+		for _, s := range d.status {
+			if s.Type == dcfg.Type {
+				s.stopWatch = watcher.WatchService(s.Service, s.Params)
+			}
 		}
 	}
 	return nil
 }
 
-func (d *DiscoveryManager) getDiscovery(config config.DiscoveryRef, serviceName string) (<-chan []*upstream.Node, error) {
-	d.log.Warnf("discoverers %v", d)
-	if _, exists := d.discoverers[config.Type]; exists {
-		return d.eb.Subscribe(types.ServiceDiscoveryEventKey(config.Type, serviceName)), nil
+func (d *DiscoveryManager) stopLocked(typ string) {
+	for _, s := range d.status {
+		if s.Type == typ && s.stopWatch != nil {
+			s.stopWatch()
+			s.stopWatch = nil
+		}
 	}
-	return nil, fmt.Errorf("unsupported discovery type: %s", config.Type)
+	d.running[typ].cancel()
+	delete(d.running, typ)
 }
 
-func (d *DiscoveryManager) StartDiscovery(ups *upstream.Upstream, discoveryManager *DiscoveryManager, discoveryConf config.DiscoveryRef, serviceName string) chan error {
-	errChan := make(chan error, 1)
-	nodesEvent, err := discoveryManager.getDiscovery(discoveryConf, serviceName)
-	if err != nil {
-		errChan <- fmt.Errorf("failed to initialize discovery: %v", err)
-		return errChan
+func (d *DiscoveryManager) startStaleCheck(ctx context.Context) {
+	utils.GoWithRecover(func() {
+		ticker := time.NewTicker(staleCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				d.Status()
+			}
+		}
+	}, func(a any) {
+		d.log.Errorf("panic in discovery staleness check: %v", a)
+	})
+}
+
+// Status returns the status of every watched service, logging the services that became stale or recovered.
+func (d *DiscoveryManager) Status() []ServiceStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	statuses := make([]ServiceStatus, 0, len(d.status))
+	for _, s := range d.status {
+		stale := false
+		if running, exists := d.running[s.Type]; exists && running.staleAfter > 0 {
+			last := s.LastUpdate
+			if last.IsZero() {
+				last = s.watchedSince
+			}
+			stale = now.Sub(last) > running.staleAfter
+		}
+		if stale && !s.Stale {
+			if s.LastUpdate.IsZero() {
+				d.log.Warnf("Discovery %s hasn't reported service %s yet", s.Type, s.Service)
+			} else {
+				d.log.Warnf("Discovery %s hasn't reported service %s since %s, its nodes are stale", s.Type, s.Service, s.LastUpdate.Format(time.RFC3339))
+			}
+		} else if !stale && s.Stale {
+			d.log.Infof("Discovery %s reported service %s again", s.Type, s.Service)
+		}
+		s.Stale = stale
+		statuses = append(statuses, s.ServiceStatus)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return types.ServiceDiscoveryParamsEventKey(statuses[i].Type, statuses[i].Service, statuses[i].Params) <
+			types.ServiceDiscoveryParamsEventKey(statuses[j].Type, statuses[j].Service, statuses[j].Params)
+	})
+	return statuses
+}
+
+// Healthy reports whether no watched service is stale.
+func (d *DiscoveryManager) Healthy() bool {
+	for _, s := range d.Status() {
+		if s.Stale {
+			return false
+		}
 	}
-	var wg sync.WaitGroup
-	wg.Add(1)
-	defer wg.Done()
-	wg.Add(1)
+	return true
+}
+
+// ValidateReference validates an upstream reference against the running discoverers, so that references to
+// a discovery type missing from the static configuration, or which failed to start, are rejected. It follows the
+// discoverers started and stopped by Reconcile.
+func (d *DiscoveryManager) ValidateReference(typ, service string, params map[string]string) error {
+	d.mu.Lock()
+	_, exists := d.running[typ]
+	d.mu.Unlock()
+	if !exists {
+		return fmt.Errorf("discovery %s is not configured", typ)
+	}
+	return Registry.ValidateReference(typ, service, params)
+}
+
+// Watch keeps the upstream's nodes in sync with the discovered service until the returned stop func is called.
+// Discoverers publishing every service they know about get their nodes filtered by the params as label selector,
+// the others are handed the params to look the service up.
+func (d *DiscoveryManager) Watch(ups *upstream.Upstream, discoveryConf config.DiscoveryRef, serviceName string) (func(), error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	running, exists := d.running[discoveryConf.Type]
+	if !exists {
+		return nil, fmt.Errorf("failed to initialize discovery: unsupported discovery type: %s", discoveryConf.Type)
+	}
+	topic := types.ServiceDiscoveryEventKey(discoveryConf.Type, serviceName)
+	selector := discoveryConf.Params
+	if _, isWatcher := running.discovery.(discovery.ServiceWatcher); isWatcher {
+		topic = types.ServiceDiscoveryParamsEventKey(discoveryConf.Type, serviceName, discoveryConf.Params)
+		selector = nil
+	}
+	statusKey := d.trackServiceLocked(running, discoveryConf, serviceName)
+	nodesEvent := d.eb.Subscribe(topic)
 	utils.GoWithRecover(func() {
-		defer wg.Done()
+		// The channel is closed on unsubscribe
 		for nodes := range nodesEvent {
+			nodes = discovery.FilterNodes(nodes, selector)
+			d.recordUpdate(statusKey, len(nodes))
 			ups.UpdateNodes(nodes)
 		}
 	}, func(a any) {
-		errChan <- fmt.Errorf("panic in node update listener for upstream %s: %v", ups.Name(), a)
+		d.log.Errorf("panic in node update listener for upstream %s: %v", ups.Name(), a)
 	})
-	go func() {
-		wg.Wait()
-		close(errChan)
-	}()
-	return errChan
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.eb.Unsubscribe(topic, nodesEvent)
+			d.untrackService(statusKey)
+		})
+	}, nil
+}
+
+// trackServiceLocked records one more watcher of the service, asking the discoverer to look it up on the first one.
+func (d *DiscoveryManager) trackServiceLocked(running *runningDiscovery, ref config.DiscoveryRef, serviceName string) string {
+	key := types.ServiceDiscoveryParamsEventKey(ref.Type, serviceName, ref.Params)
+	s, exists := d.status[key]
+	if !exists {
+		s = &serviceStatus{
+			ServiceStatus: ServiceStatus{Type: ref.Type, Service: serviceName, Params: ref.Params},
+			watchedSince:  time.Now(),
+		}
+		if watcher, ok := running.discovery.(discovery.ServiceWatcher); ok {
+			s.stopWatch = watcher.WatchService(serviceName, ref.Params)
+		}
+		d.status[key] = s
+	}
+	s.watchers++
+	return key
+}
+
+func (d *DiscoveryManager) recordUpdate(key string, nodes int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, exists := d.status[key]; exists {
+		s.LastUpdate = time.Now()
+		s.Nodes = nodes
+	}
+}
+
+func (d *DiscoveryManager) untrackService(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if s, exists := d.status[key]; exists {
+		s.watchers--
+		if s.watchers == 0 {
+			if s.stopWatch != nil {
+				s.stopWatch()
+			}
+			delete(d.status, key)
+		}
+	}
 }
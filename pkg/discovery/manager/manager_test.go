@@ -1,11 +1,19 @@
 package manager
 
 import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/discovery"
+	"github.com/Revolyssup/arp/pkg/eventbus"
 	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/types"
 	"github.com/Revolyssup/arp/pkg/upstream"
 )
 
@@ -45,7 +53,11 @@ func TestUpstreamWithDemoDiscovery(t *testing.T) {
 		t.Fatalf("Failed to create upstream with discovery: %v", err)
 	}
 	discoveryManager.InitDiscovery(t.Context(), conf)
-	discoveryManager.StartDiscovery(headerup, discoveryManager, headerupConf.Discovery, "header")
+	stopHeader, err := discoveryManager.Watch(headerup, headerupConf.Discovery, "header")
+	if err != nil {
+		t.Fatalf("Failed to watch discovery: %v", err)
+	}
+	defer stopHeader()
 	if headerup == nil {
 		t.Fatal("Expected upstream to be non-nil")
 	}
@@ -59,7 +71,11 @@ func TestUpstreamWithDemoDiscovery(t *testing.T) {
 		t.Fatal("Expected upstream to be non-nil")
 	}
 	discoveryManager.InitDiscovery(t.Context(), conf)
-	_ = discoveryManager.StartDiscovery(up, discoveryManager, ipupConf.Discovery, "ip")
+	stopIP, err := discoveryManager.Watch(up, ipupConf.Discovery, "ip")
+	if err != nil {
+		t.Fatalf("Failed to watch discovery: %v", err)
+	}
+	defer stopIP()
 	time.Sleep(2 * time.Second) // wait for discovery to populate nodes
 	//first try
 	firstNode := up.SelectNode()
@@ -75,3 +91,312 @@ func TestUpstreamWithDemoDiscovery(t *testing.T) {
 		t.Errorf("Expected different nodes from different service name, got same node %v", firstNode)
 	}
 }
+
+func TestRegistryValidatesStaticConfig(t *testing.T) {
+	validator := config.NewStaticValidator()
+	validator.SetDiscoveryValidator(Registry.Validate)
+
+	valid := &config.Static{DiscoveryConfigs: conf}
+	if err := validator.Validate(valid); err != nil {
+		t.Errorf("Expected registered discovery to be valid, got %v", err)
+	}
+
+	tests := map[string]config.DiscoveryConfig{
+		"unknown type":   {Type: "unknown"},
+		"invalid config": {Type: "demo", Config: map[string]any{"interval": "soon"}},
+	}
+	for name, dcfg := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := validator.Validate(&config.Static{DiscoveryConfigs: []config.DiscoveryConfig{dcfg}}); err == nil {
+				t.Error("Expected validation to fail")
+			}
+		})
+	}
+
+	mgr, _ := NewDiscoveryManager(logger.New(logger.LevelInfo))
+	if err := mgr.InitDiscovery(t.Context(), []config.DiscoveryConfig{{Type: "unknown"}}); err == nil {
+		t.Error("Expected unknown discovery type to fail")
+	}
+}
+
+func TestRegistryValidatesDynamicConfig(t *testing.T) {
+	validator := config.NewDynamicValidator()
+	validator.SetDiscoveryReferenceValidator(Registry.ValidateReference)
+
+	upstreamWith := func(service string, ref config.DiscoveryRef) config.Dynamic {
+		return config.Dynamic{Upstreams: []config.UpstreamConfig{{Name: "backend", Service: service, Discovery: ref}}}
+	}
+	valid := upstreamWith("web", config.DiscoveryRef{Type: "dns", Params: map[string]string{"port": "8080"}})
+	if err := validator.Validate(&valid); err != nil {
+		t.Errorf("Expected valid discovery reference, got %v", err)
+	}
+
+	tests := map[string]config.Dynamic{
+		"unknown type":            upstreamWith("web", config.DiscoveryRef{Type: "unknown"}),
+		"invalid dns port":        upstreamWith("web", config.DiscoveryRef{Type: "dns", Params: map[string]string{"port": "http"}}),
+		"kubernetes no namespace": upstreamWith("web", config.DiscoveryRef{Type: "kubernetes"}),
+	}
+	for name, cfg := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := validator.Validate(&cfg); err == nil {
+				t.Error("Expected validation to fail")
+			}
+			if errs := validator.GetErrors(); len(errs) != 1 || errs[0].Field != "upstreams[0].discovery" {
+				t.Errorf("Expected an error on upstreams[0].discovery, got %v", errs)
+			}
+		})
+	}
+}
+
+func TestWatchFiltersByParams(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	content := `
+web:
+  - url: http://10.0.0.1:8080
+    labels:
+      version: v1
+  - url: http://10.0.0.2:8080
+    labels:
+      version: v2
+`
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	mgr, _ := NewDiscoveryManager(logger.New(logger.LevelInfo))
+	if err := mgr.InitDiscovery(t.Context(), []config.DiscoveryConfig{{Type: "file", Config: map[string]any{"path": path}}}); err != nil {
+		t.Fatalf("Failed to init discovery: %v", err)
+	}
+
+	factory := upstream.NewFactory()
+	watch := func(params map[string]string) *upstream.Upstream {
+		cfg := config.UpstreamConfig{Service: "web", Discovery: config.DiscoveryRef{Type: "file", Params: params}}
+		up, err := factory.NewUpstream(cfg)
+		if err != nil {
+			t.Fatalf("Failed to create upstream: %v", err)
+		}
+		stop, err := mgr.Watch(up, cfg.Discovery, cfg.Service)
+		if err != nil {
+			t.Fatalf("Failed to watch discovery: %v", err)
+		}
+		t.Cleanup(stop)
+		return up
+	}
+	all := watch(nil)
+	v2 := watch(map[string]string{"version": "v2"})
+
+	// Collects the hosts selected by the upstream once it has nodes
+	selected := func(up *upstream.Upstream) map[string]bool {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if node := up.SelectNode(); node != nil {
+				up.Release(node)
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for discovered nodes")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		hosts := make(map[string]bool)
+		for range 4 {
+			node := up.SelectNode()
+			hosts[node.URL.Host] = true
+			up.Release(node)
+		}
+		return hosts
+	}
+	if hosts := selected(all); len(hosts) != 2 {
+		t.Errorf("Expected both nodes without params, got %v", hosts)
+	}
+	if hosts := selected(v2); len(hosts) != 1 || !hosts["10.0.0.2:8080"] {
+		t.Errorf("Expected only the v2 node, got %v", hosts)
+	}
+}
+
+func TestStatusReportsStaleServices(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	write("web: [{url: http://10.0.0.1:8080}]")
+	mgr, _ := NewDiscoveryManager(logger.New(logger.LevelInfo))
+	err := mgr.InitDiscovery(t.Context(), []config.DiscoveryConfig{{Type: "file", Config: map[string]any{"path": path}, StaleAfter: "200ms"}})
+	if err != nil {
+		t.Fatalf("Failed to init discovery: %v", err)
+	}
+	cfg := config.UpstreamConfig{Service: "web", Discovery: config.DiscoveryRef{Type: "file"}}
+	up, _ := upstream.NewFactory().NewUpstream(cfg)
+	stop, err := mgr.Watch(up, cfg.Discovery, cfg.Service)
+	if err != nil {
+		t.Fatalf("Failed to watch discovery: %v", err)
+	}
+
+	waitFor := func(check func(ServiceStatus) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			status := mgr.Status()
+			if len(status) == 1 && check(status[0]) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Unexpected discovery status %+v", status)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitFor(func(s ServiceStatus) bool { return s.Nodes == 1 && !s.LastUpdate.IsZero() && !s.Stale })
+	waitFor(func(s ServiceStatus) bool { return s.Stale })
+	if mgr.Healthy() {
+		t.Error("Expected discovery to be unhealthy while a service is stale")
+	}
+
+	write("web: [{url: http://10.0.0.1:8080}, {url: http://10.0.0.2:8080}]")
+	waitFor(func(s ServiceStatus) bool { return s.Nodes == 2 && !s.Stale })
+
+	stop()
+	if status := mgr.Status(); len(status) != 0 {
+		t.Errorf("Expected no status once the service isn't watched, got %+v", status)
+	}
+}
+
+// fakeDiscovery publishes a single node on the configured host for every watched service.
+type fakeDiscovery struct {
+	host string
+	// fail makes Start fail
+	fail bool
+	ctx  context.Context
+	name string
+	eb   *eventbus.EventBus[[]*upstream.Node]
+}
+
+func (f *fakeDiscovery) Start(ctx context.Context, name string, eb *eventbus.EventBus[[]*upstream.Node], cfg map[string]any) error {
+	if f.fail {
+		return fmt.Errorf("failed to reach %s", f.host)
+	}
+	f.ctx, f.name, f.eb = ctx, name, eb
+	return nil
+}
+
+func (f *fakeDiscovery) WatchService(service string, params map[string]string) func() {
+	f.eb.Publish(types.ServiceDiscoveryParamsEventKey(f.name, service, params), []*upstream.Node{
+		{ServiceName: service, URL: &url.URL{Scheme: "http", Host: f.host}},
+	})
+	return func() {}
+}
+
+func init() {
+	Registry.Register("fake", func(cfg map[string]any, log *logger.Logger) (discovery.Discovery, error) {
+		fail, _ := cfg["fail"].(bool)
+		return &fakeDiscovery{host: cfg["host"].(string), fail: fail}, nil
+	}, nil)
+}
+
+func TestReconcile(t *testing.T) {
+	mgr, _ := NewDiscoveryManager(logger.New(logger.LevelInfo))
+	fakeConfig := func(host string) []config.DiscoveryConfig {
+		return []config.DiscoveryConfig{{Type: "fake", Config: map[string]any{"host": host}}}
+	}
+	if err := mgr.Reconcile(t.Context(), fakeConfig("first:8080")); err != nil {
+		t.Fatalf("Failed to reconcile discovery: %v", err)
+	}
+	first := mgr.running["fake"].discovery.(*fakeDiscovery)
+
+	cfg := config.UpstreamConfig{Service: "web", Discovery: config.DiscoveryRef{Type: "fake"}}
+	up, _ := upstream.NewFactory().NewUpstream(cfg)
+	stop, err := mgr.Watch(up, cfg.Discovery, cfg.Service)
+	if err != nil {
+		t.Fatalf("Failed to watch discovery: %v", err)
+	}
+	defer stop()
+	expectHost := func(host string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			node := up.SelectNode()
+			if node != nil {
+				up.Release(node)
+				if node.URL.Host == host {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for node %s", host)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	expectHost("first:8080")
+
+	// An unchanged configuration keeps the discoverer
+	if err := mgr.Reconcile(t.Context(), fakeConfig("first:8080")); err != nil {
+		t.Fatalf("Failed to reconcile discovery: %v", err)
+	}
+	if mgr.running["fake"].discovery != first {
+		t.Error("Expected unchanged discovery to keep running")
+	}
+
+	// A changed configuration restarts the discoverer, which takes over the watched services
+	if err := mgr.Reconcile(t.Context(), fakeConfig("second:8080")); err != nil {
+		t.Fatalf("Failed to reconcile discovery: %v", err)
+	}
+	if first.ctx.Err() == nil {
+		t.Error("Expected the replaced discovery to be stopped")
+	}
+	expectHost("second:8080")
+
+	// A discoverer failing to start leaves the running one in place
+	second := mgr.running["fake"].discovery.(*fakeDiscovery)
+	failing := []config.DiscoveryConfig{{Type: "fake", Config: map[string]any{"host": "broken:8080", "fail": true}}}
+	if err := mgr.Reconcile(t.Context(), failing); err == nil {
+		t.Error("Expected failing discovery to fail")
+	}
+	if mgr.running["fake"].discovery != second || second.ctx.Err() != nil {
+		t.Error("Expected the running discovery to keep running")
+	}
+
+	// Removed discoverers are stopped, upstreams keep their last nodes
+	if err := mgr.Reconcile(t.Context(), nil); err != nil {
+		t.Fatalf("Failed to reconcile discovery: %v", err)
+	}
+	if second.ctx.Err() == nil {
+		t.Error("Expected the removed discovery to be stopped")
+	}
+	expectHost("second:8080")
+	if _, err := mgr.Watch(up, cfg.Discovery, cfg.Service); err == nil {
+		t.Error("Expected watching a removed discovery to fail")
+	}
+
+	// Errors are reported while the other discoverers still start
+	err = mgr.Reconcile(t.Context(), append(fakeConfig("third:8080"), config.DiscoveryConfig{Type: "unknown"}))
+	if err == nil {
+		t.Error("Expected unknown discovery type to fail")
+	}
+	if _, exists := mgr.running["fake"]; !exists {
+		t.Error("Expected valid discovery to start despite other failures")
+	}
+}
+
+func TestValidateReferenceAgainstRunningDiscovery(t *testing.T) {
+	mgr, _ := NewDiscoveryManager(logger.New(logger.LevelInfo))
+	if err := mgr.Reconcile(t.Context(), []config.DiscoveryConfig{{Type: "fake", Config: map[string]any{"host": "web:8080"}}}); err != nil {
+		t.Fatalf("Failed to reconcile discovery: %v", err)
+	}
+	if err := mgr.ValidateReference("fake", "web", nil); err != nil {
+		t.Errorf("Expected running discovery to be valid, got %v", err)
+	}
+	// dns is registered but not configured
+	if err := mgr.ValidateReference("dns", "web", nil); err == nil {
+		t.Error("Expected discovery missing from the configuration to be invalid")
+	}
+
+	if err := mgr.Reconcile(t.Context(), nil); err != nil {
+		t.Fatalf("Failed to reconcile discovery: %v", err)
+	}
+	if err := mgr.ValidateReference("fake", "web", nil); err == nil {
+		t.Error("Expected removed discovery to be invalid")
+	}
+}
@@ -0,0 +1,50 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+)
+
+// Watches runs a single watch loop per service for discoverers implementing ServiceWatcher, shared by
+// every upstream watching the service.
+type Watches struct {
+	mu      sync.Mutex
+	watches map[string]*serviceWatch
+}
+
+type serviceWatch struct {
+	refs   int
+	cancel context.CancelFunc
+}
+
+func NewWatches() *Watches {
+	return &Watches{watches: make(map[string]*serviceWatch)}
+}
+
+// Start runs watch in a goroutine unless it already runs for the service, and returns the func releasing
+// the reference. The context given to watch is cancelled once every reference is released.
+func (w *Watches) Start(ctx context.Context, service string, watch func(ctx context.Context)) (stop func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sw, exists := w.watches[service]
+	if !exists {
+		watchCtx, cancel := context.WithCancel(ctx)
+		sw = &serviceWatch{cancel: cancel}
+		w.watches[service] = sw
+		go watch(watchCtx)
+	}
+	sw.refs++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			sw.refs--
+			if sw.refs == 0 {
+				sw.cancel()
+				delete(w.watches, service)
+			}
+		})
+	}
+}
@@ -4,12 +4,13 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 
 	"github.com/Revolyssup/arp/pkg/config"
-	"github.com/Revolyssup/arp/pkg/discovery/manager"
 	"github.com/Revolyssup/arp/pkg/eventbus"
 	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/proxy"
 	"github.com/Revolyssup/arp/pkg/route"
 	httprouter "github.com/Revolyssup/arp/pkg/router/http"
 	"github.com/Revolyssup/arp/pkg/types"
@@ -24,13 +25,20 @@ type Listener struct {
 	router *httprouter.Router
 	server *http.Server
 	logger *logger.Logger
+	// ln is bound by Listen, or by Start when Listen wasn't called
+	ln net.Listener
+
+	eventBus           *eventbus.EventBus[config.Dynamic]
+	routeUpdates       <-chan config.Dynamic
+	streamRouteUpdates <-chan config.Dynamic
 }
 
-func NewListener(cfg config.ListenerConfig, discoveryManager *manager.DiscoveryManager, eventBus *eventbus.EventBus[config.Dynamic], routerFactory *route.Factory, upstreamFactory *upstream.Factory, logger *logger.Logger) *Listener {
+func NewListener(cfg config.ListenerConfig, eventBus *eventbus.EventBus[config.Dynamic], routerFactory *route.Factory, upstreams *upstream.Registry, proxyService *proxy.Service, logger *logger.Logger) *Listener {
 	l := &Listener{
-		config: cfg,
-		router: httprouter.NewRouter(cfg.Name, routerFactory, upstreamFactory, discoveryManager, logger),
-		logger: logger,
+		config:   cfg,
+		router:   httprouter.NewRouter(cfg.Name, routerFactory, upstreams, proxyService, logger),
+		logger:   logger,
+		eventBus: eventBus,
 	}
 	var handler http.Handler = l.router
 	if cfg.HTTP2 && cfg.TLS == nil {
@@ -53,12 +61,24 @@ func NewListener(cfg config.ListenerConfig, discoveryManager *manager.DiscoveryM
 		}
 	}
 
+	// Subscribing right away gets the last published config, even for listeners created after it was published
+	l.routeUpdates = eventBus.Subscribe(types.RouteEventKey(cfg.Name))
+	l.streamRouteUpdates = eventBus.Subscribe(types.StreamRouteEventKey(cfg.Name))
 	utils.GoWithRecover(func() {
-		for dynCfg := range eventBus.Subscribe(types.RouteEventKey(cfg.Name)) {
-			l.updateRoutes(dynCfg.Routes, dynCfg.Upstreams, dynCfg.Plugins)
-		}
-		for dynCfg := range eventBus.Subscribe(types.StreamRouteEventKey(cfg.Name)) {
-			l.updateStreamRoutes(dynCfg.StreamRoute, dynCfg.Upstreams, dynCfg.Plugins)
+		// Both channels are closed when the listener is stopped
+		for {
+			select {
+			case dynCfg, ok := <-l.routeUpdates:
+				if !ok {
+					return
+				}
+				l.updateRoutes(dynCfg.Routes, dynCfg.Upstreams, dynCfg.Plugins)
+			case dynCfg, ok := <-l.streamRouteUpdates:
+				if !ok {
+					return
+				}
+				l.updateStreamRoutes(dynCfg.StreamRoute, dynCfg.Upstreams, dynCfg.Plugins)
+			}
 		}
 	}, func(a any) {
 		l.logger.Errorf("panic in route update listener for listener %s: %v", cfg.Name, a)
@@ -66,23 +86,49 @@ func NewListener(cfg config.ListenerConfig, discoveryManager *manager.DiscoveryM
 	return l
 }
 
+// Listen binds the listener's port, so that a listener replacing another one on the same port is bound before the
+// old one stops. Ports are bound with SO_REUSEPORT where supported, both listeners accepting connections until the
+// old one is stopped.
+func (l *Listener) Listen() error {
+	if l.ln != nil {
+		return nil
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	ln, err := lc.Listen(context.Background(), "tcp", l.server.Addr)
+	if err != nil {
+		return err
+	}
+	l.ln = ln
+	return nil
+}
+
+// Start serves the listener until it is stopped, binding its port first when Listen wasn't called.
 func (l *Listener) Start() error {
+	if err := l.Listen(); err != nil {
+		return err
+	}
 	if l.config.TLS != nil {
-		return l.server.ListenAndServeTLS(l.config.TLS.CertFile, l.config.TLS.KeyFile)
+		return l.server.ServeTLS(l.ln, l.config.TLS.CertFile, l.config.TLS.KeyFile)
 	}
-	return l.server.ListenAndServe()
+	return l.server.Serve(l.ln)
 }
 
 // TODO: Refactor the updation logic from this ugly mess of passing each config type separately.
 func (l *Listener) updateRoutes(routes []config.RouteConfig, upstreams []config.UpstreamConfig, plugins []config.PluginConfig) {
 	l.logger.Infof("Updating routes for listener %s", l.config.Name)
-	l.router.UpdateRoutes(routes, upstreams, plugins)
+	if err := l.router.UpdateRoutes(routes, upstreams, plugins); err != nil {
+		l.logger.Errorf("Failed to update routes for listener %s: %v", l.config.Name, err)
+	}
 }
 
 func (l *Listener) updateStreamRoutes(streamRoutes []config.StreamRouteConfig, upstreams []config.UpstreamConfig, plugins []config.PluginConfig) {
 	l.logger.Infof("Updating stream routes for listener %s", l.config.Name)
 	// l.router.UpdateStreamRoutes(streamRoutes, upstreams, plugins)
 }
+
+// Stop stops receiving config updates and gracefully shuts the server down.
 func (l *Listener) Stop(ctx context.Context) error {
+	l.eventBus.Unsubscribe(types.RouteEventKey(l.config.Name), l.routeUpdates)
+	l.eventBus.Unsubscribe(types.StreamRouteEventKey(l.config.Name), l.streamRouteUpdates)
 	return l.server.Shutdown(ctx)
 }
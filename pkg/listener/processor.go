@@ -4,6 +4,7 @@ import (
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"sync"
 
 	"github.com/Revolyssup/arp/pkg/config"
 	"github.com/Revolyssup/arp/pkg/eventbus"
@@ -17,9 +18,15 @@ type ListenerProcessor struct {
 	listenerHashes   map[string]string // Maps listener name to config hash
 	logger           *logger.Logger
 	dynamicValidator *config.DynamicValidator
+
+	mu sync.Mutex
+	// last is the last config received, processed again when the listeners change
+	last *config.Dynamic
 }
 
-func NewListenerProcessor(eventBus *eventbus.EventBus[config.Dynamic], dynamicValidator *config.DynamicValidator, logger *logger.Logger) watcher.Processor {
+var _ watcher.Processor = (*ListenerProcessor)(nil)
+
+func NewListenerProcessor(eventBus *eventbus.EventBus[config.Dynamic], dynamicValidator *config.DynamicValidator, logger *logger.Logger) *ListenerProcessor {
 	return &ListenerProcessor{
 		eventBus:         eventBus,
 		logger:           logger,
@@ -31,6 +38,24 @@ func NewListenerProcessor(eventBus *eventbus.EventBus[config.Dynamic], dynamicVa
 // processConfig helps to send each provider config for the listener that it's specifically subscribed to.
 // Processor -> EventBus -> Listener -> Router
 func (w *ListenerProcessor) Process(dynCfg config.Dynamic) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.last = &dynCfg
+	w.processLocked(dynCfg)
+}
+
+// SetListeners validates the configs against the new static listeners, processing the last config again so that
+// routes rejected for referencing a listener that didn't exist yet are published.
+func (w *ListenerProcessor) SetListeners(listeners []config.ListenerConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dynamicValidator.SetListeners(listeners)
+	if w.last != nil {
+		w.processLocked(*w.last)
+	}
+}
+
+func (w *ListenerProcessor) processLocked(dynCfg config.Dynamic) {
 	err := w.dynamicValidator.Validate(&dynCfg)
 	if err != nil {
 		w.logger.Errorf("Dynamic config validation failed: %v", err)
@@ -225,3 +225,33 @@ func TestListenerProcessor(t *testing.T) {
 	eventBus.Unsubscribe(types.RouteEventKey("listener2"), eventChan2)
 	wg.Wait()
 }
+
+func TestListenerProcessorSetListeners(t *testing.T) {
+	eventBus := eventbus.NewEventBus[config.Dynamic](logger.New(log.InfoLevel))
+	dynamicValidator := config.NewDynamicValidator()
+	dynamicValidator.SetListeners([]config.ListenerConfig{{Name: "http", Port: 8080}})
+	processor := NewListenerProcessor(eventBus, dynamicValidator, logger.New(log.InfoLevel))
+
+	cfg := config.Dynamic{
+		Routes: []config.RouteConfig{
+			{Name: "web", Listener: "http", Matches: []config.Match{{Path: "/"}}, Upstream: &config.UpstreamConfig{Name: "backend"}},
+			{Name: "admin", Listener: "admin", Matches: []config.Match{{Path: "/"}}, Upstream: &config.UpstreamConfig{Name: "backend"}},
+		},
+		Upstreams: []config.UpstreamConfig{{Name: "backend", Nodes: []config.Node{{URL: "http://127.0.0.1:9090"}}}},
+	}
+	// The admin listener doesn't exist yet, rejecting the whole config
+	processor.Process(cfg)
+
+	// Subscribing after the listener is added, like a listener created on reload
+	processor.SetListeners([]config.ListenerConfig{{Name: "http", Port: 8080}, {Name: "admin", Port: 8081}})
+	events := eventBus.Subscribe(types.RouteEventKey("admin"))
+	defer eventBus.Unsubscribe(types.RouteEventKey("admin"), events)
+	select {
+	case event := <-events:
+		if len(event.Routes) != 1 || event.Routes[0].Name != "admin" {
+			t.Errorf("Expected the admin route, got %v", event.Routes)
+		}
+	case <-time.After(TIMEOUT * time.Second):
+		t.Fatal("Timeout waiting for the routes of the new listener")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package listener
+
+import "syscall"
+
+// reusePort is a no-op where SO_REUSEPORT isn't supported, a replaced listener having to stop before the new one
+// binds its port.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return nil
+}
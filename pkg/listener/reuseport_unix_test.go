@@ -0,0 +1,24 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package listener
+
+import (
+	"net"
+	"testing"
+)
+
+func TestReusePort(t *testing.T) {
+	lc := net.ListenConfig{Control: reusePort}
+	old, err := lc.Listen(t.Context(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer old.Close()
+
+	// The replacing listener binds the port while the old one still accepts connections
+	replacement, err := lc.Listen(t.Context(), "tcp", old.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected the port to be shared, got %v", err)
+	}
+	replacement.Close()
+}
@@ -1,12 +1,68 @@
 package logger
 
 import (
+	"io"
 	"os"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/charmbracelet/log"
 )
 
+// minRedactedLength is the length under which values aren't redacted, as they would mask unrelated output
+// without being meaningful secrets.
+const minRedactedLength = 4
+
+var (
+	redactMu sync.RWMutex
+	redacted []string
+	output   io.Writer = redactingWriter{os.Stderr}
+
+	// level is shared by every logger, so that SetGlobalLevel applies to the loggers already created. The
+	// underlying loggers log every level, leaving the filtering to Logger.
+	level atomic.Int64
+)
+
+// Redact masks the value in everything logged from now on, by any logger. The lines of multi-line values,
+// like PEM keys, are masked on their own too.
+func Redact(value string) {
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	values := []string{value}
+	if strings.Contains(value, "\n") {
+		values = append(values, strings.Split(value, "\n")...)
+	}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if len(value) >= minRedactedLength && !slices.Contains(redacted, value) {
+			redacted = append(redacted, value)
+		}
+	}
+	// Longer values first, so that values containing others are masked as a whole
+	sort.Slice(redacted, func(i, j int) bool { return len(redacted[i]) > len(redacted[j]) })
+}
+
+// redactingWriter masks the redacted values of the log lines written to it.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	redactMu.RLock()
+	line := string(p)
+	for _, value := range redacted {
+		line = strings.ReplaceAll(line, value, "[REDACTED]")
+	}
+	redactMu.RUnlock()
+	if _, err := io.WriteString(r.w, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
 // TODO: Add structured logging with fields
 type Logger struct {
 	*log.Logger
@@ -22,9 +78,11 @@ const (
 	LevelError = log.ErrorLevel
 )
 
+// New creates a root logger, setting the level shared by every logger.
 func New(level Level) *Logger {
-	logger := log.New(os.Stderr)
-	logger.SetLevel(level)
+	SetGlobalLevel(level)
+	logger := log.New(output)
+	logger.SetLevel(LevelDebug)
 	logger.SetTimeFormat("2006-01-02 15:04:05")
 	logger.SetReportCaller(false)
 
@@ -44,8 +102,8 @@ func (l *Logger) WithComponent(component string) *Logger {
 	}
 
 	// Create a new logger with the updated component chain
-	newLogger := log.New(os.Stderr)
-	newLogger.SetLevel(l.GetLevel())
+	newLogger := log.New(output)
+	newLogger.SetLevel(LevelDebug)
 	newLogger.SetTimeFormat("2006-01-02 15:04:05")
 	newLogger.SetReportCaller(false)
 
@@ -59,11 +117,69 @@ func (l *Logger) WithComponent(component string) *Logger {
 }
 
 func (l *Logger) GetLevel() Level {
-	return l.Logger.GetLevel()
+	return Level(level.Load())
 }
 
+// SetLevel changes the level shared by every logger.
 func (l *Logger) SetLevel(level Level) {
-	l.Logger.SetLevel(level)
+	SetGlobalLevel(level)
+}
+
+// SetGlobalLevel changes the level of every logger, like when the static configuration is reloaded.
+func SetGlobalLevel(l Level) {
+	level.Store(int64(l))
+}
+
+func enabled(l Level) bool {
+	return int64(l) >= level.Load()
+}
+
+func (l *Logger) Debug(msg any, keyvals ...any) {
+	if enabled(LevelDebug) {
+		l.Logger.Debug(msg, keyvals...)
+	}
+}
+
+func (l *Logger) Debugf(format string, args ...any) {
+	if enabled(LevelDebug) {
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l *Logger) Info(msg any, keyvals ...any) {
+	if enabled(LevelInfo) {
+		l.Logger.Info(msg, keyvals...)
+	}
+}
+
+func (l *Logger) Infof(format string, args ...any) {
+	if enabled(LevelInfo) {
+		l.Logger.Infof(format, args...)
+	}
+}
+
+func (l *Logger) Warn(msg any, keyvals ...any) {
+	if enabled(LevelWarn) {
+		l.Logger.Warn(msg, keyvals...)
+	}
+}
+
+func (l *Logger) Warnf(format string, args ...any) {
+	if enabled(LevelWarn) {
+		l.Logger.Warnf(format, args...)
+	}
+}
+
+func (l *Logger) Error(msg any, keyvals ...any) {
+	if enabled(LevelError) {
+		l.Logger.Error(msg, keyvals...)
+	}
+}
+
+func (l *Logger) Errorf(format string, args ...any) {
+	if enabled(LevelError) {
+		l.Logger.Errorf(format, args...)
+	}
 }
 
 func SetLogLevel(levelStr string) Level {
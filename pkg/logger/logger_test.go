@@ -0,0 +1,41 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSetGlobalLevel(t *testing.T) {
+	var buf bytes.Buffer
+	previous := output
+	output = redactingWriter{&buf}
+	defer func() {
+		output = previous
+		SetGlobalLevel(LevelInfo)
+	}()
+
+	root := New(LevelInfo)
+	child := root.WithComponent("child")
+	child.Debugf("hidden")
+	child.Infof("shown")
+
+	// Loggers created before the change follow it
+	SetGlobalLevel(LevelDebug)
+	child.Debugf("debug")
+	root.WithComponent("other").Debug("other debug")
+	SetGlobalLevel(LevelError)
+	child.Warnf("dropped")
+
+	logged := buf.String()
+	for _, line := range []string{"[child]: shown", "[child]: debug", "[other]: other debug"} {
+		if !strings.Contains(logged, line) {
+			t.Errorf("Expected %q to be logged, got:\n%s", line, logged)
+		}
+	}
+	for _, line := range []string{"hidden", "dropped"} {
+		if strings.Contains(logged, line) {
+			t.Errorf("Expected %q to be filtered, got:\n%s", line, logged)
+		}
+	}
+}
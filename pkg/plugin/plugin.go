@@ -63,6 +63,6 @@ var Registry *types.Registry
 
 func init() {
 	Registry = types.NewRegistry()
-	Registry.Register("demo", demo.NewPlugin)
-	Registry.Register("responsecache", responsecache.NewPlugin)
+	Registry.Register("demo", demo.NewPlugin, nil)
+	Registry.Register("responsecache", responsecache.NewPlugin, responsecache.ValidateConfig)
 }
@@ -43,8 +43,8 @@ const (
 	DefaultTTL = 30 * time.Second
 )
 
-func (p *ResponseCache) ValidateAndSetConfig(conf types.PluginConf) error {
-	//validate before setting
+// ValidateConfig validates the configuration of the plugin.
+func ValidateConfig(conf types.PluginConf) error {
 	if conf == nil {
 		return fmt.Errorf("config cannot be nil")
 	}
@@ -74,6 +74,14 @@ func (p *ResponseCache) ValidateAndSetConfig(conf types.PluginConf) error {
 	} else {
 		return fmt.Errorf("key must be a string")
 	}
+	return nil
+}
+
+func (p *ResponseCache) ValidateAndSetConfig(conf types.PluginConf) error {
+	//validate before setting
+	if err := ValidateConfig(conf); err != nil {
+		return err
+	}
 	p.config = conf
 	size := conf["size"].(int)
 	p.cache = cache.NewLRUCache[[]byte](size, p.logger)
@@ -394,3 +394,18 @@ func TestResponseCache_DefaultTTL(t *testing.T) {
 	}
 
 }
+
+func TestRegistryValidatesConfig(t *testing.T) {
+	registry := types.NewRegistry()
+	registry.Register("responsecache", NewPlugin, ValidateConfig)
+
+	if err := registry.Validate("responsecache", map[string]any{"size": 10, "ttl": 30, "key": "uri"}); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+	if err := registry.Validate("responsecache", map[string]any{"size": 10, "ttl": 30, "key": "path"}); err == nil {
+		t.Error("Expected invalid key to fail")
+	}
+	if err := registry.Validate("unknown", nil); err == nil {
+		t.Error("Expected unknown plugin type to fail")
+	}
+}
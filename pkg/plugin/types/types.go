@@ -1,6 +1,7 @@
 package types
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/Revolyssup/arp/pkg/logger"
@@ -24,6 +25,10 @@ type Plugin interface {
 
 type PluginFactory func(logger *logger.Logger) Plugin
 
+// ConfigValidator validates the configuration of a plugin type, so that invalid configurations are rejected with
+// the whole update instead of the plugin being skipped at runtime.
+type ConfigValidator func(conf PluginConf) error
+
 type ResponseWriterWrapper interface {
 	http.ResponseWriter
 	Unwrap() http.ResponseWriter
@@ -51,19 +56,37 @@ func (b *BaseResponseWriter) Header() http.Header {
 }
 
 type Registry struct {
-	plugins map[string]PluginFactory
+	plugins    map[string]PluginFactory
+	validators map[string]ConfigValidator
 }
 
 func NewRegistry() *Registry {
 	return &Registry{
-		plugins: make(map[string]PluginFactory),
+		plugins:    make(map[string]PluginFactory),
+		validators: make(map[string]ConfigValidator),
 	}
 }
-func (r *Registry) Register(typ string, pluginFactory PluginFactory) {
+
+// Register adds a plugin type. The validator is optional.
+func (r *Registry) Register(typ string, pluginFactory PluginFactory, validator ConfigValidator) {
 	r.plugins[typ] = pluginFactory
+	if validator != nil {
+		r.validators[typ] = validator
+	}
 }
 
 func (r *Registry) Get(typ string) (PluginFactory, bool) {
 	p, exists := r.plugins[typ]
 	return p, exists
 }
+
+// Validate checks that the plugin type is registered and its configuration is valid.
+func (r *Registry) Validate(typ string, conf map[string]any) error {
+	if _, exists := r.plugins[typ]; !exists {
+		return fmt.Errorf("unsupported plugin type: %s", typ)
+	}
+	if validate, exists := r.validators[typ]; exists {
+		return validate(conf)
+	}
+	return nil
+}
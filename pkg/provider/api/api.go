@@ -0,0 +1,438 @@
+package api
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/discovery/manager"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/Revolyssup/arp/pkg/plugin"
+	"gopkg.in/yaml.v3"
+)
+
+// maxBodySize bounds the size of request bodies
+const maxBodySize = 1 << 20
+
+// APIProvider serves a REST API to manage routes, upstreams and plugins individually:
+//
+//	GET    /config              the whole configuration
+//	GET    /<kind>              the objects of a kind, being routes, upstreams or plugins
+//	GET    /<kind>/<name>       an object
+//	PUT    /<kind>/<name>       creates or replaces an object
+//	PATCH  /<kind>/<name>       updates an object with a JSON merge patch (RFC 7386)
+//	DELETE /<kind>/<name>       deletes an object
+//
+// Bodies are JSON or YAML objects using the same fields as the configuration files. Every change is validated
+// before being applied, and increments the revision of the configuration, returned in the ETag header of every
+// response. Changes sent with an If-Match header fail with 412 when the configuration was changed since that
+// revision. Requests must carry the configured token as a bearer token.
+//
+// The configuration is kept in memory, and starts empty.
+type APIProvider struct {
+	config   config.ProviderConfig
+	logger   *logger.Logger
+	address  string
+	token    string
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	current  config.Dynamic
+	revision uint64
+	// updated is signalled on every change, coalescing the changes the watcher didn't receive yet
+	updated chan struct{}
+	// listeners are the static listeners routes may reference, nil until set with SetListeners
+	listeners []config.ListenerConfig
+	// discoveryReferenceValidator validates the discovery of upstreams, against every registered discovery type
+	// until the running discoverers are set with SetDiscoveryReferenceValidator
+	discoveryReferenceValidator config.DiscoveryReferenceValidator
+}
+
+func NewAPIProvider(cfg config.ProviderConfig, logger *logger.Logger) (*APIProvider, error) {
+	for _, key := range []string{"address", "token", "tokenFile", "certFile", "keyFile"} {
+		if value, exists := cfg.Config[key]; exists {
+			if _, ok := value.(string); !ok {
+				return nil, fmt.Errorf("'%s' must be a string", key)
+			}
+		}
+	}
+	ap := &APIProvider{
+		config:  cfg,
+		logger:  logger.WithComponent("api_provider"),
+		updated: make(chan struct{}, 1),
+
+		discoveryReferenceValidator: manager.Registry.ValidateReference,
+	}
+	ap.address, _ = cfg.Config["address"].(string)
+	if ap.address == "" {
+		return nil, fmt.Errorf("missing 'address' configuration")
+	}
+
+	ap.token, _ = cfg.Config["token"].(string)
+	if tokenFile, ok := cfg.Config["tokenFile"].(string); ok {
+		if ap.token != "" {
+			return nil, fmt.Errorf("'token' and 'tokenFile' are mutually exclusive")
+		}
+		token, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file: %w", err)
+		}
+		ap.token = strings.TrimSpace(string(token))
+	}
+	if ap.token == "" {
+		return nil, fmt.Errorf("missing 'token' or 'tokenFile' configuration")
+	}
+
+	ap.certFile, _ = cfg.Config["certFile"].(string)
+	ap.keyFile, _ = cfg.Config["keyFile"].(string)
+	if (ap.certFile == "") != (ap.keyFile == "") {
+		return nil, fmt.Errorf("'certFile' and 'keyFile' must be set together")
+	}
+	return ap, nil
+}
+
+// SetDiscoveryReferenceValidator makes the changes referencing a discovery be validated with fn, like the
+// running discoverers.
+func (ap *APIProvider) SetDiscoveryReferenceValidator(fn config.DiscoveryReferenceValidator) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	ap.discoveryReferenceValidator = fn
+}
+
+// SetListeners makes the changes referencing a listener missing from listeners be rejected.
+func (ap *APIProvider) SetListeners(listeners []config.ListenerConfig) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+	ap.listeners = listeners
+}
+
+func (ap *APIProvider) Provide(ch chan<- config.Dynamic) {
+	go ap.forward(ch)
+
+	server := &http.Server{Addr: ap.address, Handler: ap.Handler()}
+	ap.logger.Infof("api provider listening on %s", ap.address)
+	var err error
+	if ap.certFile != "" {
+		err = server.ListenAndServeTLS(ap.certFile, ap.keyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	ap.logger.Errorf("api provider stopped: %v", err)
+}
+
+// forward sends the current configuration whenever it changes. Unlike file changes, API changes can't be read
+// again later, so they are never dropped: when the watcher lags behind, it gets the latest configuration.
+func (ap *APIProvider) forward(ch chan<- config.Dynamic) {
+	for range ap.updated {
+		ap.mu.Lock()
+		current := ap.current
+		ap.mu.Unlock()
+		ch <- current
+	}
+}
+
+// Handler returns the handler serving the API.
+func (ap *APIProvider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		ap.mu.Lock()
+		defer ap.mu.Unlock()
+		ap.respond(w, http.StatusOK, ap.current)
+	})
+	handleKind(ap, mux, "routes",
+		func(cfg *config.Dynamic) *[]config.RouteConfig { return &cfg.Routes },
+		func(route *config.RouteConfig) *string { return &route.Name })
+	handleKind(ap, mux, "upstreams",
+		func(cfg *config.Dynamic) *[]config.UpstreamConfig { return &cfg.Upstreams },
+		func(upstream *config.UpstreamConfig) *string { return &upstream.Name })
+	handleKind(ap, mux, "plugins",
+		func(cfg *config.Dynamic) *[]config.PluginConfig { return &cfg.Plugins },
+		func(plugin *config.PluginConfig) *string { return &plugin.Name })
+	return ap.authenticate(mux)
+}
+
+func (ap *APIProvider) authenticate(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + ap.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "invalid or missing token", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleKind registers the endpoints of a kind of object, whose list and name are returned by items and name.
+func handleKind[T any](ap *APIProvider, mux *http.ServeMux, kind string, items func(*config.Dynamic) *[]T, name func(*T) *string) {
+	find := func(cfg *config.Dynamic, objectName string) int {
+		for i := range *items(cfg) {
+			if *name(&(*items(cfg))[i]) == objectName {
+				return i
+			}
+		}
+		return -1
+	}
+
+	mux.HandleFunc("GET /"+kind, func(w http.ResponseWriter, r *http.Request) {
+		ap.mu.Lock()
+		defer ap.mu.Unlock()
+		list := *items(&ap.current)
+		if list == nil {
+			list = []T{}
+		}
+		ap.respond(w, http.StatusOK, list)
+	})
+
+	mux.HandleFunc("GET /"+kind+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		ap.mu.Lock()
+		defer ap.mu.Unlock()
+		i := find(&ap.current, r.PathValue("name"))
+		if i < 0 {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("%s %s not found", kind, r.PathValue("name")), nil)
+			return
+		}
+		ap.respond(w, http.StatusOK, (*items(&ap.current))[i])
+	})
+
+	mux.HandleFunc("PUT /"+kind+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var object T
+		if err := decodeBody(r, &object); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+		ap.update(w, r, func(cfg *config.Dynamic) (int, any, error) {
+			objectName := r.PathValue("name")
+			if err := setName(name(&object), objectName); err != nil {
+				return http.StatusBadRequest, nil, err
+			}
+			if i := find(cfg, objectName); i >= 0 {
+				(*items(cfg))[i] = object
+				return http.StatusOK, object, nil
+			}
+			*items(cfg) = append(*items(cfg), object)
+			return http.StatusCreated, object, nil
+		})
+	})
+
+	mux.HandleFunc("PATCH /"+kind+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		var patch map[string]any
+		if err := decodeBody(r, &patch); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+		ap.update(w, r, func(cfg *config.Dynamic) (int, any, error) {
+			objectName := r.PathValue("name")
+			i := find(cfg, objectName)
+			if i < 0 {
+				return http.StatusNotFound, nil, fmt.Errorf("%s %s not found", kind, objectName)
+			}
+			document, err := toMap((*items(cfg))[i])
+			if err != nil {
+				return http.StatusInternalServerError, nil, err
+			}
+			var object T
+			if err := fromMap(mergePatch(document, patch), &object); err != nil {
+				return http.StatusBadRequest, nil, err
+			}
+			if err := setName(name(&object), objectName); err != nil {
+				return http.StatusBadRequest, nil, err
+			}
+			(*items(cfg))[i] = object
+			return http.StatusOK, object, nil
+		})
+	})
+
+	mux.HandleFunc("DELETE /"+kind+"/{name}", func(w http.ResponseWriter, r *http.Request) {
+		ap.update(w, r, func(cfg *config.Dynamic) (int, any, error) {
+			objectName := r.PathValue("name")
+			i := find(cfg, objectName)
+			if i < 0 {
+				return http.StatusNotFound, nil, fmt.Errorf("%s %s not found", kind, objectName)
+			}
+			*items(cfg) = append((*items(cfg))[:i:i], (*items(cfg))[i+1:]...)
+			return http.StatusNoContent, nil, nil
+		})
+	})
+}
+
+// update applies the change to a copy of the configuration, and makes it the current one once validated.
+func (ap *APIProvider) update(w http.ResponseWriter, r *http.Request, change func(cfg *config.Dynamic) (int, any, error)) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" {
+		revision, err := strconv.ParseUint(strings.Trim(match, `"`), 10, 64)
+		if err != nil || revision != ap.revision {
+			ap.setRevision(w)
+			writeError(w, http.StatusPreconditionFailed, fmt.Sprintf("configuration is at revision %d", ap.revision), nil)
+			return
+		}
+	}
+
+	// Changes only replace the elements of the lists, which are copied
+	updated := config.Dynamic{
+		Routes:      append([]config.RouteConfig(nil), ap.current.Routes...),
+		Upstreams:   append([]config.UpstreamConfig(nil), ap.current.Upstreams...),
+		Plugins:     append([]config.PluginConfig(nil), ap.current.Plugins...),
+		StreamRoute: ap.current.StreamRoute,
+	}
+	status, object, err := change(&updated)
+	if err != nil {
+		writeError(w, status, err.Error(), nil)
+		return
+	}
+	validator := config.NewDynamicValidator()
+	if ap.listeners != nil {
+		validator.SetListeners(ap.listeners)
+	}
+	validator.SetPluginValidator(plugin.Registry.Validate)
+	validator.SetDiscoveryReferenceValidator(ap.discoveryReferenceValidator)
+	// Objects of other providers are only known once the configurations are merged
+	validator.AllowExternalReferences()
+	if err := validator.Validate(&updated); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, "invalid configuration", validator.GetErrors())
+		return
+	}
+
+	ap.current = updated
+	ap.revision++
+	ap.logger.Infof("api provider %s %s, now at revision %d", r.Method, r.URL.Path, ap.revision)
+	select {
+	case ap.updated <- struct{}{}:
+	default:
+	}
+	if object == nil {
+		ap.setRevision(w)
+		w.WriteHeader(status)
+		return
+	}
+	ap.respond(w, status, object)
+}
+
+func (ap *APIProvider) setRevision(w http.ResponseWriter) {
+	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, ap.revision))
+}
+
+// respond writes the object as JSON, with the field names of the configuration files.
+func (ap *APIProvider) respond(w http.ResponseWriter, status int, object any) {
+	ap.setRevision(w)
+	document, err := toDocument(object)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error(), nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(document)
+}
+
+func writeError(w http.ResponseWriter, status int, message string, errors []config.ValidationError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Error  string                   `json:"error"`
+		Errors []config.ValidationError `json:"errors,omitempty"`
+	}{message, errors})
+}
+
+func setName(field *string, name string) error {
+	// Qualified names are reserved for references to the objects of other providers
+	if strings.Contains(name, "@") {
+		return fmt.Errorf("name %s cannot contain '@'", name)
+	}
+	if *field != "" && *field != name {
+		return fmt.Errorf("name %s doesn't match %s in the path", *field, name)
+	}
+	*field = name
+	return nil
+}
+
+// decodeBody decodes a JSON or YAML body, rejecting unknown fields.
+func decodeBody(r *http.Request, v any) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read body: %v", err)
+	}
+	if len(body) > maxBodySize {
+		return fmt.Errorf("body larger than %d bytes", maxBodySize)
+	}
+	// YAML being a superset of JSON, both are decoded the same way, with unknown fields rejected
+	decoder := yaml.NewDecoder(bytes.NewReader(body))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(v); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("empty body")
+		}
+		return fmt.Errorf("invalid body: %v", err)
+	}
+	return nil
+}
+
+// toMap returns the object as a document with the field names of the configuration files.
+func toMap(object any) (map[string]any, error) {
+	document, err := toDocument(object)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := document.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%T isn't an object", object)
+	}
+	return m, nil
+}
+
+func fromMap(document map[string]any, object any) error {
+	content, err := yaml.Marshal(document)
+	if err != nil {
+		return err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(object); err != nil {
+		return fmt.Errorf("invalid patch: %v", err)
+	}
+	return nil
+}
+
+// toDocument converts the object to maps and lists, keyed by the field names of the configuration files.
+func toDocument(object any) (any, error) {
+	content, err := yaml.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	var document any
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// mergePatch applies a JSON merge patch, null values removing fields.
+func mergePatch(target, patch map[string]any) map[string]any {
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		if patchMap, ok := value.(map[string]any); ok {
+			targetMap, _ := target[key].(map[string]any)
+			if targetMap == nil {
+				targetMap = make(map[string]any)
+			}
+			target[key] = mergePatch(targetMap, patchMap)
+			continue
+		}
+		target[key] = value
+	}
+	return target
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+)
+
+func newTestAPI(t *testing.T) (*APIProvider, http.Handler, chan config.Dynamic) {
+	t.Helper()
+	ap, err := NewAPIProvider(config.ProviderConfig{Name: "api", Type: "api", Config: map[string]any{
+		"address": "127.0.0.1:0",
+		"token":   "secret",
+	}}, logger.New(logger.LevelInfo))
+	if err != nil {
+		t.Fatalf("Failed to create api provider: %v", err)
+	}
+	ch := make(chan config.Dynamic, 10)
+	go ap.forward(ch)
+	return ap, ap.Handler(), ch
+}
+
+func do(handler http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAPIProvider(t *testing.T) {
+	_, handler, ch := newTestAPI(t)
+
+	rec := do(handler, http.MethodPut, "/upstreams/backend", `{"nodes": [{"url": "http://127.0.0.1:9090"}]}`)
+	if rec.Code != http.StatusCreated || rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("Expected upstream to be created at revision 1, got %d %s: %s", rec.Code, rec.Header().Get("ETag"), rec.Body)
+	}
+	cfg := <-ch
+	if len(cfg.Upstreams) != 1 || cfg.Upstreams[0].Name != "backend" {
+		t.Errorf("Expected upstream sent to the watcher, got %+v", cfg)
+	}
+
+	rec = do(handler, http.MethodPut, "/routes/web", "listener: http\nmatches:\n  - path: /\nupstream:\n  name: backend\n")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Expected YAML route to be created, got %d: %s", rec.Code, rec.Body)
+	}
+	<-ch
+
+	// Invalid changes are rejected with the validation errors
+	rec = do(handler, http.MethodPatch, "/routes/web", `{"matches": [{"path": "no-slash"}]}`)
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "path must start with '/'") {
+		t.Errorf("Expected validation failure, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = do(handler, http.MethodPut, "/routes/web", `{"unknown": true}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown field to be rejected, got %d: %s", rec.Code, rec.Body)
+	}
+
+	// Stale revisions are rejected
+	rec = do(handler, http.MethodPatch, "/routes/web", `{"matches": [{"path": "/api"}]}`, "If-Match", `"1"`)
+	if rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected stale revision to be rejected, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = do(handler, http.MethodPatch, "/routes/web", `{"matches": [{"path": "/api"}]}`, "If-Match", `"2"`)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"3"` {
+		t.Fatalf("Expected patch at current revision to succeed, got %d: %s", rec.Code, rec.Body)
+	}
+	var route map[string]any
+	json.Unmarshal(rec.Body.Bytes(), &route)
+	if route["listener"] != "http" || route["upstream"] == nil {
+		t.Errorf("Expected merge patch to keep the other fields, got %v", route)
+	}
+	cfg = <-ch
+	if cfg.Routes[0].Matches[0].Path != "/api" || cfg.Routes[0].Upstream.Name != "backend" {
+		t.Errorf("Expected patched route sent to the watcher, got %+v", cfg.Routes[0])
+	}
+
+	rec = do(handler, http.MethodDelete, "/routes/web", "")
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected route to be deleted, got %d: %s", rec.Code, rec.Body)
+	}
+	if cfg := <-ch; len(cfg.Routes) != 0 {
+		t.Errorf("Expected route removed from the config, got %+v", cfg.Routes)
+	}
+	if rec := do(handler, http.MethodGet, "/routes/web", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected deleted route to be gone, got %d", rec.Code)
+	}
+}
+
+func TestAPIProviderAuthentication(t *testing.T) {
+	_, handler, _ := newTestAPI(t)
+	req := httptest.NewRequest(http.MethodGet, "/config", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected wrong token to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestAPIProviderPutNameMismatch(t *testing.T) {
+	_, handler, _ := newTestAPI(t)
+	rec := do(handler, http.MethodPut, "/plugins/cache", `{"name": "other", "type": "responsecache"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected mismatching name to be rejected, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	target := map[string]any{"a": "1", "b": map[string]any{"c": "2", "d": "3"}}
+	patched := mergePatch(target, map[string]any{"a": nil, "b": map[string]any{"c": "4"}, "e": "5"})
+	b := patched["b"].(map[string]any)
+	if _, exists := patched["a"]; exists || b["c"] != "4" || b["d"] != "3" || patched["e"] != "5" {
+		t.Errorf("Unexpected merge patch result %v", patched)
+	}
+}
+
+func TestAPIProviderDoesNotBlockOnWatcher(t *testing.T) {
+	ap, err := NewAPIProvider(config.ProviderConfig{Name: "api", Type: "api", Config: map[string]any{
+		"address": "127.0.0.1:0",
+		"token":   "secret",
+	}}, logger.New(logger.LevelInfo))
+	if err != nil {
+		t.Fatalf("Failed to create api provider: %v", err)
+	}
+	ch := make(chan config.Dynamic)
+	go ap.forward(ch)
+	handler := ap.Handler()
+
+	// The watcher doesn't read while the changes are made
+	for _, name := range []string{"a", "b", "c"} {
+		if rec := do(handler, http.MethodPut, "/upstreams/"+name, `{"nodes": [{"url": "http://127.0.0.1:9090"}]}`); rec.Code != http.StatusCreated {
+			t.Fatalf("Expected upstream %s to be created, got %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+	if rec := do(handler, http.MethodGet, "/config", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected config to be readable, got %d", rec.Code)
+	}
+
+	// Changes the watcher missed are coalesced into the latest config
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case cfg := <-ch:
+			if len(cfg.Upstreams) == 3 {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for the latest config")
+		}
+	}
+}
+
+func TestAPIProviderValidatesRegisteredTypes(t *testing.T) {
+	_, handler, _ := newTestAPI(t)
+
+	rec := do(handler, http.MethodPut, "/plugins/auth", `{"type": "unknown"}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected unknown plugin type to be rejected, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = do(handler, http.MethodPut, "/upstreams/web", `{"service": "web", "discovery": {"type": "unknown"}}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected unknown discovery type to be rejected, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAPIProviderValidatesRunningDiscovery(t *testing.T) {
+	ap, handler, _ := newTestAPI(t)
+	ap.SetDiscoveryReferenceValidator(func(typ, service string, params map[string]string) error {
+		if typ != "dns" {
+			return fmt.Errorf("discovery %s is not configured", typ)
+		}
+		return nil
+	})
+
+	rec := do(handler, http.MethodPut, "/upstreams/web", `{"service": "web", "discovery": {"type": "kubernetes", "params": {"namespace": "default"}}}`)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("Expected discovery which isn't running to be rejected, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = do(handler, http.MethodPut, "/upstreams/web", `{"service": "web", "discovery": {"type": "dns"}}`)
+	if rec.Code != http.StatusCreated && rec.Code != http.StatusOK {
+		t.Errorf("Expected running discovery to be accepted, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAPIProviderValidatesListeners(t *testing.T) {
+	ap, handler, _ := newTestAPI(t)
+	ap.SetListeners([]config.ListenerConfig{{Name: "http", Port: 8080}})
+
+	route := `{"listener": "%s", "matches": [{"path": "/"}], "upstream": {"name": "backend@file"}}`
+	rec := do(handler, http.MethodPut, "/routes/web", fmt.Sprintf(route, "unknown"))
+	if rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "listener 'unknown' is not defined") {
+		t.Errorf("Expected route on an unknown listener to be rejected, got %d: %s", rec.Code, rec.Body)
+	}
+	rec = do(handler, http.MethodPut, "/routes/web", fmt.Sprintf(route, "http"))
+	if rec.Code != http.StatusCreated && rec.Code != http.StatusOK {
+		t.Errorf("Expected route on a static listener to be accepted, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,401 @@
+package docker
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	dockerdiscovery "github.com/Revolyssup/arp/pkg/discovery/docker"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/filters"
+	"github.com/moby/moby/client"
+)
+
+const (
+	DefaultLabelPrefix       = "arp"
+	DefaultReconnectInterval = 5 * time.Second
+
+	// composeServiceLabel names the upstream of containers started by Docker Compose
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// Container labels, relative to the label prefix, that describe the routes and upstream of a container.
+//
+// Routes are described with <prefix>.routes.<route>.<field> labels, the fields being listener, path, method,
+// headers.<header>, plugins (a comma separated list of plugin names) and upstream (defaulting to the upstream
+// of the container). Upstreams are described with <prefix>.upstream.<field> labels, the fields being name,
+// type, port, scheme, network, weight, zone and priority. Every running container of an upstream is one of
+// its nodes, the upstream being named after the Compose service or the container when name isn't set.
+const (
+	LabelRoutes   = "routes"
+	LabelUpstream = "upstream"
+)
+
+// DockerProvider builds the dynamic configuration from the labels of the running containers, rebuilding it
+// whenever a container starts, stops or changes health. Containers are only considered once they have a
+// route or an upstream name label, and while their health check, if any, passes.
+type DockerProvider struct {
+	config            config.ProviderConfig
+	logger            *logger.Logger
+	cli               *client.Client
+	network           string
+	labelPrefix       string
+	listener          string
+	reconnectInterval time.Duration
+	lastHash          string
+}
+
+func NewDockerProvider(cfg config.ProviderConfig, logger *logger.Logger) (*DockerProvider, error) {
+	for _, key := range []string{"host", "network", "labelPrefix", "listener", "reconnectInterval"} {
+		if value, exists := cfg.Config[key]; exists {
+			if _, ok := value.(string); !ok {
+				return nil, fmt.Errorf("'%s' must be a string", key)
+			}
+		}
+	}
+	dp := &DockerProvider{
+		config:            cfg,
+		logger:            logger.WithComponent("docker_provider"),
+		labelPrefix:       DefaultLabelPrefix,
+		reconnectInterval: DefaultReconnectInterval,
+	}
+	if network, ok := cfg.Config["network"].(string); ok {
+		dp.network = network
+	}
+	if prefix, ok := cfg.Config["labelPrefix"].(string); ok && prefix != "" {
+		dp.labelPrefix = prefix
+	}
+	if listener, ok := cfg.Config["listener"].(string); ok {
+		dp.listener = listener
+	}
+	if interval, ok := cfg.Config["reconnectInterval"].(string); ok {
+		dur, err := time.ParseDuration(interval)
+		if err != nil || dur <= 0 {
+			return nil, fmt.Errorf("invalid reconnectInterval %s", interval)
+		}
+		dp.reconnectInterval = dur
+	}
+
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if host, ok := cfg.Config["host"].(string); ok && host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %v", err)
+	}
+	dp.cli = cli
+	return dp, nil
+}
+
+func (dp *DockerProvider) Provide(ch chan<- config.Dynamic) {
+	defer dp.cli.Close()
+	ctx := context.Background()
+	if err := dp.refreshAndSendConfig(ctx, ch); err != nil {
+		dp.logger.Errorf("Failed to read initial config: %v", err)
+	}
+
+	dp.logger.Debugf("docker provider watching containers with %s labels", dp.labelPrefix)
+
+	for {
+		err := dp.watchEvents(ctx, ch)
+		dp.logger.Errorf("Docker event stream failed, reconnecting in %s: %v", dp.reconnectInterval, err)
+		time.Sleep(dp.reconnectInterval)
+		// Events may have been missed while disconnected
+		if err := dp.refreshAndSendConfig(ctx, ch); err != nil {
+			dp.logger.Errorf("Failed to read config: %v", err)
+		}
+	}
+}
+
+// watchEvents rebuilds the config on every container event until the stream fails.
+func (dp *DockerProvider) watchEvents(ctx context.Context, ch chan<- config.Dynamic) error {
+	messages, errs := dp.cli.Events(ctx, client.EventsListOptions{
+		Filters: filters.NewArgs(filters.Arg("type", "container")),
+	})
+	for {
+		select {
+		case msg := <-messages:
+			dp.logger.Debugf("Docker event %s for container %s", msg.Action, msg.Actor.ID)
+			if err := dp.refreshAndSendConfig(ctx, ch); err != nil {
+				dp.logger.Errorf("Failed to read config: %v", err)
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+func (dp *DockerProvider) refreshAndSendConfig(ctx context.Context, ch chan<- config.Dynamic) error {
+	containers, err := dp.cli.ContainerList(ctx, client.ContainerListOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+	dynamicConfig := dp.buildConfig(containers)
+
+	content, err := json.Marshal(dynamicConfig)
+	if err != nil {
+		return err
+	}
+	contentHash := fmt.Sprintf("%x", md5.Sum(content))
+	if contentHash == dp.lastHash {
+		// Config hasn't changed
+		return nil
+	}
+
+	select {
+	case ch <- dynamicConfig:
+	default:
+		dp.logger.Warnf("Warning: Config channel is full, dropping update")
+	}
+
+	dp.lastHash = contentHash
+	dp.logger.Infof("docker provider sent updated configuration")
+	return nil
+}
+
+// containerObjects are the routes and upstream described by the labels of a container.
+type containerObjects struct {
+	name     string
+	routes   []config.RouteConfig
+	upstream config.UpstreamConfig
+}
+
+// buildConfig builds the routes and upstreams of the running containers. Containers are validated one by one,
+// invalid ones being skipped so that they don't invalidate the whole configuration. Containers are processed by
+// name, so that when replicas define the same route or upstream differently, the first one wins.
+func (dp *DockerProvider) buildConfig(containers []container.Summary) config.Dynamic {
+	sort.Slice(containers, func(i, j int) bool { return containerName(containers[i]) < containerName(containers[j]) })
+
+	// Objects of other providers are only known once the configurations are merged
+	validator := config.NewDynamicValidator()
+	validator.AllowExternalReferences()
+
+	var candidates []containerObjects
+	var knownUpstreams []config.UpstreamConfig
+	known := make(map[string]bool)
+	for _, c := range containers {
+		if c.State != container.StateRunning || (c.Health != nil && c.Health.Status != container.Healthy && c.Health.Status != container.NoHealthcheck) {
+			continue
+		}
+		routeConfigs, upstreamConfig, err := dp.containerConfig(c)
+		if err != nil {
+			dp.logger.Warnf("Skipping container %s: %v", containerName(c), err)
+			continue
+		}
+		if upstreamConfig == nil {
+			continue
+		}
+		if err := validator.Validate(&config.Dynamic{Upstreams: []config.UpstreamConfig{*upstreamConfig}}); err != nil {
+			dp.logger.Warnf("Skipping container %s: %v", containerName(c), err)
+			continue
+		}
+		candidates = append(candidates, containerObjects{name: containerName(c), routes: routeConfigs, upstream: *upstreamConfig})
+		if !known[upstreamConfig.Name] {
+			known[upstreamConfig.Name] = true
+			knownUpstreams = append(knownUpstreams, *upstreamConfig)
+		}
+	}
+
+	var dynamicConfig config.Dynamic
+	upstreams := make(map[string]int)
+	upstreamOwners := make(map[string]string)
+	routes := make(map[string]int)
+	routeOwners := make(map[string]string)
+	for _, objects := range candidates {
+		// Routes can reference the upstreams of other containers
+		if err := validator.Validate(&config.Dynamic{Routes: objects.routes, Upstreams: knownUpstreams}); err != nil {
+			dp.logger.Warnf("Skipping container %s: %v", objects.name, err)
+			continue
+		}
+
+		upstreamConfig := objects.upstream
+		if i, exists := upstreams[upstreamConfig.Name]; exists {
+			if !sameUpstreamSettings(dynamicConfig.Upstreams[i], upstreamConfig) {
+				dp.logger.Warnf("Ignoring upstream settings of container %s conflicting with the ones of container %s for upstream %s",
+					objects.name, upstreamOwners[upstreamConfig.Name], upstreamConfig.Name)
+			}
+			dynamicConfig.Upstreams[i].Nodes = append(dynamicConfig.Upstreams[i].Nodes, upstreamConfig.Nodes...)
+		} else {
+			upstreams[upstreamConfig.Name] = len(dynamicConfig.Upstreams)
+			upstreamOwners[upstreamConfig.Name] = objects.name
+			dynamicConfig.Upstreams = append(dynamicConfig.Upstreams, upstreamConfig)
+		}
+
+		for _, route := range objects.routes {
+			if i, exists := routes[route.Name]; exists {
+				// Replicas usually define the same routes
+				if !reflect.DeepEqual(dynamicConfig.Routes[i], route) {
+					dp.logger.Warnf("Ignoring route %s of container %s conflicting with the one of container %s",
+						route.Name, objects.name, routeOwners[route.Name])
+				}
+				continue
+			}
+			routes[route.Name] = len(dynamicConfig.Routes)
+			routeOwners[route.Name] = objects.name
+			dynamicConfig.Routes = append(dynamicConfig.Routes, route)
+		}
+	}
+
+	for _, upstream := range dynamicConfig.Upstreams {
+		sort.Slice(upstream.Nodes, func(i, j int) bool { return upstream.Nodes[i].URL < upstream.Nodes[j].URL })
+	}
+	// Routes of a container come from a map
+	sort.Slice(dynamicConfig.Routes, func(i, j int) bool { return dynamicConfig.Routes[i].Name < dynamicConfig.Routes[j].Name })
+	return dynamicConfig
+}
+
+// sameUpstreamSettings reports whether the upstreams only differ by their nodes.
+func sameUpstreamSettings(a, b config.UpstreamConfig) bool {
+	a.Nodes, b.Nodes = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// containerConfig returns the routes of the container and its upstream with the container as only node,
+// or a nil upstream when the container has no route nor upstream name label.
+func (dp *DockerProvider) containerConfig(c container.Summary) ([]config.RouteConfig, *config.UpstreamConfig, error) {
+	routeFields := make(map[string]map[string]string)
+	routesPrefix := dp.label(LabelRoutes) + "."
+	for key, value := range c.Labels {
+		rest, ok := strings.CutPrefix(key, routesPrefix)
+		if !ok {
+			continue
+		}
+		name, field, ok := strings.Cut(rest, ".")
+		if !ok || name == "" {
+			return nil, nil, fmt.Errorf("invalid label %s, expected %s<route>.<field>", key, routesPrefix)
+		}
+		if routeFields[name] == nil {
+			routeFields[name] = make(map[string]string)
+		}
+		routeFields[name][field] = value
+	}
+	upstreamName := c.Labels[dp.upstreamLabel("name")]
+	if len(routeFields) == 0 && upstreamName == "" {
+		return nil, nil, nil
+	}
+
+	if upstreamName == "" {
+		upstreamName = c.Labels[composeServiceLabel]
+	}
+	if upstreamName == "" {
+		upstreamName = containerName(c)
+	}
+	node, err := dp.containerNode(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	upstreamConfig := &config.UpstreamConfig{
+		Name:  upstreamName,
+		Type:  c.Labels[dp.upstreamLabel("type")],
+		Nodes: []config.Node{node},
+	}
+
+	routeConfigs := make([]config.RouteConfig, 0, len(routeFields))
+	for name, fields := range routeFields {
+		route, err := dp.routeConfig(name, fields, upstreamName)
+		if err != nil {
+			return nil, nil, err
+		}
+		routeConfigs = append(routeConfigs, route)
+	}
+	return routeConfigs, upstreamConfig, nil
+}
+
+func (dp *DockerProvider) routeConfig(name string, fields map[string]string, upstreamName string) (config.RouteConfig, error) {
+	route := config.RouteConfig{
+		Name:     name,
+		Listener: dp.listener,
+		Upstream: &config.UpstreamConfig{Name: upstreamName},
+	}
+	var match config.Match
+	for field, value := range fields {
+		switch field {
+		case "listener":
+			route.Listener = value
+		case "path":
+			match.Path = value
+		case "method":
+			match.Method = value
+		case "upstream":
+			route.Upstream.Name = value
+		case "plugins":
+			for _, plugin := range strings.Split(value, ",") {
+				if plugin = strings.TrimSpace(plugin); plugin != "" {
+					route.Plugins = append(route.Plugins, config.PluginConfig{Name: plugin})
+				}
+			}
+		default:
+			header, ok := strings.CutPrefix(field, "headers.")
+			if !ok || header == "" {
+				return route, fmt.Errorf("unknown field %s of route %s", field, name)
+			}
+			if match.Headers == nil {
+				match.Headers = make(map[string]string)
+			}
+			match.Headers[header] = value
+		}
+	}
+	route.Matches = []config.Match{match}
+	return route, nil
+}
+
+func (dp *DockerProvider) containerNode(c container.Summary) (config.Node, error) {
+	labels := c.Labels
+	network := labels[dp.upstreamLabel("network")]
+	if network == "" {
+		network = dp.network
+	}
+	ip, err := dockerdiscovery.ContainerIP(c, network)
+	if err != nil {
+		return config.Node{}, err
+	}
+	port, err := dockerdiscovery.ContainerPort(c, labels[dp.upstreamLabel("port")])
+	if err != nil {
+		return config.Node{}, err
+	}
+	scheme := "http"
+	if s := labels[dp.upstreamLabel("scheme")]; s != "" {
+		scheme = s
+	}
+
+	node := config.Node{
+		URL:  (&url.URL{Scheme: scheme, Host: ip + ":" + port}).String(),
+		Zone: labels[dp.upstreamLabel("zone")],
+	}
+	if w := labels[dp.upstreamLabel("weight")]; w != "" {
+		if node.Weight, err = strconv.Atoi(w); err != nil {
+			return config.Node{}, fmt.Errorf("invalid %s label %q: %v", dp.upstreamLabel("weight"), w, err)
+		}
+	}
+	if p := labels[dp.upstreamLabel("priority")]; p != "" {
+		if node.Priority, err = strconv.Atoi(p); err != nil {
+			return config.Node{}, fmt.Errorf("invalid %s label %q: %v", dp.upstreamLabel("priority"), p, err)
+		}
+	}
+	return node, nil
+}
+
+func (dp *DockerProvider) label(name string) string {
+	return dp.labelPrefix + "." + name
+}
+
+func (dp *DockerProvider) upstreamLabel(field string) string {
+	return dp.label(LabelUpstream) + "." + field
+}
+
+func containerName(c container.Summary) string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
+	}
+	return c.ID
+}
@@ -0,0 +1,179 @@
+package docker
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/events"
+	"github.com/moby/moby/api/types/network"
+)
+
+// fakeDocker implements the parts of the Docker Engine API used by the provider.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []container.Summary
+	events     chan events.Message
+}
+
+func newFakeDocker(t *testing.T) (*fakeDocker, string) {
+	t.Helper()
+	fake := &fakeDocker{events: make(chan events.Message, 10)}
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socket, err)
+	}
+	server := &http.Server{Handler: fake}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return fake, "unix://" + socket
+}
+
+func (f *fakeDocker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/_ping"):
+		w.Header().Set("Api-Version", "1.52")
+		w.Write([]byte("OK"))
+	case strings.HasSuffix(r.URL.Path, "/containers/json"):
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		json.NewEncoder(w).Encode(f.containers)
+	case strings.HasSuffix(r.URL.Path, "/events"):
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case msg := <-f.events:
+				json.NewEncoder(w).Encode(msg)
+				w.(http.Flusher).Flush()
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeDocker) setContainers(containers ...container.Summary) {
+	f.mu.Lock()
+	f.containers = containers
+	f.mu.Unlock()
+	f.events <- events.Message{Type: events.ContainerEventType, Action: events.ActionStart}
+}
+
+func newContainer(name, ip string, labels map[string]string) container.Summary {
+	return container.Summary{
+		ID:     name,
+		Names:  []string{"/" + name},
+		State:  container.StateRunning,
+		Labels: labels,
+		Ports:  []container.PortSummary{{PrivatePort: 8080}},
+		NetworkSettings: &container.NetworkSettingsSummary{
+			Networks: map[string]*network.EndpointSettings{"backend": {IPAddress: ip}},
+		},
+	}
+}
+
+func expectConfig(t *testing.T, ch <-chan config.Dynamic, check func(config.Dynamic) bool) config.Dynamic {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case cfg := <-ch:
+			if check(cfg) {
+				return cfg
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for expected config")
+			return config.Dynamic{}
+		}
+	}
+}
+
+func TestDockerProvider(t *testing.T) {
+	fake, host := newFakeDocker(t)
+	labels := map[string]string{
+		"com.docker.compose.service":    "web",
+		"arp.routes.api.path":           "/api",
+		"arp.routes.api.method":         "GET",
+		"arp.routes.api.headers.X-Team": "payments",
+		"arp.routes.api.plugins":        "cache@file, auth@file",
+		"arp.routes.admin.path":         "/admin",
+		"arp.routes.admin.listener":     "internal",
+		"arp.upstream.weight":           "2",
+		"arp.upstream.type":             "roundrobin",
+	}
+	fake.setContainers(
+		newContainer("web-1", "10.0.0.1", labels),
+		newContainer("web-2", "10.0.0.2", labels),
+		newContainer("unrelated", "10.0.0.3", map[string]string{"other": "label"}),
+	)
+
+	dp, err := NewDockerProvider(config.ProviderConfig{Name: "docker", Type: "docker", Config: map[string]any{
+		"host":     host,
+		"listener": "http",
+	}}, logger.New(logger.LevelInfo))
+	if err != nil {
+		t.Fatalf("Failed to create docker provider: %v", err)
+	}
+	ch := make(chan config.Dynamic, 10)
+	go dp.Provide(ch)
+
+	cfg := expectConfig(t, ch, func(cfg config.Dynamic) bool { return len(cfg.Routes) == 2 })
+	admin, api := cfg.Routes[0], cfg.Routes[1]
+	if admin.Name != "admin" || admin.Listener != "internal" || admin.Matches[0].Path != "/admin" {
+		t.Errorf("Unexpected admin route %+v", admin)
+	}
+	if api.Listener != "http" || api.Upstream.Name != "web" || api.Matches[0].Method != "GET" || api.Matches[0].Headers["X-Team"] != "payments" {
+		t.Errorf("Unexpected api route %+v", api)
+	}
+	if len(api.Plugins) != 2 || api.Plugins[0].Name != "cache@file" || api.Plugins[1].Name != "auth@file" {
+		t.Errorf("Expected plugin references, got %+v", api.Plugins)
+	}
+	if len(cfg.Upstreams) != 1 || len(cfg.Upstreams[0].Nodes) != 2 || cfg.Upstreams[0].Type != "roundrobin" {
+		t.Fatalf("Expected one upstream with a node per replica, got %+v", cfg.Upstreams)
+	}
+	if node := cfg.Upstreams[0].Nodes[0]; node.URL != "http://10.0.0.1:8080" || node.Weight != 2 {
+		t.Errorf("Unexpected node %+v", node)
+	}
+
+	// Stopped and unhealthy containers are removed
+	stopped := newContainer("web-2", "10.0.0.2", labels)
+	stopped.State = container.StateExited
+	unhealthy := newContainer("web-1", "10.0.0.1", labels)
+	unhealthy.Health = &container.HealthSummary{Status: container.Unhealthy}
+	fake.setContainers(unhealthy, stopped)
+	expectConfig(t, ch, func(cfg config.Dynamic) bool { return len(cfg.Routes) == 0 && len(cfg.Upstreams) == 0 })
+}
+
+func TestBuildConfigInvalidLabels(t *testing.T) {
+	dp := &DockerProvider{labelPrefix: DefaultLabelPrefix, listener: "http", logger: logger.New(logger.LevelInfo)}
+	cfg := dp.buildConfig([]container.Summary{
+		newContainer("a", "10.0.0.1", map[string]string{"arp.routes.web.unknown": "x"}),
+		newContainer("b", "10.0.0.2", map[string]string{"arp.routes.web.path": "/", "arp.upstream.weight": "heavy"}),
+		newContainer("c", "10.0.0.3", map[string]string{"arp.routes.web.path": "/c", "arp.upstream.name": "c"}),
+		newContainer("d", "10.0.0.4", map[string]string{"arp.routes.web.path": "/d", "arp.upstream.name": "c"}),
+		// Invalid route and upstream configs
+		newContainer("e", "10.0.0.5", map[string]string{"arp.routes.other.path": "other", "arp.upstream.name": "c"}),
+		newContainer("f", "10.0.0.6", map[string]string{"arp.upstream.name": "c", "arp.upstream.weight": "-1"}),
+		newContainer("g", "10.0.0.7", map[string]string{"arp.routes.other.path": "/g", "arp.routes.other.plugins": "cache"}),
+		// Conflicting upstream settings are ignored, the replica still being a node
+		newContainer("h", "10.0.0.8", map[string]string{"arp.upstream.name": "c", "arp.upstream.type": "roundrobin"}),
+	})
+	if len(cfg.Routes) != 1 || cfg.Routes[0].Matches[0].Path != "/c" {
+		t.Errorf("Expected invalid containers skipped and the first conflicting route kept, got %+v", cfg.Routes)
+	}
+	if len(cfg.Upstreams) != 1 || len(cfg.Upstreams[0].Nodes) != 3 || cfg.Upstreams[0].Type != "" {
+		t.Errorf("Expected nodes of the valid containers with the settings of the first one, got %+v", cfg.Upstreams)
+	}
+}
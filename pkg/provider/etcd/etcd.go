@@ -0,0 +1,281 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultPrefix            = "/arp"
+	DefaultDialTimeout       = 5 * time.Second
+	DefaultReconnectInterval = 5 * time.Second
+)
+
+// Kinds of objects, each stored under <prefix>/<kind>/<name>
+const (
+	KindRoutes       = "routes"
+	KindUpstreams    = "upstreams"
+	KindPlugins      = "plugins"
+	KindStreamRoutes = "streamRoutes"
+)
+
+// EtcdProvider reads the dynamic configuration from the keys under a prefix, each key holding one object as
+// YAML or JSON, like /arp/routes/web. The name of an object is the last segment of its key. After the initial
+// read, the keys are watched and the configuration is rebuilt from the changed objects only. Invalid values are
+// ignored, the object keeping its last valid value.
+type EtcdProvider struct {
+	config            config.ProviderConfig
+	logger            *logger.Logger
+	client            client
+	prefix            string
+	reconnectInterval time.Duration
+
+	// objects holds the current objects by kind and name
+	objects  map[string]map[string]any
+	revision int64
+}
+
+// client is the part of the etcd client used by the provider.
+type client interface {
+	clientv3.KV
+	clientv3.Watcher
+}
+
+func NewEtcdProvider(cfg config.ProviderConfig, logger *logger.Logger) (*EtcdProvider, error) {
+	var endpoints []string
+	switch value := cfg.Config["endpoints"].(type) {
+	case string:
+		endpoints = strings.Split(value, ",")
+	case []any:
+		for _, endpoint := range value {
+			str, ok := endpoint.(string)
+			if !ok {
+				return nil, fmt.Errorf("'endpoints' must be a list of strings")
+			}
+			endpoints = append(endpoints, str)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("missing 'endpoints' configuration")
+	}
+	for _, key := range []string{"prefix", "username", "password", "dialTimeout", "reconnectInterval"} {
+		if value, exists := cfg.Config[key]; exists {
+			if _, ok := value.(string); !ok {
+				return nil, fmt.Errorf("'%s' must be a string", key)
+			}
+		}
+	}
+
+	ep := &EtcdProvider{
+		config:            cfg,
+		logger:            logger.WithComponent("etcd_provider"),
+		prefix:            DefaultPrefix,
+		reconnectInterval: DefaultReconnectInterval,
+	}
+	if prefix, ok := cfg.Config["prefix"].(string); ok && prefix != "" {
+		ep.prefix = strings.TrimSuffix(prefix, "/")
+	}
+	dialTimeout := DefaultDialTimeout
+	for key, dur := range map[string]*time.Duration{"dialTimeout": &dialTimeout, "reconnectInterval": &ep.reconnectInterval} {
+		if value, ok := cfg.Config[key].(string); ok {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid %s %s", key, value)
+			}
+			*dur = parsed
+		}
+	}
+
+	clientConfig := clientv3.Config{Endpoints: endpoints, DialTimeout: dialTimeout}
+	clientConfig.Username, _ = cfg.Config["username"].(string)
+	clientConfig.Password, _ = cfg.Config["password"].(string)
+	etcdClient, err := clientv3.New(clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd client: %v", err)
+	}
+	ep.client = etcdClient
+	return ep, nil
+}
+
+func (ep *EtcdProvider) Provide(ch chan<- config.Dynamic) {
+	defer ep.client.Close()
+	ctx := context.Background()
+
+	ep.logger.Debugf("etcd provider watching prefix %s", ep.prefix)
+
+	for {
+		if err := ep.load(ctx, ch); err != nil {
+			ep.logger.Errorf("Failed to read config, retrying in %s: %v", ep.reconnectInterval, err)
+			time.Sleep(ep.reconnectInterval)
+			continue
+		}
+		err := ep.watch(ctx, ch)
+		if errors.Is(err, rpctypes.ErrCompacted) {
+			// The changes since the last revision are gone, read everything again
+			ep.logger.Warnf("Watch revision %d was compacted, reading config again", ep.revision+1)
+			continue
+		}
+		ep.logger.Errorf("etcd watch failed, reconnecting in %s: %v", ep.reconnectInterval, err)
+		time.Sleep(ep.reconnectInterval)
+	}
+}
+
+// load reads every object under the prefix, and sends the resulting config.
+func (ep *EtcdProvider) load(ctx context.Context, ch chan<- config.Dynamic) error {
+	resp, err := ep.client.Get(ctx, ep.prefix+"/", clientv3.WithPrefix())
+	if err != nil {
+		return err
+	}
+	previous := ep.objects
+	ep.objects = make(map[string]map[string]any)
+	for _, kv := range resp.Kvs {
+		ep.put(string(kv.Key), kv.Value, previous)
+	}
+	ep.revision = resp.Header.Revision
+	ep.send(ch)
+	return nil
+}
+
+// watch applies the changes made after the loaded revision until the watch fails.
+func (ep *EtcdProvider) watch(ctx context.Context, ch chan<- config.Dynamic) error {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer cancel()
+	watchChan := ep.client.Watch(ctx, ep.prefix+"/", clientv3.WithPrefix(), clientv3.WithRev(ep.revision+1))
+	for resp := range watchChan {
+		if err := resp.Err(); err != nil {
+			return err
+		}
+		for _, event := range resp.Events {
+			key := string(event.Kv.Key)
+			switch event.Type {
+			case mvccpb.PUT:
+				ep.put(key, event.Kv.Value, ep.objects)
+			case mvccpb.DELETE:
+				if kind, name, ok := ep.parseKey(key); ok {
+					delete(ep.objects[kind], name)
+				}
+			}
+		}
+		ep.revision = resp.Header.Revision
+		if len(resp.Events) > 0 {
+			ep.send(ch)
+		}
+	}
+	return fmt.Errorf("watch channel closed")
+}
+
+// put parses the value of the key into the objects, keeping the value from previous when it is invalid.
+func (ep *EtcdProvider) put(key string, value []byte, previous map[string]map[string]any) {
+	kind, name, ok := ep.parseKey(key)
+	if !ok {
+		ep.logger.Warnf("Ignoring key %s, expected %s/<kind>/<name>", key, ep.prefix)
+		return
+	}
+	object, err := decodeObject(kind, name, value)
+	if err != nil {
+		ep.logger.Errorf("Ignoring invalid value of key %s: %v", key, err)
+		object = previous[kind][name]
+		if object == nil {
+			return
+		}
+	}
+	if ep.objects[kind] == nil {
+		ep.objects[kind] = make(map[string]any)
+	}
+	ep.objects[kind][name] = object
+}
+
+func (ep *EtcdProvider) parseKey(key string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(key, ep.prefix+"/")
+	if !ok {
+		return "", "", false
+	}
+	kind, name, ok := strings.Cut(rest, "/")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return "", "", false
+	}
+	switch kind {
+	case KindRoutes, KindUpstreams, KindPlugins, KindStreamRoutes:
+		return kind, name, true
+	}
+	return "", "", false
+}
+
+// decodeObject parses the YAML or JSON value of an object, whose name is set from its key.
+func decodeObject(kind, name string, value []byte) (any, error) {
+	// YAML being a superset of JSON, both are parsed the same way
+	checkName := func(field *string) error {
+		if *field != "" && *field != name {
+			return fmt.Errorf("name %s doesn't match the key", *field)
+		}
+		*field = name
+		return nil
+	}
+	switch kind {
+	case KindRoutes:
+		var route config.RouteConfig
+		if err := yaml.Unmarshal(value, &route); err != nil {
+			return nil, err
+		}
+		return route, checkName(&route.Name)
+	case KindUpstreams:
+		var upstream config.UpstreamConfig
+		if err := yaml.Unmarshal(value, &upstream); err != nil {
+			return nil, err
+		}
+		return upstream, checkName(&upstream.Name)
+	case KindPlugins:
+		var plugin config.PluginConfig
+		if err := yaml.Unmarshal(value, &plugin); err != nil {
+			return nil, err
+		}
+		return plugin, checkName(&plugin.Name)
+	default:
+		var streamRoute config.StreamRouteConfig
+		if err := yaml.Unmarshal(value, &streamRoute); err != nil {
+			return nil, err
+		}
+		return streamRoute, checkName(&streamRoute.Name)
+	}
+}
+
+func (ep *EtcdProvider) send(ch chan<- config.Dynamic) {
+	var dynamicConfig config.Dynamic
+	for _, kind := range []string{KindRoutes, KindUpstreams, KindPlugins, KindStreamRoutes} {
+		names := make([]string, 0, len(ep.objects[kind]))
+		for name := range ep.objects[kind] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			switch object := ep.objects[kind][name].(type) {
+			case config.RouteConfig:
+				dynamicConfig.Routes = append(dynamicConfig.Routes, object)
+			case config.UpstreamConfig:
+				dynamicConfig.Upstreams = append(dynamicConfig.Upstreams, object)
+			case config.PluginConfig:
+				dynamicConfig.Plugins = append(dynamicConfig.Plugins, object)
+			case config.StreamRouteConfig:
+				dynamicConfig.StreamRoute = append(dynamicConfig.StreamRoute, object)
+			}
+		}
+	}
+
+	select {
+	case ch <- dynamicConfig:
+	default:
+		ep.logger.Warnf("Warning: Config channel is full, dropping update")
+	}
+	ep.logger.Infof("etcd provider sent configuration at revision %d", ep.revision)
+}
@@ -0,0 +1,165 @@
+package etcd
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// fakeEtcd is an in-memory etcd keeping the history of its changes, so that watches get the changes made since
+// their start revision.
+type fakeEtcd struct {
+	// KV is embedded for the methods the provider doesn't use
+	clientv3.KV
+
+	mu       sync.Mutex
+	revision int64
+	values   map[string][]byte
+	history  []*clientv3.Event
+	watches  map[chan clientv3.WatchResponse]string
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{values: make(map[string][]byte), watches: make(map[chan clientv3.WatchResponse]string)}
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &clientv3.GetResponse{Header: &etcdserverpb.ResponseHeader{Revision: f.revision}}
+	for k, v := range f.values {
+		if strings.HasPrefix(k, key) {
+			resp.Kvs = append(resp.Kvs, &mvccpb.KeyValue{Key: []byte(k), Value: v})
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, key string, opts ...clientv3.OpOption) clientv3.WatchChan {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan clientv3.WatchResponse, 100)
+	startRev := clientv3.OpGet(key, opts...).Rev()
+	for _, event := range f.history {
+		if event.Kv.ModRevision >= startRev && strings.HasPrefix(string(event.Kv.Key), key) {
+			ch <- f.responseLocked(event)
+		}
+	}
+	f.watches[ch] = key
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.watches, ch)
+		close(ch)
+	}()
+	return ch
+}
+
+func (f *fakeEtcd) RequestProgress(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeEtcd) Close() error {
+	return nil
+}
+
+func (f *fakeEtcd) put(key, value string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.values[key] = []byte(value)
+	f.recordLocked(mvccpb.PUT, key, []byte(value))
+}
+
+func (f *fakeEtcd) delete(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.values, key)
+	f.recordLocked(mvccpb.DELETE, key, nil)
+}
+
+func (f *fakeEtcd) recordLocked(typ mvccpb.Event_EventType, key string, value []byte) {
+	f.revision++
+	event := &clientv3.Event{Type: typ, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: value, ModRevision: f.revision}}
+	f.history = append(f.history, event)
+	for ch, prefix := range f.watches {
+		if strings.HasPrefix(key, prefix) {
+			ch <- f.responseLocked(event)
+		}
+	}
+}
+
+func (f *fakeEtcd) responseLocked(event *clientv3.Event) clientv3.WatchResponse {
+	return clientv3.WatchResponse{
+		Header: etcdserverpb.ResponseHeader{Revision: event.Kv.ModRevision},
+		Events: []*clientv3.Event{event},
+	}
+}
+
+func expectConfig(t *testing.T, ch <-chan config.Dynamic, check func(config.Dynamic) bool) config.Dynamic {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case cfg := <-ch:
+			if check(cfg) {
+				return cfg
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for expected config")
+			return config.Dynamic{}
+		}
+	}
+}
+
+func TestEtcdProvider(t *testing.T) {
+	etcd := newFakeEtcd()
+	etcd.put("/arp/routes/web", "listener: http\nmatches:\n  - path: /\nupstream:\n  name: backend\n")
+	etcd.put("/arp/upstreams/backend", `{"nodes": [{"url": "http://127.0.0.1:9090"}]}`)
+	etcd.put("/arp/unknown/key", "ignored")
+	etcd.put("/other/routes/api", "listener: http")
+
+	ep, err := NewEtcdProvider(config.ProviderConfig{Name: "etcd", Type: "etcd", Config: map[string]any{
+		"endpoints":         []any{"127.0.0.1:2379"},
+		"reconnectInterval": "100ms",
+	}}, logger.New(logger.LevelInfo))
+	if err != nil {
+		t.Fatalf("Failed to create etcd provider: %v", err)
+	}
+	ep.client.Close()
+	ep.client = etcd
+	ch := make(chan config.Dynamic, 10)
+	go ep.Provide(ch)
+
+	cfg := expectConfig(t, ch, func(cfg config.Dynamic) bool { return true })
+	if len(cfg.Routes) != 1 || cfg.Routes[0].Name != "web" || len(cfg.Upstreams) != 1 || cfg.Upstreams[0].Name != "backend" {
+		t.Fatalf("Expected the objects under the prefix, got %+v", cfg)
+	}
+
+	// Changes are applied incrementally, invalid values keeping the last valid one
+	etcd.put("/arp/plugins/cache", "type: responsecache\nconfig:\n  ttl: 30\n")
+	expectConfig(t, ch, func(cfg config.Dynamic) bool { return len(cfg.Plugins) == 1 && cfg.Plugins[0].Name == "cache" })
+	etcd.put("/arp/routes/web", "listener: [")
+	etcd.put("/arp/routes/api", `{"name": "api", "listener": "http"}`)
+	cfg = expectConfig(t, ch, func(cfg config.Dynamic) bool { return len(cfg.Routes) == 2 })
+	if cfg.Routes[1].Name != "web" || cfg.Routes[1].Listener != "http" {
+		t.Errorf("Expected invalid route value to keep the last valid one, got %+v", cfg.Routes[1])
+	}
+
+	etcd.delete("/arp/upstreams/backend")
+	expectConfig(t, ch, func(cfg config.Dynamic) bool { return len(cfg.Upstreams) == 0 && len(cfg.Routes) == 2 })
+}
+
+func TestDecodeObjectNameMismatch(t *testing.T) {
+	if _, err := decodeObject(KindUpstreams, "backend", []byte("name: other")); err == nil {
+		t.Error("Expected object named differently from its key to be rejected")
+	}
+}
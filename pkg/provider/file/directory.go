@@ -0,0 +1,333 @@
+package file
+
+import (
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Directory mode merges the configuration fragments found in a directory, so that every team can own its
+// own file. Files are matched against pattern, .yaml, .yml, .json and .toml files being read when it is empty, and
+// subdirectories are only read when recursive is set. Hidden files and directories are skipped.
+//
+// Routes, upstreams, plugins and stream routes are merged by name. The same name may only appear in several
+// files with identical definitions, any conflict rejecting the whole update until it is fixed.
+
+func newDirectoryProvider(cfg config.ProviderConfig, logger *logger.Logger) (*FileProvider, error) {
+	directory, ok := cfg.Config["directory"].(string)
+	if !ok || directory == "" {
+		return nil, fmt.Errorf("'directory' must be a non empty string")
+	}
+	if _, ok := cfg.Config["path"]; ok {
+		return nil, fmt.Errorf("'path' and 'directory' are mutually exclusive")
+	}
+	absPath, err := filepath.Abs(directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	fp := &FileProvider{
+		config:    cfg,
+		directory: absPath,
+		logger:    logger.WithComponent("file_provider"),
+	}
+	if recursive, exists := cfg.Config["recursive"]; exists {
+		if fp.recursive, ok = recursive.(bool); !ok {
+			return nil, fmt.Errorf("'recursive' must be a boolean")
+		}
+	}
+	if pattern, exists := cfg.Config["pattern"]; exists {
+		if fp.pattern, ok = pattern.(string); !ok {
+			return nil, fmt.Errorf("'pattern' must be a string")
+		}
+		if _, err := filepath.Match(fp.pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %w", fp.pattern, err)
+		}
+	}
+	if fp.format, err = parseFormat(cfg); err != nil {
+		return nil, err
+	}
+	return fp, nil
+}
+
+func (fp *FileProvider) provideDirectory(ch chan<- config.Dynamic) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fp.logger.Errorf("Failed to create file watcher: %v", err)
+		return
+	}
+	defer watcher.Close()
+
+	if err := fp.watchDirectories(watcher, fp.directory); err != nil {
+		fp.logger.Errorf("Failed to watch directory: %v", err)
+		return
+	}
+
+	if err := fp.readAndSendDirectory(ch); err != nil {
+		fp.logger.Errorf("Failed to read initial config: %v", err)
+	}
+
+	fp.logger.Debugf("file provider watching directory: %s", fp.directory)
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			if fp.recursive && event.Has(fsnotify.Create) {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					if err := fp.watchDirectories(watcher, event.Name); err != nil {
+						fp.logger.Errorf("Failed to watch directory: %v", err)
+					}
+				}
+			}
+			// Any other event may change the merged configuration, e.g. symlinks swapped by Kubernetes when a
+			// ConfigMap changes. Unchanged content is skipped by the hash check.
+			if err := fp.readAndSendDirectory(ch); err != nil {
+				fp.logger.Errorf("Failed to read config: %v", err)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fp.logger.Errorf("File watcher error: %v", err)
+		}
+	}
+}
+
+// watchDirectories adds a watch on the directory, and on its subdirectories in recursive mode.
+func (fp *FileProvider) watchDirectories(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if path != root && (!fp.recursive || isHidden(d.Name())) {
+			return filepath.SkipDir
+		}
+		return watcher.Add(path)
+	})
+}
+
+// fragment is the configuration read from a file of the directory.
+type fragment struct {
+	// path is relative to the directory
+	path string
+	cfg  config.Dynamic
+}
+
+func (fp *FileProvider) readAndSendDirectory(ch chan<- config.Dynamic) error {
+	paths, err := fp.listFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list config files: %v", err)
+	}
+
+	hash := md5.New()
+	contents := make([][]byte, len(paths))
+	for i, path := range paths {
+		if contents[i], err = os.ReadFile(filepath.Join(fp.directory, path)); err != nil {
+			return fmt.Errorf("%s: failed to read config file: %v", path, err)
+		}
+		fmt.Fprintf(hash, "%s\x00%d\x00", path, len(contents[i]))
+		hash.Write(contents[i])
+	}
+	contentHash := fmt.Sprintf("%x", hash.Sum(nil))
+	if contentHash == fp.lastHash {
+		// Content hasn't changed
+		return nil
+	}
+
+	fragments := make([]fragment, 0, len(paths))
+	var errs []error
+	for i, path := range paths {
+		var cfg config.Dynamic
+		format := fp.formatOf(path)
+		if err := config.Decode(contents[i], format, &cfg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: failed to parse config %s: %v", path, format, err))
+			continue
+		}
+		fragments = append(fragments, fragment{path: path, cfg: cfg})
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	dynamicConfig, sources, err := mergeFragments(fragments)
+	if err != nil {
+		return err
+	}
+	if err := validateMerged(dynamicConfig, sources); err != nil {
+		return err
+	}
+
+	select {
+	case ch <- dynamicConfig:
+	default:
+		fp.logger.Warnf("Warning: Config channel is full, dropping update")
+	}
+
+	fp.lastHash = contentHash
+	for key, source := range sources {
+		fp.logger.Debugf("file provider loaded %s from %s", key, source)
+	}
+	fp.logger.Infof("file provider sent configuration merged from %d files", len(fragments))
+	return nil
+}
+
+// listFiles returns the config files of the directory relative to it, in lexical order.
+func (fp *FileProvider) listFiles() ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(fp.directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != fp.directory && (!fp.recursive || isHidden(d.Name())) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isHidden(d.Name()) || !fp.matches(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(fp.directory, path)
+		if err != nil {
+			return err
+		}
+		paths = append(paths, rel)
+		return nil
+	})
+	return paths, err
+}
+
+func (fp *FileProvider) matches(name string) bool {
+	if fp.pattern != "" {
+		matched, _ := filepath.Match(fp.pattern, name)
+		return matched
+	}
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml", ".json", ".toml":
+		return true
+	}
+	return false
+}
+
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// mergeFragments merges the fragments in order, returning the file each object came from keyed by kind and name.
+// Objects defined with different content in several files are reported with the files involved.
+func mergeFragments(fragments []fragment) (config.Dynamic, map[string]string, error) {
+	var merged config.Dynamic
+	sources := make(map[string]string)
+	definitions := make(map[string]any)
+	var errs []error
+
+	// add records the object, returning false when it was already merged
+	add := func(kind, name, path string, definition any) bool {
+		key := kind + "/" + name
+		source, exists := sources[key]
+		if !exists {
+			sources[key] = path
+			definitions[key] = definition
+			return true
+		}
+		if !reflect.DeepEqual(definitions[key], definition) {
+			errs = append(errs, fmt.Errorf("%s: %s %q conflicts with the one defined in %s", path, kind, name, source))
+		}
+		return false
+	}
+
+	for _, f := range fragments {
+		for _, route := range f.cfg.Routes {
+			if add("route", route.Name, f.path, route) {
+				merged.Routes = append(merged.Routes, route)
+			}
+		}
+		for _, upstream := range f.cfg.Upstreams {
+			if add("upstream", upstream.Name, f.path, upstream) {
+				merged.Upstreams = append(merged.Upstreams, upstream)
+			}
+		}
+		for _, plugin := range f.cfg.Plugins {
+			if add("plugin", plugin.Name, f.path, plugin) {
+				merged.Plugins = append(merged.Plugins, plugin)
+			}
+		}
+		for _, streamRoute := range f.cfg.StreamRoute {
+			if add("streamRoute", streamRoute.Name, f.path, streamRoute) {
+				merged.StreamRoute = append(merged.StreamRoute, streamRoute)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return config.Dynamic{}, nil, errors.Join(errs...)
+	}
+	return merged, sources, nil
+}
+
+// validateMerged validates the merged configuration, prefixing every error with the file defining the object.
+// References to listeners, plugin types and discovery types are left to the watcher, which knows about them.
+func validateMerged(merged config.Dynamic, sources map[string]string) error {
+	validator := config.NewDynamicValidator()
+	validator.AllowExternalReferences()
+	if validator.Validate(&merged) == nil {
+		return nil
+	}
+	errs := make([]error, 0, len(validator.GetErrors()))
+	for _, verr := range validator.GetErrors() {
+		if source := sourceOf(merged, sources, verr.Field); source != "" {
+			errs = append(errs, fmt.Errorf("%s: %v", source, verr))
+		} else {
+			errs = append(errs, verr)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sourceOf returns the file defining the object of a validation error field like routes[0].matches, or an empty
+// string when it isn't known.
+func sourceOf(merged config.Dynamic, sources map[string]string, field string) string {
+	kind, rest, ok := strings.Cut(field, "[")
+	if !ok {
+		return ""
+	}
+	index, _, ok := strings.Cut(rest, "]")
+	if !ok {
+		return ""
+	}
+	i, err := strconv.Atoi(index)
+	if err != nil || i < 0 {
+		return ""
+	}
+	var name string
+	switch {
+	case kind == "routes" && i < len(merged.Routes):
+		kind, name = "route", merged.Routes[i].Name
+	case kind == "upstreams" && i < len(merged.Upstreams):
+		kind, name = "upstream", merged.Upstreams[i].Name
+	case kind == "plugins" && i < len(merged.Plugins):
+		kind, name = "plugin", merged.Plugins[i].Name
+	case kind == "streamRoutes" && i < len(merged.StreamRoute):
+		kind, name = "streamRoute", merged.StreamRoute[i].Name
+	default:
+		return ""
+	}
+	return sources[kind+"/"+name]
+}
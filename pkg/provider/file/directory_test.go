@@ -0,0 +1,181 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+}
+
+func newTestDirectoryProvider(t *testing.T, cfg map[string]any) *FileProvider {
+	t.Helper()
+	fp, err := NewFileProvider(config.ProviderConfig{Name: "dir", Type: "file", Config: cfg}, logger.New(logger.LevelInfo))
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+	return fp
+}
+
+func expectConfig(t *testing.T, ch <-chan config.Dynamic, check func(config.Dynamic) bool) config.Dynamic {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case cfg := <-ch:
+			if check(cfg) {
+				return cfg
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for expected config")
+			return config.Dynamic{}
+		}
+	}
+}
+
+func TestDirectoryProvider(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.yaml"), `
+routes:
+  - name: web
+    listener: http
+    matches:
+      - path: /
+    upstream:
+      name: shared
+upstreams:
+  - name: shared
+    type: roundrobin
+    nodes:
+      - url: http://127.0.0.1:8080
+`)
+	writeFile(t, filepath.Join(dir, "team", "b.yml"), `
+upstreams:
+  - name: shared
+    type: roundrobin
+    nodes:
+      - url: http://127.0.0.1:8080
+  - name: api
+    type: roundrobin
+    nodes:
+      - url: http://127.0.0.1:8081
+`)
+	writeFile(t, filepath.Join(dir, "notes.txt"), "not a config")
+	writeFile(t, filepath.Join(dir, ".hidden.yaml"), "routes: [")
+
+	fp := newTestDirectoryProvider(t, map[string]any{"directory": dir, "recursive": true})
+	ch := make(chan config.Dynamic, 10)
+	go fp.Provide(ch)
+
+	cfg := expectConfig(t, ch, func(cfg config.Dynamic) bool { return true })
+	if len(cfg.Routes) != 1 || len(cfg.Upstreams) != 2 {
+		t.Fatalf("Expected 1 route and 2 upstreams, got %+v", cfg)
+	}
+
+	// Files added to new subdirectories are picked up
+	writeFile(t, filepath.Join(dir, "other", "c.json"), `{"plugins": [{"name": "cache", "type": "responsecache"}]}`)
+	expectConfig(t, ch, func(cfg config.Dynamic) bool { return len(cfg.Plugins) == 1 })
+}
+
+func TestDirectoryProviderPattern(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "routes.yaml"), "routes:\n  - name: web\n")
+	writeFile(t, filepath.Join(dir, "routes.draft"), "routes:\n  - name: draft\n")
+	writeFile(t, filepath.Join(dir, "sub", "routes.yaml"), "routes:\n  - name: nested\n")
+
+	fp := newTestDirectoryProvider(t, map[string]any{"directory": dir, "pattern": "*.yaml"})
+	paths, err := fp.listFiles()
+	if err != nil {
+		t.Fatalf("Failed to list files: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != "routes.yaml" {
+		t.Errorf("Expected only routes.yaml without recursion, got %v", paths)
+	}
+}
+
+func TestMergeFragmentsConflict(t *testing.T) {
+	fragments := []fragment{
+		{path: "a.yaml", cfg: config.Dynamic{Routes: []config.RouteConfig{{Name: "web", Listener: "http"}}}},
+		{path: "b.yaml", cfg: config.Dynamic{Routes: []config.RouteConfig{{Name: "web", Listener: "https"}}}},
+	}
+	_, _, err := mergeFragments(fragments)
+	if err == nil || !strings.Contains(err.Error(), `b.yaml: route "web" conflicts with the one defined in a.yaml`) {
+		t.Errorf("Expected conflict reported against both files, got %v", err)
+	}
+}
+
+func TestMergeFragmentsSources(t *testing.T) {
+	fragments := []fragment{
+		{path: "a.yaml", cfg: config.Dynamic{
+			Routes:    []config.RouteConfig{{Name: "web", Listener: "http"}},
+			Upstreams: []config.UpstreamConfig{{Name: "shared"}},
+		}},
+		{path: filepath.Join("team", "b.yml"), cfg: config.Dynamic{
+			Upstreams: []config.UpstreamConfig{{Name: "shared"}, {Name: "api"}},
+		}},
+	}
+	_, sources, err := mergeFragments(fragments)
+	if err != nil {
+		t.Fatalf("Failed to merge fragments: %v", err)
+	}
+	if sources["route/web"] != "a.yaml" || sources["upstream/shared"] != "a.yaml" || sources["upstream/api"] != filepath.Join("team", "b.yml") {
+		t.Errorf("Unexpected sources %v", sources)
+	}
+}
+
+func TestDirectoryProviderReportsInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.yaml"), `
+upstreams:
+  - name: shared
+    type: roundrobin
+    nodes:
+      - url: http://127.0.0.1:8080
+`)
+	writeFile(t, filepath.Join(dir, "b.yaml"), `
+routes:
+  - name: web
+    listener: http
+    matches:
+      - path: web
+    upstream:
+      name: shared
+`)
+
+	fp := newTestDirectoryProvider(t, map[string]any{"directory": dir})
+	ch := make(chan config.Dynamic, 1)
+	err := fp.readAndSendDirectory(ch)
+	if err == nil || !strings.Contains(err.Error(), "b.yaml: validation error: routes[0].matches[0].path") {
+		t.Errorf("Expected the invalid route reported against b.yaml, got %v", err)
+	}
+	if len(ch) != 0 {
+		t.Error("Expected the invalid configuration not to be sent")
+	}
+}
+
+func TestDirectoryProviderConfig(t *testing.T) {
+	invalid := []map[string]any{
+		{"directory": ""},
+		{"directory": "conf.d", "path": "dynamic.yaml"},
+		{"directory": "conf.d", "recursive": "yes"},
+		{"directory": "conf.d", "pattern": "["},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewFileProvider(config.ProviderConfig{Config: cfg}, logger.New(logger.LevelInfo)); err == nil {
+			t.Errorf("Expected config %v to be invalid", cfg)
+		}
+	}
+}
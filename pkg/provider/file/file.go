@@ -9,20 +9,30 @@ import (
 	"github.com/Revolyssup/arp/pkg/config"
 	"github.com/Revolyssup/arp/pkg/logger"
 	"github.com/fsnotify/fsnotify"
-	"gopkg.in/yaml.v3"
 )
 
+// FileProvider reads the dynamic configuration from a single file set with path, or from every file of a
+// directory set with directory. See directory.go for the directory mode.
 type FileProvider struct {
 	config   config.ProviderConfig
 	logger   *logger.Logger
 	filePath string
 	lastHash string
+	// format overrides the format detected from the file extension
+	format config.Format
+
+	directory string
+	recursive bool
+	pattern   string
 }
 
 func NewFileProvider(cfg config.ProviderConfig, logger *logger.Logger) (*FileProvider, error) {
+	if _, ok := cfg.Config["directory"]; ok {
+		return newDirectoryProvider(cfg, logger)
+	}
 	filePath, ok := cfg.Config["path"].(string)
 	if !ok {
-		return nil, fmt.Errorf("missing 'path' configuration")
+		return nil, fmt.Errorf("missing 'path' or 'directory' configuration")
 	}
 
 	absPath, err := filepath.Abs(filePath)
@@ -30,14 +40,25 @@ func NewFileProvider(cfg config.ProviderConfig, logger *logger.Logger) (*FilePro
 		return nil, fmt.Errorf("failed to get absolute path: %w", err)
 	}
 
+	format, err := parseFormat(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	return &FileProvider{
 		config:   cfg,
 		filePath: absPath,
+		format:   format,
 		logger:   logger.WithComponent("file_provider"),
 	}, nil
 }
 
 func (fp *FileProvider) Provide(ch chan<- config.Dynamic) {
+	if fp.directory != "" {
+		fp.provideDirectory(ch)
+		return
+	}
+
 	// Create new watcher
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -118,8 +139,9 @@ func (fp *FileProvider) readAndSendConfig(ch chan<- config.Dynamic) error {
 	}
 
 	var dynamicConfig config.Dynamic
-	if err := yaml.Unmarshal(content, &dynamicConfig); err != nil {
-		return fmt.Errorf("failed to parse config YAML: %v", err)
+	format := fp.formatOf(fp.filePath)
+	if err := config.Decode(content, format, &dynamicConfig); err != nil {
+		return fmt.Errorf("failed to parse config %s: %v", format, err)
 	}
 
 	select {
@@ -132,3 +154,23 @@ func (fp *FileProvider) readAndSendConfig(ch chan<- config.Dynamic) error {
 	fp.logger.Warnf("file provider sent updated configuration")
 	return nil
 }
+
+// parseFormat returns the format set with the format option, empty when it is detected from the file extensions.
+func parseFormat(cfg config.ProviderConfig) (config.Format, error) {
+	value, exists := cfg.Config["format"]
+	if !exists {
+		return "", nil
+	}
+	name, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("'format' must be a string")
+	}
+	return config.ParseFormat(name)
+}
+
+func (fp *FileProvider) formatOf(path string) config.Format {
+	if fp.format != "" {
+		return fp.format
+	}
+	return config.FormatOf(path)
+}
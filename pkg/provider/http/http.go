@@ -0,0 +1,260 @@
+package httpprovider
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+)
+
+const (
+	DefaultInterval = 10 * time.Second
+	DefaultTimeout  = 5 * time.Second
+
+	// maxConfigSize bounds the size of the fetched configuration
+	maxConfigSize = 10 << 20
+)
+
+// HTTPProvider periodically fetches the dynamic configuration from a URL. The body is parsed as JSON when
+// served with a JSON content type, as TOML with application/toml, and as YAML otherwise. Conditional requests avoid transferring unchanged
+// configurations, and the last good configuration is kept while the endpoint is unavailable or serves an
+// invalid one.
+type HTTPProvider struct {
+	config   config.ProviderConfig
+	logger   *logger.Logger
+	url      string
+	interval time.Duration
+	headers  map[string]string
+	client   *http.Client
+
+	etag         string
+	lastModified string
+	lastHash     string
+}
+
+func NewHTTPProvider(cfg config.ProviderConfig, logger *logger.Logger) (*HTTPProvider, error) {
+	rawURL, ok := cfg.Config["url"].(string)
+	if !ok || rawURL == "" {
+		return nil, fmt.Errorf("missing 'url' configuration")
+	}
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %s", rawURL)
+	}
+	hp := &HTTPProvider{
+		config:   cfg,
+		logger:   logger.WithComponent("http_provider"),
+		url:      rawURL,
+		interval: DefaultInterval,
+		headers:  make(map[string]string),
+	}
+
+	timeout := DefaultTimeout
+	for key, dur := range map[string]*time.Duration{"interval": &hp.interval, "timeout": &timeout} {
+		value, exists := cfg.Config[key]
+		if !exists {
+			continue
+		}
+		str, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("'%s' must be a duration string", key)
+		}
+		parsed, err := time.ParseDuration(str)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid %s %s", key, str)
+		}
+		*dur = parsed
+	}
+
+	if headers, exists := cfg.Config["headers"]; exists {
+		m, ok := headers.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("'headers' must be a map")
+		}
+		for name, value := range m {
+			str, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("header %s must be a string", name)
+			}
+			hp.headers[name] = str
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg, exists := cfg.Config["tls"]; exists {
+		m, ok := tlsCfg.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("'tls' must be a map")
+		}
+		clientTLS, err := newTLSConfig(m)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = clientTLS
+	}
+	hp.client = &http.Client{Timeout: timeout, Transport: transport}
+	return hp, nil
+}
+
+// newTLSConfig builds the client TLS configuration from the caFile, certFile, keyFile, serverName and
+// insecureSkipVerify options.
+func newTLSConfig(cfg map[string]any) (*tls.Config, error) {
+	tlsCfg := &tls.Config{}
+	str := func(key string) (string, error) {
+		value, exists := cfg[key]
+		if !exists {
+			return "", nil
+		}
+		s, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("'tls.%s' must be a string", key)
+		}
+		return s, nil
+	}
+
+	caFile, err := str("caFile")
+	if err != nil {
+		return nil, err
+	}
+	if caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", caFile)
+		}
+	}
+
+	certFile, err := str("certFile")
+	if err != nil {
+		return nil, err
+	}
+	keyFile, err := str("keyFile")
+	if err != nil {
+		return nil, err
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("'tls.certFile' and 'tls.keyFile' must be set together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsCfg.ServerName, err = str("serverName"); err != nil {
+		return nil, err
+	}
+	if insecure, exists := cfg["insecureSkipVerify"]; exists {
+		var ok bool
+		if tlsCfg.InsecureSkipVerify, ok = insecure.(bool); !ok {
+			return nil, fmt.Errorf("'tls.insecureSkipVerify' must be a boolean")
+		}
+	}
+	return tlsCfg, nil
+}
+
+func (hp *HTTPProvider) Provide(ch chan<- config.Dynamic) {
+	if err := hp.fetchAndSendConfig(ch); err != nil {
+		hp.logger.Errorf("Failed to fetch initial config: %v", err)
+	}
+
+	hp.logger.Debugf("http provider polling %s every %s", hp.url, hp.interval)
+
+	ticker := time.NewTicker(hp.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := hp.fetchAndSendConfig(ch); err != nil {
+			hp.logger.Errorf("Failed to fetch config, keeping last good config: %v", err)
+		}
+	}
+}
+
+func (hp *HTTPProvider) fetchAndSendConfig(ch chan<- config.Dynamic) error {
+	req, err := http.NewRequest(http.MethodGet, hp.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/yaml, application/json;q=0.9")
+	for key, value := range hp.headers {
+		req.Header.Set(key, value)
+	}
+	if hp.etag != "" {
+		req.Header.Set("If-None-Match", hp.etag)
+	}
+	if hp.lastModified != "" {
+		req.Header.Set("If-Modified-Since", hp.lastModified)
+	}
+
+	resp, err := hp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	content, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to read config: %v", err)
+	}
+	if len(content) > maxConfigSize {
+		return fmt.Errorf("config larger than %d bytes", maxConfigSize)
+	}
+
+	contentHash := fmt.Sprintf("%x", md5.Sum(content))
+	if contentHash != hp.lastHash {
+		dynamicConfig, err := decode(resp.Header.Get("Content-Type"), content)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case ch <- dynamicConfig:
+		default:
+			hp.logger.Warnf("Warning: Config channel is full, dropping update")
+			return nil
+		}
+		hp.lastHash = contentHash
+		hp.logger.Infof("http provider sent updated configuration")
+	}
+
+	// Validators are only remembered once the config was sent, so that a dropped or undecodable one is fetched again
+	hp.etag = resp.Header.Get("ETag")
+	hp.lastModified = resp.Header.Get("Last-Modified")
+	return nil
+}
+
+// decode parses the config according to its content type, defaulting to YAML.
+func decode(contentType string, content []byte) (config.Dynamic, error) {
+	var dynamicConfig config.Dynamic
+	format := config.FormatYAML
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		format = config.FormatJSON
+	case mediaType == "application/toml":
+		format = config.FormatTOML
+	}
+	if err := config.Unmarshal(content, format, &dynamicConfig); err != nil {
+		return dynamicConfig, fmt.Errorf("failed to parse config %s: %v", format, err)
+	}
+	return dynamicConfig, nil
+}
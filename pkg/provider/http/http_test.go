@@ -0,0 +1,171 @@
+package httpprovider
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+)
+
+// fakeConfigServer serves a config with an ETag, answering conditional requests with 304.
+type fakeConfigServer struct {
+	mu          sync.Mutex
+	contentType string
+	body        string
+	status      int
+	version     int
+	notModified int
+}
+
+func (f *fakeConfigServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	etag := `"` + string(rune('0'+f.version)) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		f.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", f.contentType)
+	w.Write([]byte(f.body))
+}
+
+func (f *fakeConfigServer) set(contentType, body string, status int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.contentType, f.body, f.status = contentType, body, status
+	f.version++
+}
+
+func expectConfig(t *testing.T, ch <-chan config.Dynamic) config.Dynamic {
+	t.Helper()
+	select {
+	case cfg := <-ch:
+		return cfg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for config")
+		return config.Dynamic{}
+	}
+}
+
+func TestHTTPProvider(t *testing.T) {
+	fake := &fakeConfigServer{}
+	fake.set("application/yaml", "routes:\n  - name: web\n    listener: http\n", 0)
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0o644); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+
+	hp, err := NewHTTPProvider(config.ProviderConfig{Name: "remote", Type: "http", Config: map[string]any{
+		"url":      server.URL,
+		"interval": "50ms",
+		"headers":  map[string]any{"Authorization": "Bearer secret"},
+		"tls":      map[string]any{"caFile": caFile},
+	}}, logger.New(logger.LevelInfo))
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+	ch := make(chan config.Dynamic, 10)
+	go hp.Provide(ch)
+
+	cfg := expectConfig(t, ch)
+	if len(cfg.Routes) != 1 || cfg.Routes[0].Name != "web" {
+		t.Fatalf("Expected route from YAML config, got %+v", cfg)
+	}
+
+	// Failures and invalid configs keep the last good config
+	fake.set("", "", http.StatusServiceUnavailable)
+	time.Sleep(150 * time.Millisecond)
+	fake.set("application/json", `{"routes": [`, 0)
+	time.Sleep(150 * time.Millisecond)
+	select {
+	case cfg := <-ch:
+		t.Fatalf("Expected no config while the endpoint fails, got %+v", cfg)
+	default:
+	}
+
+	fake.set("application/json; charset=utf-8", `{"routes": [{"name": "api", "listener": "http"}]}`, 0)
+	cfg = expectConfig(t, ch)
+	if len(cfg.Routes) != 1 || cfg.Routes[0].Name != "api" {
+		t.Fatalf("Expected route from JSON config, got %+v", cfg)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	fake.mu.Lock()
+	notModified := fake.notModified
+	fake.mu.Unlock()
+	if notModified == 0 {
+		t.Error("Expected conditional requests for unchanged config")
+	}
+}
+
+func TestHTTPProviderConfig(t *testing.T) {
+	invalid := []map[string]any{
+		{},
+		{"url": "ftp://config"},
+		{"url": "http://config", "interval": "often"},
+		{"url": "http://config", "headers": "Authorization"},
+		{"url": "http://config", "tls": map[string]any{"certFile": "cert.pem"}},
+		{"url": "http://config", "tls": map[string]any{"caFile": "missing.pem"}},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewHTTPProvider(config.ProviderConfig{Config: cfg}, logger.New(logger.LevelInfo)); err == nil {
+			t.Errorf("Expected config %v to be invalid", cfg)
+		}
+	}
+}
+
+func TestHTTPProviderDroppedConfigFetchedAgain(t *testing.T) {
+	fake := &fakeConfigServer{}
+	fake.set("application/yaml", "routes:\n  - name: web\n    listener: http\n", 0)
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	hp, err := NewHTTPProvider(config.ProviderConfig{Name: "remote", Type: "http", Config: map[string]any{
+		"url":     server.URL,
+		"headers": map[string]any{"Authorization": "Bearer secret"},
+	}}, logger.New(logger.LevelInfo))
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+
+	// Nobody reads the unbuffered channel, so the config is dropped
+	if err := hp.fetchAndSendConfig(make(chan config.Dynamic)); err != nil {
+		t.Fatalf("Failed to fetch config: %v", err)
+	}
+	ch := make(chan config.Dynamic, 1)
+	if err := hp.fetchAndSendConfig(ch); err != nil {
+		t.Fatalf("Failed to fetch config: %v", err)
+	}
+	select {
+	case cfg := <-ch:
+		if len(cfg.Routes) != 1 || cfg.Routes[0].Name != "web" {
+			t.Errorf("Expected dropped config to be sent again, got %+v", cfg)
+		}
+	default:
+		t.Error("Expected dropped config to be fetched and sent again")
+	}
+	if fake.notModified != 0 {
+		t.Errorf("Expected dropped config to be fetched without validators, got %d not modified", fake.notModified)
+	}
+}
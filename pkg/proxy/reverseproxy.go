@@ -2,13 +2,16 @@ package proxy
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Revolyssup/arp/pkg/logger"
 	"github.com/Revolyssup/arp/pkg/utils"
@@ -16,10 +19,25 @@ import (
 
 const bufferSize = 32 * 1024
 
+const (
+	// maxIdleConnsPerTarget caps how many idle connections are kept per upstream target
+	maxIdleConnsPerTarget = 32
+	// idleConnTimeout is how long an idle pooled connection is trusted to still be usable
+	idleConnTimeout = 90 * time.Second
+)
+
+// ErrConnect is returned by Forward when no connection to the target could be established.
+// Nothing has been written to the client at that point, so the request can be retried elsewhere.
+var ErrConnect = errors.New("failed to connect to upstream")
+
 // Service holds resources shared across multiple reverse proxy instances
 type Service struct {
-	buf *utils.Pool[[]byte]
-	log *logger.Logger
+	buf   *utils.Pool[[]byte]
+	log   *logger.Logger
+	mu    sync.Mutex
+	pools map[string]*connPool
+	// scopes holds the open scopes, connections of other scopes not being pooled
+	scopes map[string]bool
 }
 
 func NewService(log *logger.Logger) *Service {
@@ -27,43 +45,161 @@ func NewService(log *logger.Logger) *Service {
 		buf: utils.NewPool(func() []byte {
 			return make([]byte, bufferSize)
 		}),
-		log: log.WithComponent("proxy_service"),
+		log:    log.WithComponent("proxy_service"),
+		pools:  make(map[string]*connPool),
+		scopes: make(map[string]bool),
+	}
+}
+
+// connPool returns the connection pool shared by all proxies of the scope to the given target.
+// Pools are keyed by the per connection request limit as well, so that upstreams
+// with different limits never hand their connections to each other.
+func (s *Service) connPool(target *url.URL, opts Options) *connPool {
+	key := opts.Scope + "#" + target.Host + "#" + strconv.Itoa(opts.MaxRequestsPerConnection)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pool, ok := s.pools[key]; ok {
+		return pool
+	}
+	pool := newconnPool(opts.Scope, target, opts.MaxRequestsPerConnection, s.log)
+	if opts.Scope != "" && !s.scopes[opts.Scope] {
+		// Proxies of a closed scope may still be serving requests, their connections are closed once done
+		pool.closed = true
+		return pool
+	}
+	s.pools[key] = pool
+	return pool
+}
+
+// OpenScope starts pooling the connections of the scope. Connections of proxies without scope are always pooled.
+func (s *Service) OpenScope(scope string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scopes[scope] = true
+}
+
+// CloseTarget closes the idle connections of the scope to the target and stops pooling connections
+// that are still serving requests, which get closed as soon as their response is done. It is meant
+// for targets that were removed from the scope, other scopes keeping their connections to the target.
+func (s *Service) CloseTarget(scope string, target *url.URL) {
+	s.closePools(func(pool *connPool) bool { return pool.scope == scope && pool.target.Host == target.Host })
+}
+
+// CloseScope closes the pools of the scope to every target and stops pooling its connections, like when the
+// upstream they serve is removed.
+func (s *Service) CloseScope(scope string) {
+	s.mu.Lock()
+	delete(s.scopes, scope)
+	s.mu.Unlock()
+	s.closePools(func(pool *connPool) bool { return pool.scope == scope })
+}
+
+func (s *Service) closePools(matches func(*connPool) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, pool := range s.pools {
+		if matches(pool) {
+			pool.Close()
+			delete(s.pools, key)
+		}
 	}
 }
 
 type UpgradeHandler func(http.ResponseWriter, *http.Request, net.Conn, *http.Response)
 
+// Options tune how a ReverseProxy uses its upstream connections.
+type Options struct {
+	// MaxRequestsPerConnection closes a pooled connection once it has served this many requests.
+	// Zero means unlimited.
+	MaxRequestsPerConnection int
+	// Scope restricts connection sharing to the proxies of the same scope, like the upstream they serve,
+	// so that closing the connections of a scope leaves the others untouched.
+	Scope string
+}
+
+type pooledConn struct {
+	net.Conn
+	requests  int
+	idleSince time.Time
+}
+
 type connPool struct {
-	target *url.URL
-	pool   *utils.Pool[net.Conn]
-	logger *logger.Logger
+	scope       string
+	target      *url.URL
+	maxRequests int
+	mu          sync.Mutex
+	idle        []*pooledConn
+	closed      bool
+	logger      *logger.Logger
 }
 
-func newconnPool(target *url.URL, logger *logger.Logger) *connPool {
+func newconnPool(scope string, target *url.URL, maxRequests int, logger *logger.Logger) *connPool {
 	return &connPool{
-		target: target,
-		pool: utils.NewPool(func() net.Conn {
-			conn, err := net.Dial("tcp", target.Host)
-			if err != nil {
-				logger.Errorf("Failed to create connection to %s: %v", target.Host, err)
-				return nil
-			}
-			return conn
-		}),
-		logger: logger.WithComponent("conn_pool"),
+		scope:       scope,
+		target:      target,
+		maxRequests: maxRequests,
+		logger:      logger.WithComponent("conn_pool"),
+	}
+}
+
+// Get returns an idle connection if one is available or dials a new one.
+func (p *connPool) Get() (*pooledConn, error) {
+	p.mu.Lock()
+	for len(p.idle) > 0 {
+		conn := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if time.Since(conn.idleSince) < idleConnTimeout {
+			p.mu.Unlock()
+			return conn, nil
+		}
+		conn.Close()
 	}
+	p.mu.Unlock()
+	return p.Dial()
 }
 
-func (p *connPool) Get() (net.Conn, error) {
-	conn := p.pool.Get()
-	if conn == nil {
-		return nil, fmt.Errorf("failed to create connection to %s", p.target.Host)
+// Dial always opens a new connection to the target, bypassing idle connections.
+func (p *connPool) Dial() (*pooledConn, error) {
+	conn, err := net.Dial("tcp", p.target.Host)
+	if err != nil {
+		p.logger.Errorf("Failed to create connection to %s: %v", p.target.Host, err)
+		return nil, fmt.Errorf("failed to create connection to %s: %w", p.target.Host, err)
 	}
-	return conn, nil
+	return &pooledConn{Conn: conn}, nil
 }
 
-func (p *connPool) Put(conn net.Conn) {
-	p.pool.Put(conn)
+// Put returns a connection that finished a request to the pool, or closes it if it
+// reached its request limit or the pool is full.
+func (p *connPool) Put(conn *pooledConn) {
+	conn.requests++
+	if p.maxRequests > 0 && conn.requests >= p.maxRequests {
+		conn.Close()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || len(p.idle) >= maxIdleConnsPerTarget {
+		conn.Close()
+		return
+	}
+	conn.idleSince = time.Now()
+	p.idle = append(p.idle, conn)
+}
+
+// Close closes all idle connections, connections put back afterwards are closed as well.
+func (p *connPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, conn := range p.idle {
+		conn.Close()
+	}
+	p.idle = nil
+}
+
+// Discard closes a connection that must not be reused.
+func (p *connPool) Discard(conn *pooledConn) {
+	conn.Close()
 }
 
 type ReverseProxy struct {
@@ -74,29 +210,43 @@ type ReverseProxy struct {
 }
 
 func NewReverseProxy(logger *logger.Logger, service *Service, targetURL *url.URL) *ReverseProxy {
+	return NewReverseProxyWithOptions(logger, service, targetURL, Options{})
+}
+
+// NewReverseProxyWithOptions creates a proxy to the target. The logger is used as is, so that callers creating a proxy
+// per request create the logger of their proxies once.
+func NewReverseProxyWithOptions(logger *logger.Logger, service *Service, targetURL *url.URL, opts Options) *ReverseProxy {
 	return &ReverseProxy{
-		logger:    logger.WithComponent("reverse_proxy"),
+		logger:    logger,
 		service:   service,
-		connPool:  newconnPool(targetURL, logger),
+		connPool:  service.connPool(targetURL, opts),
 		targetURL: targetURL,
 	}
 }
 
 func (p *ReverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := p.Forward(w, r); err != nil {
+		p.logger.Errorf("Failed to get connection from pool: %v", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}
+}
+
+// Forward proxies the request to the target. If no connection to the target can be established
+// an error wrapping ErrConnect is returned without writing anything to w. Any other failure is
+// reported to the client as 502 Bad Gateway.
+func (p *ReverseProxy) Forward(w http.ResponseWriter, r *http.Request) error {
 	upstreamReq := r.Clone(r.Context())
 	upstreamReq.URL.Scheme = p.targetURL.Scheme
 	upstreamReq.URL.Host = p.targetURL.Host
 	upstreamReq.Header = r.Header.Clone()
-	p.roundTrip(w, r, upstreamReq)
+	return p.roundTrip(w, r, upstreamReq)
 }
 
 // Custom round trip implementation
-func (p *ReverseProxy) roundTrip(w http.ResponseWriter, r *http.Request, upstreamReq *http.Request) {
+func (p *ReverseProxy) roundTrip(w http.ResponseWriter, r *http.Request, upstreamReq *http.Request) error {
 	conn, err := p.connPool.Get()
 	if err != nil {
-		p.logger.Errorf("Failed to get connection from pool: %v", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return
+		return fmt.Errorf("%w: %v", ErrConnect, err)
 	}
 	var upgradeHandler UpgradeHandler
 	if isWebSocketUpgrade(r) {
@@ -106,30 +256,42 @@ func (p *ReverseProxy) roundTrip(w http.ResponseWriter, r *http.Request, upstrea
 		removeHopHeaders(upstreamReq.Header)
 	}
 
-	// we don't need to put back long lived connections like WebSocket for now.
-	if upgradeHandler == nil {
-		defer p.connPool.Put(conn)
+	resp, err := p.send(conn, r, upstreamReq)
+	if err != nil && conn.requests > 0 && isReplayable(r) {
+		// The upstream may have closed the pooled connection while it was idle, try once more on a fresh one.
+		p.connPool.Discard(conn)
+		if conn, err = p.connPool.Dial(); err != nil {
+			return fmt.Errorf("%w: %v", ErrConnect, err)
+		}
+		resp, err = p.send(conn, r, upstreamReq)
 	}
-
-	if err := upstreamReq.Write(conn); err != nil {
-		p.logger.Errorf("Failed to write request to connection: %v", err)
+	if err != nil {
+		p.connPool.Discard(conn)
+		p.logger.Errorf("Failed to proxy request: %v", err)
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return
+		return nil
 	}
 
-	p.handleResponse(conn, w, r, upgradeHandler)
+	p.handleResponse(conn, resp, w, r, upgradeHandler)
+	return nil
 }
 
-func (p *ReverseProxy) handleResponse(conn net.Conn, w http.ResponseWriter, r *http.Request, upgradeHandler UpgradeHandler) {
-	reader := bufio.NewReader(conn)
-	resp, err := http.ReadResponse(reader, r)
+// send writes the request on the connection and reads back the response headers.
+func (p *ReverseProxy) send(conn *pooledConn, r *http.Request, upstreamReq *http.Request) (*http.Response, error) {
+	if err := upstreamReq.Write(conn); err != nil {
+		return nil, fmt.Errorf("failed to write request to connection: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), r)
 	if err != nil {
-		p.logger.Errorf("Failed to read response: %v", err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
-		return
+		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
+	return resp, nil
+}
+
+func (p *ReverseProxy) handleResponse(conn *pooledConn, resp *http.Response, w http.ResponseWriter, r *http.Request, upgradeHandler UpgradeHandler) {
 	defer resp.Body.Close()
 
+	// we don't need to put back long lived connections like WebSocket for now.
 	if resp.StatusCode == http.StatusSwitchingProtocols && upgradeHandler != nil {
 		upgradeHandler(w, r, conn, resp)
 		return
@@ -140,16 +302,24 @@ func (p *ReverseProxy) handleResponse(conn net.Conn, w http.ResponseWriter, r *h
 	}
 	w.WriteHeader(resp.StatusCode)
 
+	var err error
 	if isStreamingResponse(resp) {
 		//ideally instead of simple copy and flush. httputil.ChunkedWriter can be used.
 		// But for some fun reasons, I cannot use it currently.
 		// TODO: Replace this with chunked writer later.
-		p.copyAndFlush(w, resp.Body, bufferSize)
+		err = p.copyAndFlush(w, resp.Body, bufferSize)
 	} else {
 		buf := p.service.buf.Get()
 		defer p.service.buf.Put(buf)
-		io.CopyBuffer(w, resp.Body, buf)
+		_, err = io.CopyBuffer(w, resp.Body, buf)
+	}
+
+	// Only a connection whose response was read completely can carry the next request.
+	if err != nil || resp.Close || r.Close {
+		p.connPool.Discard(conn)
+		return
 	}
+	p.connPool.Put(conn)
 }
 
 func (p *ReverseProxy) webSocketUpgradeHandler(w http.ResponseWriter, r *http.Request, conn net.Conn, resp *http.Response) {
@@ -207,14 +377,14 @@ func (p *ReverseProxy) webSocketUpgradeHandler(w http.ResponseWriter, r *http.Re
 	wg.Wait()
 }
 
-func (p *ReverseProxy) copyAndFlush(dst http.ResponseWriter, src io.Reader, bufferSize int) {
+func (p *ReverseProxy) copyAndFlush(dst http.ResponseWriter, src io.Reader, bufferSize int) error {
 	flusher, hasFlusher := dst.(http.Flusher)
 	buf := make([]byte, bufferSize)
 	for {
 		n, err := src.Read(buf)
 		if n > 0 {
 			if _, writeErr := dst.Write(buf[:n]); writeErr != nil {
-				break
+				return writeErr
 			}
 
 			if hasFlusher {
@@ -225,8 +395,9 @@ func (p *ReverseProxy) copyAndFlush(dst http.ResponseWriter, src io.Reader, buff
 		if err != nil {
 			if err != io.EOF {
 				p.logger.Infof("Copy error: %v", err)
+				return err
 			}
-			break
+			return nil
 		}
 	}
 }
@@ -241,6 +412,11 @@ func removeHopHeaders(header http.Header) {
 	}
 }
 
+// isReplayable reports whether the request can safely be sent again on another connection.
+func isReplayable(r *http.Request) bool {
+	return r.Body == nil || r.Body == http.NoBody
+}
+
 func isWebSocketUpgrade(r *http.Request) bool {
 	return strings.ToLower(r.Header.Get("Upgrade")) == "websocket" &&
 		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
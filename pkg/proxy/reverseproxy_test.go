@@ -2,11 +2,14 @@ package proxy
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync/atomic"
 	"testing"
 
 	"github.com/Revolyssup/arp/pkg/logger"
@@ -31,3 +34,84 @@ func TestReverseProxy_ServeHTTP(t *testing.T) {
 		t.Errorf("Expected response body to contain 'httpbin', got %s", string(body))
 	}
 }
+
+func TestReverseProxy_MaxRequestsPerConnection(t *testing.T) {
+	var newConns atomic.Int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	upstream.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			newConns.Add(1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	targetURL, _ := url.Parse(upstream.URL)
+	log := logger.New(logger.LevelDebug)
+	service := NewService(log)
+
+	for i := 0; i < 4; i++ {
+		proxy := NewReverseProxyWithOptions(log, service, targetURL, Options{MaxRequestsPerConnection: 2})
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200 OK, got %d", w.Code)
+		}
+	}
+
+	if got := newConns.Load(); got != 2 {
+		t.Errorf("Expected 4 requests to use 2 connections, got %d", got)
+	}
+}
+
+func TestReverseProxy_ForwardConnectError(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	targetURL, _ := url.Parse("http://" + listener.Addr().String())
+	listener.Close()
+
+	proxy := NewReverseProxy(logger.New(logger.LevelDebug), NewService(logger.New(logger.LevelDebug)), targetURL)
+	w := httptest.NewRecorder()
+	err := proxy.Forward(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	if !errors.Is(err, ErrConnect) {
+		t.Errorf("Expected ErrConnect, got %v", err)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected nothing written to the client, got %q", w.Body.String())
+	}
+}
+
+func TestServiceScopes(t *testing.T) {
+	targetURL, _ := url.Parse("http://10.0.0.1:8080")
+	service := NewService(logger.New(logger.LevelInfo))
+	service.OpenScope("a")
+	service.OpenScope("b")
+
+	poolA := service.connPool(targetURL, Options{Scope: "a"})
+	poolB := service.connPool(targetURL, Options{Scope: "b"})
+	if poolA == poolB {
+		t.Fatal("Expected scopes to use their own pools")
+	}
+
+	// Draining the target of a leaves the connections of b untouched
+	service.CloseTarget("a", targetURL)
+	if !poolA.closed || poolB.closed {
+		t.Errorf("Expected only the pool of a to be closed, got a closed: %v, b closed: %v", poolA.closed, poolB.closed)
+	}
+	if service.connPool(targetURL, Options{Scope: "b"}) != poolB {
+		t.Error("Expected b to keep its pool")
+	}
+
+	// Proxies of a closed scope don't pool their connections anymore
+	service.CloseScope("b")
+	if !poolB.closed {
+		t.Error("Expected the pools of the closed scope to be closed")
+	}
+	if pool := service.connPool(targetURL, Options{Scope: "b"}); !pool.closed {
+		t.Error("Expected closed scope not to pool connections")
+	}
+	if len(service.pools) != 0 {
+		t.Errorf("Expected no pool left, got %d", len(service.pools))
+	}
+}
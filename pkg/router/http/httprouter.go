@@ -1,11 +1,11 @@
 package router
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
 	"github.com/Revolyssup/arp/pkg/config"
-	"github.com/Revolyssup/arp/pkg/discovery/manager"
 	"github.com/Revolyssup/arp/pkg/logger"
 	"github.com/Revolyssup/arp/pkg/plugin"
 	"github.com/Revolyssup/arp/pkg/proxy"
@@ -13,49 +13,46 @@ import (
 	"github.com/Revolyssup/arp/pkg/upstream"
 )
 
+// OverloadedHeader is set on responses rejected by an upstream's circuit breaker.
+const OverloadedHeader = "X-ARP-Overloaded"
+
 type Router struct {
-	pluginChain      []*plugin.Chain
-	discoveryManager *manager.DiscoveryManager
-	pathMatcher      *route.PathMatcher
-	methodMatcher    *route.MethodMatcher
-	headerMatcher    *route.HeaderMatcher
-	upstreamFactory  *upstream.Factory
-	logger           *logger.Logger
-	proxyService     *proxy.Service
+	listener      string
+	pluginChain   []*plugin.Chain
+	pathMatcher   *route.PathMatcher
+	methodMatcher *route.MethodMatcher
+	headerMatcher *route.HeaderMatcher
+	upstreams     *upstream.Registry
+	logger        *logger.Logger
+	proxyService  *proxy.Service
+	// proxyLogger is shared by the proxies created for every request
+	proxyLogger *logger.Logger
 }
 
-func NewRouter(listener string, routerFactory *route.Factory, upstreamFactory *upstream.Factory, discoveryManager *manager.DiscoveryManager, parentLogger *logger.Logger) *Router {
+func NewRouter(listener string, routerFactory *route.Factory, upstreams *upstream.Registry, proxyService *proxy.Service, parentLogger *logger.Logger) *Router {
+	routerLogger := parentLogger.WithComponent("router")
 	return &Router{
-		pathMatcher:      route.NewPathMatcher(parentLogger),
-		methodMatcher:    route.NewMethodMatcher(),
-		headerMatcher:    route.NewHeaderMatcher(),
-		upstreamFactory:  upstreamFactory,
-		discoveryManager: discoveryManager,
-		pluginChain:      []*plugin.Chain{},
-		logger:           parentLogger.WithComponent("router"),
-		proxyService:     proxy.NewService(parentLogger),
+		listener:      listener,
+		pathMatcher:   route.NewPathMatcher(parentLogger),
+		methodMatcher: route.NewMethodMatcher(),
+		headerMatcher: route.NewHeaderMatcher(),
+		upstreams:     upstreams,
+		pluginChain:   []*plugin.Chain{},
+		logger:        routerLogger,
+		proxyService:  proxyService,
+		proxyLogger:   routerLogger.WithComponent("reverse_proxy"),
 	}
 }
 
 func (r *Router) UpdateRoutes(routeConfigs []config.RouteConfig, upstreamConfigs []config.UpstreamConfig, pluginConfigs []config.PluginConfig) error {
-	// Clear existing matchers
-	r.pathMatcher.Clear()
-	r.methodMatcher.Clear()
-	r.headerMatcher.Clear()
-	//cleanup plugin
-	for _, p := range r.pluginChain {
-		p.Destroy()
-	}
 	upstreamMap := make(map[string]config.UpstreamConfig)
 	for _, up := range upstreamConfigs {
 		upstreamMap[up.Name] = up
 	}
 
-	pluginMap := make(map[string]*config.PluginConfig)
-	for _, p := range pluginConfigs {
-		pluginMap[p.Name] = &p
-	}
-
+	// Resolve the upstream of every route first, so that a failure leaves the current routes untouched
+	var routed []config.RouteConfig
+	var routeUpstreams []config.UpstreamConfig
 	for _, rc := range routeConfigs {
 		upstreamConfig := rc.Upstream
 		if upstreamConfig == nil {
@@ -64,23 +61,31 @@ func (r *Router) UpdateRoutes(routeConfigs []config.RouteConfig, upstreamConfigs
 		if up, exists := upstreamMap[upstreamConfig.Name]; exists {
 			upstreamConfig = &up
 		}
+		routed = append(routed, rc)
+		routeUpstreams = append(routeUpstreams, *upstreamConfig)
+	}
+	ups, err := r.upstreams.Sync(r.listener, routeUpstreams)
+	if err != nil {
+		return err
+	}
 
-		up, err := r.upstreamFactory.NewUpstream(*upstreamConfig)
-		if err != nil {
-			return err
-		}
+	// Clear existing matchers
+	r.pathMatcher.Clear()
+	r.methodMatcher.Clear()
+	r.headerMatcher.Clear()
+	//cleanup plugin
+	for _, p := range r.pluginChain {
+		p.Destroy()
+	}
+	r.pluginChain = []*plugin.Chain{}
 
-		//init service discovery
-		if upstreamConfig.Discovery.Type != "" && r.discoveryManager != nil {
-			errChan := r.discoveryManager.StartDiscovery(up, r.discoveryManager, upstreamConfig.Discovery, upstreamConfig.Service)
-			go func() {
-				for err := range errChan {
-					if err != nil {
-						r.logger.Errorf("Error in discovery for upstream %s: %v", upstreamConfig.Name, err)
-					}
-				}
-			}()
-		}
+	pluginMap := make(map[string]*config.PluginConfig)
+	for _, p := range pluginConfigs {
+		pluginMap[p.Name] = &p
+	}
+
+	for i, rc := range routed {
+		up := ups[i]
 		pluginChain := plugin.NewChain()
 		for _, pCfg := range rc.Plugins {
 			if pluginMap[pCfg.Name] != nil {
@@ -175,13 +180,56 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	if finished {
 		return
 	}
-	node := route.Upstream.SelectNode()
-	if node == nil {
-		http.Error(w, "No available upstream nodes", http.StatusServiceUnavailable)
+	wrappedWriter := route.Plugins.HandleResponse(req, w)
+	r.forward(wrappedWriter, req, route.Upstream)
+}
+
+// forward proxies the request to a node of the upstream, retrying on other nodes when connecting
+// fails and respecting the upstream's circuit breaker thresholds.
+func (r *Router) forward(w http.ResponseWriter, req *http.Request, up *upstream.Upstream) {
+	breaker := up.CircuitBreaker()
+	release, err := breaker.AcquireConnection(req.Context())
+	if err != nil {
+		r.overloaded(w, err)
 		return
 	}
+	defer release()
+
+	opts := proxy.Options{MaxRequestsPerConnection: breaker.MaxRequestsPerConnection(), Scope: up.ID()}
+	for attempt := 0; attempt <= up.Retries(); attempt++ {
+		releaseRetry := func() {}
+		if attempt > 0 {
+			if releaseRetry, err = breaker.AcquireRetry(); err != nil {
+				r.overloaded(w, err)
+				return
+			}
+		}
 
-	wrappedWriter := route.Plugins.HandleResponse(req, w)
-	proxy := proxy.NewReverseProxy(r.logger, r.proxyService, node.URL)
-	proxy.ServeHTTP(wrappedWriter, req)
+		node := up.SelectNode()
+		if node == nil {
+			releaseRetry()
+			http.Error(w, "No available upstream nodes", http.StatusServiceUnavailable)
+			return
+		}
+
+		proxy := proxy.NewReverseProxyWithOptions(r.proxyLogger, r.proxyService, node.URL, opts)
+		err = proxy.Forward(w, req)
+		up.Release(node)
+		releaseRetry()
+		if err == nil {
+			return
+		}
+		r.logger.Warnf("Attempt %d to upstream %s failed: %v", attempt+1, up.Name(), err)
+	}
+	http.Error(w, "Bad Gateway", http.StatusBadGateway)
+}
+
+// overloaded rejects a request that tripped a circuit breaker, telling the client which threshold was hit.
+func (r *Router) overloaded(w http.ResponseWriter, err error) {
+	var overloadedErr *upstream.OverloadedError
+	if errors.As(err, &overloadedErr) {
+		r.logger.Warnf("Rejecting request: %v", err)
+		w.Header().Set(OverloadedHeader, overloadedErr.Threshold)
+	}
+	http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
 }
@@ -1,5 +1,7 @@
 package types
 
+import "net/url"
+
 //TODO: Do I need this types.go?
 
 func RouteEventKey(listenerName string) string {
@@ -13,3 +15,18 @@ func StreamRouteEventKey(listenerName string) string {
 func ServiceDiscoveryEventKey(typ string, serviceName string) string {
 	return "sd_" + typ + "_" + serviceName
 }
+
+// ServiceDiscoveryParamsEventKey is the topic of a service discovered with per upstream parameters, so that
+// upstreams using different parameters for the same service get their own node lists.
+func ServiceDiscoveryParamsEventKey(typ string, serviceName string, params map[string]string) string {
+	key := ServiceDiscoveryEventKey(typ, serviceName)
+	if len(params) == 0 {
+		return key
+	}
+	values := url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+	// Encode sorts by key
+	return key + "?" + values.Encode()
+}
@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/Revolyssup/arp/pkg/config"
+)
+
+// Names of the circuit breaker thresholds, reported back to clients when exceeded.
+const (
+	ThresholdMaxConnections     = "max_connections"
+	ThresholdMaxPendingRequests = "max_pending_requests"
+	ThresholdMaxRetries         = "max_retries"
+)
+
+// OverloadedError is returned when a request is rejected because a circuit breaker threshold is exceeded.
+type OverloadedError struct {
+	Upstream  string
+	Threshold string
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("upstream %s overloaded: %s exceeded", e.Upstream, e.Threshold)
+}
+
+// CircuitBreaker protects an upstream by failing fast once the configured limits are reached.
+// Requests that can't get a connection slot wait as pending until one frees up, as long as
+// there is room in the pending queue.
+type CircuitBreaker struct {
+	upstream                 string
+	maxPendingRequests       int64
+	maxRetries               int64
+	maxRequestsPerConnection int
+
+	slots   chan struct{} // nil when connections are unlimited
+	pending atomic.Int64
+	retries atomic.Int64
+}
+
+func NewCircuitBreaker(upstream string, cfg *config.CircuitBreakerConfig) *CircuitBreaker {
+	cb := &CircuitBreaker{upstream: upstream}
+	if cfg == nil {
+		return cb
+	}
+	cb.maxPendingRequests = int64(cfg.MaxPendingRequests)
+	cb.maxRetries = int64(cfg.MaxRetries)
+	cb.maxRequestsPerConnection = cfg.MaxRequestsPerConnection
+	if cfg.MaxConnections > 0 {
+		cb.slots = make(chan struct{}, cfg.MaxConnections)
+	}
+	return cb
+}
+
+// AcquireConnection reserves a connection slot for a request. The returned release func must be
+// called once the request is finished.
+func (cb *CircuitBreaker) AcquireConnection(ctx context.Context) (release func(), err error) {
+	if cb.slots == nil {
+		return func() {}, nil
+	}
+	release = func() { <-cb.slots }
+
+	select {
+	case cb.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if cb.pending.Add(1) > cb.maxPendingRequests {
+		cb.pending.Add(-1)
+		// Without a pending queue it is the connection limit itself that rejected the request.
+		if cb.maxPendingRequests == 0 {
+			return nil, &OverloadedError{Upstream: cb.upstream, Threshold: ThresholdMaxConnections}
+		}
+		return nil, &OverloadedError{Upstream: cb.upstream, Threshold: ThresholdMaxPendingRequests}
+	}
+	defer cb.pending.Add(-1)
+
+	select {
+	case cb.slots <- struct{}{}:
+		return release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// AcquireRetry reserves one of the concurrent retry slots. The returned release func must be
+// called once the retry attempt is finished.
+func (cb *CircuitBreaker) AcquireRetry() (release func(), err error) {
+	if cb.maxRetries == 0 {
+		return func() {}, nil
+	}
+	if cb.retries.Add(1) > cb.maxRetries {
+		cb.retries.Add(-1)
+		return nil, &OverloadedError{Upstream: cb.upstream, Threshold: ThresholdMaxRetries}
+	}
+	return func() { cb.retries.Add(-1) }, nil
+}
+
+// MaxRequestsPerConnection returns how many requests a pooled connection may serve before it is closed.
+// Zero means unlimited.
+func (cb *CircuitBreaker) MaxRequestsPerConnection() int {
+	return cb.maxRequestsPerConnection
+}
@@ -0,0 +1,115 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+)
+
+func TestCircuitBreakerMaxConnections(t *testing.T) {
+	cb := NewCircuitBreaker("test", &config.CircuitBreakerConfig{MaxConnections: 1})
+
+	release, err := cb.AcquireConnection(context.Background())
+	if err != nil {
+		t.Fatalf("Expected first connection to be admitted, got %v", err)
+	}
+
+	_, err = cb.AcquireConnection(context.Background())
+	var overloaded *OverloadedError
+	if !errors.As(err, &overloaded) || overloaded.Threshold != ThresholdMaxConnections {
+		t.Fatalf("Expected %s to be exceeded, got %v", ThresholdMaxConnections, err)
+	}
+
+	release()
+	release, err = cb.AcquireConnection(context.Background())
+	if err != nil {
+		t.Fatalf("Expected connection to be admitted after release, got %v", err)
+	}
+	release()
+}
+
+func TestCircuitBreakerPendingRequests(t *testing.T) {
+	cb := NewCircuitBreaker("test", &config.CircuitBreakerConfig{MaxConnections: 1, MaxPendingRequests: 1})
+
+	release, err := cb.AcquireConnection(context.Background())
+	if err != nil {
+		t.Fatalf("Expected first connection to be admitted, got %v", err)
+	}
+
+	admitted := make(chan error, 1)
+	go func() {
+		releasePending, err := cb.AcquireConnection(context.Background())
+		if err == nil {
+			releasePending()
+		}
+		admitted <- err
+	}()
+
+	// Wait for the goroutine to be queued as pending
+	deadline := time.Now().Add(time.Second)
+	for cb.pending.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a pending request")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err = cb.AcquireConnection(context.Background())
+	var overloaded *OverloadedError
+	if !errors.As(err, &overloaded) || overloaded.Threshold != ThresholdMaxPendingRequests {
+		t.Fatalf("Expected %s to be exceeded, got %v", ThresholdMaxPendingRequests, err)
+	}
+
+	release()
+	select {
+	case err := <-admitted:
+		if err != nil {
+			t.Errorf("Expected pending request to be admitted, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pending request was not admitted after release")
+	}
+
+	// A pending request gives up when its context is done
+	release, _ = cb.AcquireConnection(context.Background())
+	defer release()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := cb.AcquireConnection(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context deadline error, got %v", err)
+	}
+}
+
+func TestCircuitBreakerMaxRetries(t *testing.T) {
+	cb := NewCircuitBreaker("test", &config.CircuitBreakerConfig{MaxRetries: 1})
+
+	release, err := cb.AcquireRetry()
+	if err != nil {
+		t.Fatalf("Expected first retry to be admitted, got %v", err)
+	}
+	if _, err := cb.AcquireRetry(); err == nil {
+		t.Fatal("Expected second concurrent retry to be rejected")
+	}
+	release()
+	if _, err := cb.AcquireRetry(); err != nil {
+		t.Errorf("Expected retry to be admitted after release, got %v", err)
+	}
+}
+
+func TestCircuitBreakerUnlimited(t *testing.T) {
+	cb := NewCircuitBreaker("test", nil)
+	for i := 0; i < 100; i++ {
+		if _, err := cb.AcquireConnection(context.Background()); err != nil {
+			t.Fatalf("Expected unlimited connections, got %v", err)
+		}
+		if _, err := cb.AcquireRetry(); err != nil {
+			t.Fatalf("Expected unlimited retries, got %v", err)
+		}
+	}
+	if cb.MaxRequestsPerConnection() != 0 {
+		t.Errorf("Expected unlimited requests per connection, got %d", cb.MaxRequestsPerConnection())
+	}
+}
@@ -0,0 +1,247 @@
+package upstream
+
+import (
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+)
+
+// Discoverer keeps an upstream's nodes in sync with a discovered service.
+type Discoverer interface {
+	// Watch feeds the upstream with the service's nodes until the returned stop func is called.
+	Watch(ups *Upstream, ref config.DiscoveryRef, serviceName string) (stop func(), err error)
+}
+
+// Registry shares upstreams between all routes and listeners referencing them. Upstreams
+// survive configuration reloads as long as their configuration doesn't change, so that load
+// balancing state and connections are kept, and are garbage collected together with their
+// discovery watch once nothing references them anymore. Every configuration of an upstream is
+// a separate entry, so that owners still referencing a previous configuration keep a running
+// upstream until they sync or release it.
+type Registry struct {
+	factory    *Factory
+	discoverer Discoverer
+	onCreated  func(*Upstream)
+	onDrained  func(*Upstream, *Node)
+	onRemoved  func(*Upstream)
+	mu         sync.Mutex
+	// entries are keyed by registry key and configuration hash
+	entries map[string]*registryEntry
+	log     *logger.Logger
+}
+
+type registryEntry struct {
+	upstream *Upstream
+	stop     func()
+	owners   map[string]struct{}
+}
+
+func NewRegistry(factory *Factory, discoverer Discoverer, parentLogger *logger.Logger) *Registry {
+	return &Registry{
+		factory:    factory,
+		discoverer: discoverer,
+		onCreated:  func(*Upstream) {},
+		onDrained:  func(*Upstream, *Node) {},
+		onRemoved:  func(*Upstream) {},
+		entries:    make(map[string]*registryEntry),
+		log:        parentLogger.WithComponent("upstream_registry"),
+	}
+}
+
+// OnNodeDrained registers the callback invoked when a node of any upstream of the registry is drained.
+func (r *Registry) OnNodeDrained(fn func(*Upstream, *Node)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onDrained = fn
+}
+
+// OnUpstreamCreated registers the callback invoked when an upstream is created by the registry.
+func (r *Registry) OnUpstreamCreated(fn func(*Upstream)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onCreated = fn
+}
+
+// OnUpstreamRemoved registers the callback invoked when an upstream is removed from the registry, once no owner
+// references it or its configuration anymore.
+func (r *Registry) OnUpstreamRemoved(fn func(*Upstream)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onRemoved = fn
+}
+
+// Sync makes the owner reference exactly the given upstream configurations and returns the
+// upstream for each of them, in order. Upstreams the owner no longer references are released.
+// Upstreams whose configuration changed are only replaced once every new upstream was created,
+// so that a failure leaves the running ones untouched. The upstream of the previous configuration
+// keeps running as long as other owners reference it.
+func (r *Registry) Sync(owner string, cfgs []config.UpstreamConfig) ([]*Upstream, error) {
+	ids := make([]string, len(cfgs))
+	for i, cfg := range cfgs {
+		key, hash, err := registryKey(cfg)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = key + "#" + hash
+	}
+
+	for {
+		// Upstreams are created without holding the lock, as starting their discovery may take a while
+		created, err := r.createMissing(cfgs, ids)
+		if err != nil {
+			return nil, err
+		}
+		if upstreams, ok := r.commit(owner, ids, created); ok {
+			return upstreams, nil
+		}
+		// Another sync removed an upstream in the meantime
+	}
+}
+
+// createMissing creates the upstreams whose configuration has no entry yet, keyed by entry id. On failure,
+// the upstreams already created are discarded.
+func (r *Registry) createMissing(cfgs []config.UpstreamConfig, ids []string) (map[string]*registryEntry, error) {
+	r.mu.Lock()
+	missing := make(map[string]int)
+	for i, id := range ids {
+		if _, exists := r.entries[id]; !exists {
+			missing[id] = i
+		}
+	}
+	r.mu.Unlock()
+
+	created := make(map[string]*registryEntry, len(missing))
+	for id, i := range missing {
+		entry, err := r.newEntry(cfgs[i])
+		if err != nil {
+			r.discard(created)
+			return nil, err
+		}
+		created[id] = entry
+	}
+	return created, nil
+}
+
+// commit makes the owner reference the upstreams, adding the created ones. It returns false without changing
+// anything when an upstream that was expected to exist is gone.
+func (r *Registry) commit(owner string, ids []string, created map[string]*registryEntry) ([]*Upstream, bool) {
+	r.mu.Lock()
+	for _, id := range ids {
+		_, exists := r.entries[id]
+		if _, ok := created[id]; !ok && !exists {
+			r.mu.Unlock()
+			r.discard(created)
+			return nil, false
+		}
+	}
+
+	upstreams := make([]*Upstream, len(ids))
+	referenced := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		entry, exists := r.entries[id]
+		if !exists {
+			entry = created[id]
+			r.entries[id] = entry
+			delete(created, id)
+		}
+		entry.owners[owner] = struct{}{}
+		referenced[id] = true
+		upstreams[i] = entry.upstream
+	}
+
+	var removed []*registryEntry
+	for id, entry := range r.entries {
+		if referenced[id] {
+			continue
+		}
+		if _, owned := entry.owners[owner]; !owned {
+			continue
+		}
+		delete(entry.owners, owner)
+		if len(entry.owners) == 0 {
+			r.log.Infof("Upstream %s is no longer referenced, removing it", entry.upstream.Name())
+			removed = append(removed, entry)
+			delete(r.entries, id)
+		}
+	}
+	onRemoved := r.onRemoved
+	r.mu.Unlock()
+
+	// Upstreams created concurrently by another sync with the same configuration are left over
+	r.discard(created)
+	for _, entry := range removed {
+		entry.stop()
+		onRemoved(entry.upstream)
+	}
+	return upstreams, true
+}
+
+// discard stops upstreams that were created but never used.
+func (r *Registry) discard(entries map[string]*registryEntry) {
+	r.mu.Lock()
+	onRemoved := r.onRemoved
+	r.mu.Unlock()
+	for _, entry := range entries {
+		entry.stop()
+		onRemoved(entry.upstream)
+	}
+}
+
+// Release drops every reference held by the owner.
+func (r *Registry) Release(owner string) {
+	r.Sync(owner, nil)
+}
+
+// Len returns the number of live upstreams.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+func (r *Registry) newEntry(cfg config.UpstreamConfig) (*registryEntry, error) {
+	up, err := r.factory.NewUpstream(cfg)
+	if err != nil {
+		return nil, err
+	}
+	up.OnNodeDrained(func(node *Node) {
+		r.mu.Lock()
+		onDrained := r.onDrained
+		r.mu.Unlock()
+		onDrained(up, node)
+	})
+
+	stop := func() {}
+	if cfg.Discovery.Type != "" && r.discoverer != nil {
+		if stop, err = r.discoverer.Watch(up, cfg.Discovery, cfg.Service); err != nil {
+			return nil, fmt.Errorf("failed to start discovery for upstream %s: %w", cfg.Name, err)
+		}
+	}
+	r.mu.Lock()
+	onCreated := r.onCreated
+	r.mu.Unlock()
+	onCreated(up)
+	return &registryEntry{
+		upstream: up,
+		stop:     stop,
+		owners:   make(map[string]struct{}),
+	}, nil
+}
+
+// registryKey identifies upstreams by name. Inline upstreams without a name are identified
+// by their configuration, so identical ones are shared as well.
+func registryKey(cfg config.UpstreamConfig) (key string, hash string, err error) {
+	configBytes, err := json.Marshal(cfg)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to hash upstream %s: %w", cfg.Name, err)
+	}
+	hash = fmt.Sprintf("%x", md5.Sum(configBytes))
+	if cfg.Name != "" {
+		return cfg.Name, hash, nil
+	}
+	return "inline_" + hash, hash, nil
+}
@@ -0,0 +1,186 @@
+package upstream
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+)
+
+type fakeDiscoverer struct {
+	watching map[string]int
+}
+
+func (f *fakeDiscoverer) Watch(ups *Upstream, ref config.DiscoveryRef, serviceName string) (func(), error) {
+	f.watching[serviceName]++
+	return func() { f.watching[serviceName]-- }, nil
+}
+
+func TestRegistrySharesUpstreams(t *testing.T) {
+	discoverer := &fakeDiscoverer{watching: make(map[string]int)}
+	registry := NewRegistry(NewFactory(), discoverer, logger.New(logger.LevelInfo))
+
+	backend := config.UpstreamConfig{Name: "backend", Nodes: []config.Node{{URL: "http://localhost:8080"}}}
+	discovered := config.UpstreamConfig{Service: "ip", Discovery: config.DiscoveryRef{Type: "demo"}}
+
+	first, err := registry.Sync("listener1", []config.UpstreamConfig{backend, discovered, backend})
+	if err != nil {
+		t.Fatalf("Failed to sync upstreams: %v", err)
+	}
+	if first[0] != first[2] {
+		t.Error("Expected routes referencing the same upstream to share it")
+	}
+
+	second, err := registry.Sync("listener2", []config.UpstreamConfig{backend, discovered})
+	if err != nil {
+		t.Fatalf("Failed to sync upstreams: %v", err)
+	}
+	if second[0] != first[0] || second[1] != first[1] {
+		t.Error("Expected listeners to share upstreams")
+	}
+	if discoverer.watching["ip"] != 1 {
+		t.Errorf("Expected a single discovery watch, got %d", discoverer.watching["ip"])
+	}
+
+	// Reloading an unchanged configuration keeps the upstream
+	reloaded, err := registry.Sync("listener1", []config.UpstreamConfig{backend, discovered})
+	if err != nil {
+		t.Fatalf("Failed to sync upstreams: %v", err)
+	}
+	if reloaded[0] != first[0] || reloaded[1] != first[1] {
+		t.Error("Expected unchanged upstreams to be kept across reloads")
+	}
+
+	// Changing the configuration replaces the upstream
+	backend.Retries = 1
+	changed, err := registry.Sync("listener1", []config.UpstreamConfig{backend})
+	if err != nil {
+		t.Fatalf("Failed to sync upstreams: %v", err)
+	}
+	if changed[0] == first[0] {
+		t.Error("Expected changed upstream to be replaced")
+	}
+	if discoverer.watching["ip"] != 1 {
+		t.Errorf("Expected discovery to be kept while listener2 references it, got %d watches", discoverer.watching["ip"])
+	}
+
+	registry.Release("listener2")
+	if discoverer.watching["ip"] != 0 {
+		t.Errorf("Expected discovery watch to be stopped, got %d", discoverer.watching["ip"])
+	}
+	if registry.Len() != 1 {
+		t.Errorf("Expected only backend to be left, got %d upstreams", registry.Len())
+	}
+
+	registry.Release("listener1")
+	if registry.Len() != 0 {
+		t.Errorf("Expected all upstreams to be removed, got %d", registry.Len())
+	}
+}
+
+func TestRegistryLifecycleCallbacks(t *testing.T) {
+	registry := NewRegistry(NewFactory(), nil, logger.New(logger.LevelInfo))
+	live := make(map[string]bool)
+	registry.OnUpstreamCreated(func(up *Upstream) { live[up.ID()] = true })
+	registry.OnUpstreamRemoved(func(up *Upstream) { delete(live, up.ID()) })
+
+	backend := config.UpstreamConfig{Name: "backend", Nodes: []config.Node{{URL: "http://localhost:8080"}}}
+	first, _ := registry.Sync("listener1", []config.UpstreamConfig{backend})
+	backend.Retries = 2
+	second, _ := registry.Sync("listener1", []config.UpstreamConfig{backend})
+	if first[0].ID() == second[0].ID() {
+		t.Fatal("Expected a replaced upstream to get a new ID")
+	}
+	if len(live) != 1 || !live[second[0].ID()] {
+		t.Errorf("Expected only the replacing upstream to be live, got %v", live)
+	}
+
+	registry.Release("listener1")
+	if len(live) != 0 {
+		t.Errorf("Expected released upstreams to be removed, got %v", live)
+	}
+}
+
+type failingDiscoverer struct {
+	fakeDiscoverer
+	fail string
+}
+
+func (f *failingDiscoverer) Watch(ups *Upstream, ref config.DiscoveryRef, serviceName string) (func(), error) {
+	if serviceName == f.fail {
+		return nil, fmt.Errorf("discovery of %s failed", serviceName)
+	}
+	return f.fakeDiscoverer.Watch(ups, ref, serviceName)
+}
+
+func TestRegistrySyncFailureKeepsUpstreams(t *testing.T) {
+	discoverer := &failingDiscoverer{fakeDiscoverer: fakeDiscoverer{watching: make(map[string]int)}}
+	registry := NewRegistry(NewFactory(), discoverer, logger.New(logger.LevelInfo))
+
+	web := config.UpstreamConfig{Name: "web", Service: "web", Discovery: config.DiscoveryRef{Type: "demo"}}
+	before, err := registry.Sync("listener1", []config.UpstreamConfig{web})
+	if err != nil {
+		t.Fatalf("Failed to sync upstreams: %v", err)
+	}
+
+	// The changed upstream comes first, the failing one afterwards
+	web.Retries = 1
+	discoverer.fail = "api"
+	api := config.UpstreamConfig{Name: "api", Service: "api", Discovery: config.DiscoveryRef{Type: "demo"}}
+	if _, err := registry.Sync("listener1", []config.UpstreamConfig{web, api}); err == nil {
+		t.Fatal("Expected sync to fail")
+	}
+	if discoverer.watching["web"] != 1 {
+		t.Errorf("Expected the running upstream to keep its single watch, got %d watches", discoverer.watching["web"])
+	}
+
+	discoverer.fail = ""
+	after, err := registry.Sync("listener1", []config.UpstreamConfig{web, api})
+	if err != nil {
+		t.Fatalf("Failed to sync upstreams: %v", err)
+	}
+	if after[0] == before[0] || discoverer.watching["web"] != 1 || registry.Len() != 2 {
+		t.Errorf("Expected web to be replaced once sync succeeds, got %d watches and %d upstreams", discoverer.watching["web"], registry.Len())
+	}
+}
+
+func TestRegistryKeepsPreviousConfigurationForOtherOwners(t *testing.T) {
+	discoverer := &fakeDiscoverer{watching: make(map[string]int)}
+	registry := NewRegistry(NewFactory(), discoverer, logger.New(logger.LevelInfo))
+	live := make(map[string]bool)
+	registry.OnUpstreamCreated(func(up *Upstream) { live[up.ID()] = true })
+	registry.OnUpstreamRemoved(func(up *Upstream) { delete(live, up.ID()) })
+
+	web := config.UpstreamConfig{Name: "web", Service: "web", Discovery: config.DiscoveryRef{Type: "demo"},
+		Nodes: []config.Node{{URL: "http://localhost:8080"}}}
+	first, _ := registry.Sync("listener1", []config.UpstreamConfig{web})
+	second, _ := registry.Sync("listener2", []config.UpstreamConfig{web})
+	if first[0] != second[0] {
+		t.Fatal("Expected listeners to share the upstream")
+	}
+
+	// listener1 moves to the new configuration while listener2 still routes to the previous one
+	web.Retries = 1
+	changed, err := registry.Sync("listener1", []config.UpstreamConfig{web})
+	if err != nil {
+		t.Fatalf("Failed to sync upstreams: %v", err)
+	}
+	if changed[0] == second[0] {
+		t.Fatal("Expected changed configuration to get its own upstream")
+	}
+	if !live[second[0].ID()] || discoverer.watching["web"] != 2 {
+		t.Errorf("Expected the previous upstream to keep running, got live %v and %d watches", live, discoverer.watching["web"])
+	}
+	node := second[0].SelectNode()
+	if node == nil {
+		t.Fatal("Expected the previous upstream to still select nodes")
+	}
+	second[0].Release(node)
+
+	// The previous upstream is removed once its last owner moves on
+	moved, _ := registry.Sync("listener2", []config.UpstreamConfig{web})
+	if moved[0] != changed[0] || live[second[0].ID()] || discoverer.watching["web"] != 1 || registry.Len() != 1 {
+		t.Errorf("Expected only the new upstream to be left, got live %v and %d watches", live, discoverer.watching["web"])
+	}
+}
@@ -3,24 +3,64 @@ package upstream
 import (
 	"fmt"
 	"net/url"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Revolyssup/arp/pkg/config"
 )
 
 const LoadBalancerRoundRobin = "round_robin"
 
+const (
+	// DefaultDrainTimeout is used when an upstream doesn't configure how long removed nodes may drain.
+	DefaultDrainTimeout = 30 * time.Second
+	// slowStartMinPercent is the share of its weight a node gets right after being added.
+	slowStartMinPercent = 10
+	// weightScale gives slow start enough resolution when ramping small integer weights.
+	weightScale = 100
+)
+
+// upstreamIDs numbers the upstreams created, see Upstream.ID
+var upstreamIDs atomic.Uint64
+
 type Upstream struct {
+	id     string
 	name   string
 	lbType string
 	nodes  []*Node
-	mu     sync.RWMutex
-	// For load balancing
-	currentIndex int
+	// Static nodes used when the discovery reports no node
+	fallback     []*Node
+	retries      int
+	breaker      *CircuitBreaker
+	slowStart    time.Duration
+	drainTimeout time.Duration
+	// Zone preferred by the upstream and the share of its nodes that must be healthy to keep traffic local
+	localZone         string
+	minHealthyPercent int
+	mu                sync.Mutex
+	// Removed nodes that still have requests in flight, keyed by URL
+	draining  map[string]*Node
+	onDrained func(*Node)
 }
+
 type Node struct {
 	ServiceName string
 	URL         *url.URL
+	Weight      int
+	Zone        string
+	Priority    int
+	Labels      map[string]string
+	// Unhealthy nodes are only picked when no node of the upstream is healthy
+	Unhealthy bool
+
+	// State owned by the upstream the node belongs to
+	addedAt       time.Time
+	currentWeight int
+	inflight      atomic.Int64
+	draining      atomic.Bool
+	drainTimer    *time.Timer
 }
 
 type Factory struct{}
@@ -33,51 +73,287 @@ func (f *Factory) NewUpstream(upsConf config.UpstreamConfig) (*Upstream, error)
 	return newUpstream(upsConf)
 }
 
-// TODO: Implement garbage collection for upstream related nodeevents and healthcheck
+// TODO: Implement active health checks
 func newUpstream(upsConf config.UpstreamConfig) (*Upstream, error) {
 	u := &Upstream{
-		name:   upsConf.Name,
-		lbType: upsConf.Type,
+		id:           upsConf.Name + "#" + strconv.FormatUint(upstreamIDs.Add(1), 10),
+		name:         upsConf.Name,
+		lbType:       upsConf.Type,
+		retries:      upsConf.Retries,
+		breaker:      NewCircuitBreaker(upsConf.Name, upsConf.CircuitBreaker),
+		drainTimeout: DefaultDrainTimeout,
+		draining:     make(map[string]*Node),
+		onDrained:    func(*Node) {},
 	}
 	if u.lbType == "" {
 		u.lbType = LoadBalancerRoundRobin
 	}
+	if upsConf.Locality != nil {
+		u.localZone = upsConf.Locality.Zone
+		u.minHealthyPercent = upsConf.Locality.MinHealthyPercent
+	}
+	if upsConf.SlowStart != "" {
+		d, err := time.ParseDuration(upsConf.SlowStart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid slowStart %s: %v", upsConf.SlowStart, err)
+		}
+		u.slowStart = d
+	}
+	if upsConf.DrainTimeout != "" {
+		d, err := time.ParseDuration(upsConf.DrainTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid drainTimeout %s: %v", upsConf.DrainTimeout, err)
+		}
+		u.drainTimeout = d
+	}
 	// Parse node URLs
 	for _, nodeConfig := range upsConf.Nodes {
-		parsedURL, err := url.Parse(nodeConfig.URL)
+		node, err := NewNode(nodeConfig)
 		if err != nil {
-			return nil, fmt.Errorf("invalid node URL %s: %v", nodeConfig.URL, err)
+			return nil, err
+		}
+		u.nodes = append(u.nodes, node)
+		if upsConf.Discovery.Type != "" {
+			// Kept apart from the live nodes, which hold per node state
+			fallback, _ := NewNode(nodeConfig)
+			u.fallback = append(u.fallback, fallback)
 		}
-		u.nodes = append(u.nodes, &Node{
-			URL: parsedURL,
-		})
 	}
 	return u, nil
 }
 
+// NewNode creates a node from its configuration.
+func NewNode(nodeConfig config.Node) (*Node, error) {
+	parsedURL, err := url.Parse(nodeConfig.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid node URL %s: %v", nodeConfig.URL, err)
+	}
+	return &Node{
+		URL:      parsedURL,
+		Weight:   nodeConfig.Weight,
+		Zone:     nodeConfig.Zone,
+		Priority: nodeConfig.Priority,
+		Labels:   nodeConfig.Labels,
+	}, nil
+}
+
+// SelectNode picks the next node using smooth weighted round robin among the candidates of the
+// highest priority level, preferring the local zone. Every selected node must be handed back
+// with Release once the request is done, so that draining nodes know when they are idle.
 func (u *Upstream) SelectNode() *Node {
-	u.mu.RLock()
-	defer u.mu.RUnlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
 
 	if len(u.nodes) == 0 {
 		return nil
 	}
 
-	if u.lbType == LoadBalancerRoundRobin {
-		node := u.nodes[u.currentIndex]
-		u.currentIndex = (u.currentIndex + 1) % len(u.nodes)
-		return node
+	if u.lbType != LoadBalancerRoundRobin {
+		return nil // Unsupported load balancer type
 	}
-	return nil // Unsupported load balancer type
+
+	now := time.Now()
+	total := 0
+	var selected *Node
+	for _, node := range u.candidatesLocked() {
+		weight := u.effectiveWeight(node, now)
+		node.currentWeight += weight
+		total += weight
+		if selected == nil || node.currentWeight > selected.currentWeight {
+			selected = node
+		}
+	}
+	selected.currentWeight -= total
+	selected.inflight.Add(1)
+	return selected
 }
 
-func (u *Upstream) UpdateNodes(nodes []*Node) {
+// candidatesLocked returns the nodes eligible for the next request. Only healthy nodes of the
+// highest priority level having any are considered, narrowed down to the local zone as long as
+// enough of its nodes are healthy. If no node is healthy at all, every node is a candidate since
+// failing over to a possibly unhealthy node beats failing the request.
+func (u *Upstream) candidatesLocked() []*Node {
+	priority := -1
+	for _, node := range u.nodes {
+		if !node.Unhealthy && (priority == -1 || node.Priority < priority) {
+			priority = node.Priority
+		}
+	}
+	if priority == -1 {
+		return u.nodes
+	}
+
+	var level, local []*Node
+	localTotal := 0
+	for _, node := range u.nodes {
+		if node.Priority != priority {
+			continue
+		}
+		isLocal := u.localZone != "" && node.Zone == u.localZone
+		if isLocal {
+			localTotal++
+		}
+		if node.Unhealthy {
+			continue
+		}
+		level = append(level, node)
+		if isLocal {
+			local = append(local, node)
+		}
+	}
+
+	if len(local) > 0 && len(local)*100 >= u.minHealthyPercent*localTotal {
+		return local
+	}
+	return level
+}
+
+// Release marks a request to the node as finished.
+func (u *Upstream) Release(node *Node) {
+	if node.inflight.Add(-1) > 0 || !node.draining.Load() {
+		return
+	}
+	u.drain(node)
+}
+
+// OnNodeDrained registers a callback invoked once a removed node has no requests in flight
+// anymore or its drain timeout expired.
+func (u *Upstream) OnNodeDrained(fn func(*Node)) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	u.nodes = nodes
-	u.currentIndex = 0
+	u.onDrained = fn
+}
+
+// UpdateNodes replaces the set of nodes. Nodes that are still present keep their load balancing
+// state, new nodes ramp up over the slow start window and removed nodes are drained. An empty set
+// falls back to the static nodes configured next to the discovery, if any.
+func (u *Upstream) UpdateNodes(nodes []*Node) {
+	u.mu.Lock()
+	if len(nodes) == 0 {
+		nodes = u.fallback
+	}
+	now := time.Now()
+	// Nodes added to an upstream that isn't serving traffic yet have nothing to ramp up against.
+	rampUp := u.slowStart > 0 && len(u.nodes) > 0
+
+	current := make(map[string]*Node, len(u.nodes))
+	for _, node := range u.nodes {
+		current[node.URL.String()] = node
+	}
+
+	// The published nodes are shared by every subscriber of the service, so the upstream
+	// keeps its own copies to hold per node state.
+	updated := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		key := n.URL.String()
+		node, exists := current[key]
+		if exists {
+			delete(current, key)
+		} else if node, exists = u.draining[key]; exists {
+			// Came back while draining, serve it again
+			u.finishDrainLocked(node)
+			node.addedAt = now
+		} else {
+			node = &Node{URL: n.URL}
+			if rampUp {
+				node.addedAt = now
+			}
+		}
+		node.ServiceName = n.ServiceName
+		node.Weight = n.Weight
+		node.Zone = n.Zone
+		node.Priority = n.Priority
+		node.Labels = n.Labels
+		node.Unhealthy = n.Unhealthy
+		updated = append(updated, node)
+	}
+	u.nodes = updated
+
+	var drained []*Node
+	for key, node := range current {
+		node.currentWeight = 0
+		// Mark the node draining before looking at its in-flight requests, so that a concurrent
+		// Release either sees the flag or leaves the last request for us to notice.
+		node.draining.Store(true)
+		u.draining[key] = node
+		if node.inflight.Load() == 0 {
+			u.finishDrainLocked(node)
+			drained = append(drained, node)
+			continue
+		}
+		node.drainTimer = time.AfterFunc(u.drainTimeout, func() { u.drain(node) })
+	}
+	onDrained := u.onDrained
+	u.mu.Unlock()
+
+	for _, node := range drained {
+		onDrained(node)
+	}
+}
+
+// drain finishes draining the node and notifies the drain callback, unless the node
+// was already drained or has been added back in the meantime.
+func (u *Upstream) drain(node *Node) {
+	u.mu.Lock()
+	drained := u.finishDrainLocked(node)
+	onDrained := u.onDrained
+	u.mu.Unlock()
+	if drained {
+		onDrained(node)
+	}
+}
+
+// finishDrainLocked removes the node from the draining set, reporting whether it was draining.
+func (u *Upstream) finishDrainLocked(node *Node) bool {
+	key := node.URL.String()
+	if u.draining[key] != node {
+		return false
+	}
+	delete(u.draining, key)
+	node.draining.Store(false)
+	if node.drainTimer != nil {
+		node.drainTimer.Stop()
+		node.drainTimer = nil
+	}
+	return true
+}
+
+// effectiveWeight scales the node's weight, ramping it linearly during slow start.
+func (u *Upstream) effectiveWeight(node *Node, now time.Time) int {
+	weight := node.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	weight *= weightScale
+	if node.addedAt.IsZero() || u.slowStart == 0 {
+		return weight
+	}
+	elapsed := now.Sub(node.addedAt)
+	if elapsed >= u.slowStart {
+		node.addedAt = time.Time{}
+		return weight
+	}
+	percent := int(elapsed * 100 / u.slowStart)
+	if percent < slowStartMinPercent {
+		percent = slowStartMinPercent
+	}
+	return max(1, weight*percent/100)
 }
 
 func (u *Upstream) Name() string {
 	return u.name
 }
+
+// ID identifies this instance of the upstream, a new one being created when its configuration changes.
+func (u *Upstream) ID() string {
+	return u.id
+}
+
+// Retries returns how many times a request may be retried on another node when connecting fails.
+func (u *Upstream) Retries() int {
+	return u.retries
+}
+
+func (u *Upstream) CircuitBreaker() *CircuitBreaker {
+	return u.breaker
+}
@@ -1,7 +1,9 @@
 package upstream
 
 import (
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/Revolyssup/arp/pkg/config"
 )
@@ -47,3 +49,253 @@ func TestUpstream(t *testing.T) {
 		t.Errorf("Expected third node to be %v, got %v", up.nodes[0], thirdNode)
 	}
 }
+
+func mustParseNodes(t *testing.T, urls ...string) []*Node {
+	t.Helper()
+	nodes := make([]*Node, 0, len(urls))
+	for _, raw := range urls {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", raw, err)
+		}
+		nodes = append(nodes, &Node{URL: u})
+	}
+	return nodes
+}
+
+func TestUpstreamWeightedSelection(t *testing.T) {
+	up, err := NewFactory().NewUpstream(config.UpstreamConfig{
+		Name: "weighted",
+		Nodes: []config.Node{
+			{URL: "http://localhost:8080", Weight: 3},
+			{URL: "http://localhost:8081", Weight: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create upstream: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		node := up.SelectNode()
+		counts[node.URL.Host]++
+		up.Release(node)
+	}
+	if counts["localhost:8080"] != 6 || counts["localhost:8081"] != 2 {
+		t.Errorf("Expected a 3:1 split, got %v", counts)
+	}
+}
+
+func TestUpstreamSlowStart(t *testing.T) {
+	up, err := NewFactory().NewUpstream(config.UpstreamConfig{
+		Name:      "slow-start",
+		SlowStart: "10s",
+		Nodes:     []config.Node{{URL: "http://localhost:8080"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create upstream: %v", err)
+	}
+
+	up.UpdateNodes(mustParseNodes(t, "http://localhost:8080", "http://localhost:8081"))
+	existing, added := up.nodes[0], up.nodes[1]
+	if !existing.addedAt.IsZero() {
+		t.Error("Expected existing node to keep its full weight")
+	}
+
+	now := time.Now()
+	if w := up.effectiveWeight(added, now); w != weightScale*slowStartMinPercent/100 {
+		t.Errorf("Expected new node to start at %d%% weight, got %d", slowStartMinPercent, w)
+	}
+	if w := up.effectiveWeight(added, added.addedAt.Add(5*time.Second)); w != weightScale/2 {
+		t.Errorf("Expected new node to be at half weight halfway through slow start, got %d", w)
+	}
+	if w := up.effectiveWeight(added, added.addedAt.Add(10*time.Second)); w != weightScale {
+		t.Errorf("Expected new node at full weight after slow start, got %d", w)
+	}
+}
+
+func TestUpstreamDrainsRemovedNodes(t *testing.T) {
+	up, err := NewFactory().NewUpstream(config.UpstreamConfig{
+		Name:  "draining",
+		Nodes: []config.Node{{URL: "http://localhost:8080"}, {URL: "http://localhost:8081"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create upstream: %v", err)
+	}
+	drained := make(chan *Node, 2)
+	up.OnNodeDrained(func(n *Node) { drained <- n })
+
+	busy := up.SelectNode() // localhost:8080 has a request in flight
+	up.UpdateNodes(mustParseNodes(t, "http://localhost:8082"))
+
+	select {
+	case n := <-drained:
+		if n.URL.Host != "localhost:8081" {
+			t.Errorf("Expected idle node to be drained immediately, got %s", n.URL.Host)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected idle node to be drained immediately")
+	}
+
+	if node := up.SelectNode(); node.URL.Host != "localhost:8082" {
+		t.Errorf("Expected only the new node to be selected, got %s", node.URL.Host)
+	}
+
+	select {
+	case n := <-drained:
+		t.Fatalf("Node %s drained while a request was in flight", n.URL.Host)
+	default:
+	}
+
+	up.Release(busy)
+	select {
+	case n := <-drained:
+		if n != busy {
+			t.Errorf("Expected busy node to be drained, got %s", n.URL.Host)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected busy node to be drained once its request finished")
+	}
+}
+
+func TestUpstreamDrainTimeout(t *testing.T) {
+	up, err := NewFactory().NewUpstream(config.UpstreamConfig{
+		Name:         "drain-timeout",
+		DrainTimeout: "10ms",
+		Nodes:        []config.Node{{URL: "http://localhost:8080"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create upstream: %v", err)
+	}
+	drained := make(chan *Node, 1)
+	up.OnNodeDrained(func(n *Node) { drained <- n })
+
+	busy := up.SelectNode()
+	up.UpdateNodes(nil)
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("Expected node to be drained after the drain timeout")
+	}
+	// Finishing the request later must not report the node twice
+	up.Release(busy)
+	select {
+	case <-drained:
+		t.Error("Node drained twice")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestUpstreamPriorityFailover(t *testing.T) {
+	up, err := NewFactory().NewUpstream(config.UpstreamConfig{
+		Name: "failover",
+		Nodes: []config.Node{
+			{URL: "http://active:8080"},
+			{URL: "http://standby:8080", Priority: 1},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create upstream: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if node := up.SelectNode(); node.URL.Host != "active:8080" {
+			t.Fatalf("Expected active node while it is healthy, got %s", node.URL.Host)
+		}
+	}
+
+	nodes := mustParseNodes(t, "http://active:8080", "http://standby:8080")
+	nodes[0].Unhealthy = true
+	nodes[1].Priority = 1
+	up.UpdateNodes(nodes)
+	if node := up.SelectNode(); node.URL.Host != "standby:8080" {
+		t.Errorf("Expected standby node once the active one is unhealthy, got %s", node.URL.Host)
+	}
+
+	nodes[1].Unhealthy = true
+	up.UpdateNodes(nodes)
+	if node := up.SelectNode(); node == nil {
+		t.Error("Expected a node to be selected even when none is healthy")
+	}
+}
+
+func TestUpstreamZoneAwareRouting(t *testing.T) {
+	up, err := NewFactory().NewUpstream(config.UpstreamConfig{
+		Name:     "zones",
+		Locality: &config.LocalityConfig{Zone: "a", MinHealthyPercent: 50},
+		Nodes: []config.Node{
+			{URL: "http://a1:8080", Zone: "a"},
+			{URL: "http://a2:8080", Zone: "a"},
+			{URL: "http://a3:8080", Zone: "a"},
+			{URL: "http://b1:8080", Zone: "b"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create upstream: %v", err)
+	}
+
+	zones := func() map[string]int {
+		seen := make(map[string]int)
+		for i := 0; i < 12; i++ {
+			node := up.SelectNode()
+			seen[node.Zone]++
+			up.Release(node)
+		}
+		return seen
+	}
+
+	if seen := zones(); seen["b"] != 0 {
+		t.Errorf("Expected all traffic to stay local, got %v", seen)
+	}
+
+	// 2 of 3 local nodes healthy is still above the threshold
+	nodes := mustParseNodes(t, "http://a1:8080", "http://a2:8080", "http://a3:8080", "http://b1:8080")
+	for i, zone := range []string{"a", "a", "a", "b"} {
+		nodes[i].Zone = zone
+	}
+	nodes[0].Unhealthy = true
+	up.UpdateNodes(nodes)
+	if seen := zones(); seen["b"] != 0 {
+		t.Errorf("Expected traffic to stay local above the threshold, got %v", seen)
+	}
+
+	// 1 of 3 local nodes healthy spills over to the other zone
+	nodes[1].Unhealthy = true
+	up.UpdateNodes(nodes)
+	if seen := zones(); seen["a"] == 0 || seen["b"] == 0 {
+		t.Errorf("Expected traffic to spill over to zone b, got %v", seen)
+	}
+}
+
+func TestUpstreamStaticFallback(t *testing.T) {
+	up, err := NewFactory().NewUpstream(config.UpstreamConfig{
+		Name:      "fallback",
+		Service:   "web",
+		Discovery: config.DiscoveryRef{Type: "demo"},
+		Nodes:     []config.Node{{URL: "http://static:8080"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create upstream: %v", err)
+	}
+	selectHost := func() string {
+		node := up.SelectNode()
+		if node == nil {
+			return ""
+		}
+		up.Release(node)
+		return node.URL.Host
+	}
+
+	if host := selectHost(); host != "static:8080" {
+		t.Errorf("Expected static node before discovery reports, got %q", host)
+	}
+	up.UpdateNodes(mustParseNodes(t, "http://discovered:8080"))
+	if host := selectHost(); host != "discovered:8080" {
+		t.Errorf("Expected discovered node, got %q", host)
+	}
+	up.UpdateNodes(nil)
+	if host := selectHost(); host != "static:8080" {
+		t.Errorf("Expected static node when discovery reports none, got %q", host)
+	}
+}
@@ -0,0 +1,121 @@
+package watcher
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Revolyssup/arp/pkg/config"
+)
+
+// NamespaceSeparator separates the name of an object from the provider it comes from, like route@file.
+const NamespaceSeparator = "@"
+
+// providerUpdate is a configuration sent by the provider with the given name.
+type providerUpdate struct {
+	provider string
+	cfg      config.Dynamic
+}
+
+// qualify returns the name in the namespace of the provider. Names already qualified reference an object of
+// another provider and are kept as is.
+func qualify(name, provider string) string {
+	if name == "" || strings.Contains(name, NamespaceSeparator) {
+		return name
+	}
+	return name + NamespaceSeparator + provider
+}
+
+// namespace qualifies the names of the objects defined by the provider, along with the names they reference,
+// so that providers can't clash with each other. Objects can't be defined with a qualified name, which would
+// let a provider define them in the namespace of another one.
+func namespace(cfg config.Dynamic, provider string) (config.Dynamic, error) {
+	var errs []string
+	define := func(kind string, i int, name string) string {
+		if strings.Contains(name, NamespaceSeparator) {
+			errs = append(errs, fmt.Sprintf("%s[%d]: name %q cannot contain %q", kind, i, name, NamespaceSeparator))
+		}
+		return qualify(name, provider)
+	}
+
+	qualified := config.Dynamic{
+		Routes:      make([]config.RouteConfig, len(cfg.Routes)),
+		Upstreams:   make([]config.UpstreamConfig, len(cfg.Upstreams)),
+		Plugins:     make([]config.PluginConfig, len(cfg.Plugins)),
+		StreamRoute: make([]config.StreamRouteConfig, len(cfg.StreamRoute)),
+	}
+	for i, route := range cfg.Routes {
+		route.Name = define("routes", i, route.Name)
+		route.Upstream = qualifyUpstream(route.Upstream, provider)
+		route.Plugins = qualifyPlugins(route.Plugins, provider)
+		qualified.Routes[i] = route
+	}
+	for i, upstream := range cfg.Upstreams {
+		upstream.Name = define("upstreams", i, upstream.Name)
+		qualified.Upstreams[i] = upstream
+	}
+	for i, plugin := range cfg.Plugins {
+		plugin.Name = define("plugins", i, plugin.Name)
+		qualified.Plugins[i] = plugin
+	}
+	for i, streamRoute := range cfg.StreamRoute {
+		streamRoute.Name = define("streamRoutes", i, streamRoute.Name)
+		streamRoute.Upstream = qualifyUpstream(streamRoute.Upstream, provider)
+		streamRoute.Plugins = qualifyPlugins(streamRoute.Plugins, provider)
+		qualified.StreamRoute[i] = streamRoute
+	}
+	if len(errs) > 0 {
+		return config.Dynamic{}, fmt.Errorf("invalid config from provider %s: %s", provider, strings.Join(errs, "; "))
+	}
+	return qualified, nil
+}
+
+func qualifyUpstream(upstream *config.UpstreamConfig, provider string) *config.UpstreamConfig {
+	if upstream == nil {
+		return nil
+	}
+	qualified := *upstream
+	qualified.Name = qualify(upstream.Name, provider)
+	return &qualified
+}
+
+func qualifyPlugins(plugins []config.PluginConfig, provider string) []config.PluginConfig {
+	if plugins == nil {
+		return nil
+	}
+	qualified := make([]config.PluginConfig, len(plugins))
+	for i, plugin := range plugins {
+		plugin.Name = qualify(plugin.Name, provider)
+		qualified[i] = plugin
+	}
+	return qualified
+}
+
+// mergeProviders namespaces the configuration of every provider and merges them. The configurations must have
+// been validated.
+func mergeProviders(configs map[string]config.Dynamic) config.Dynamic {
+	namespaced := make(map[string]config.Dynamic, len(configs))
+	for provider, cfg := range configs {
+		namespaced[provider], _ = namespace(cfg, provider)
+	}
+	return merge(namespaced)
+}
+
+// merge concatenates the namespaced configurations of every provider, ordered by provider name.
+func merge(configs map[string]config.Dynamic) config.Dynamic {
+	providers := make([]string, 0, len(configs))
+	for provider := range configs {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	var merged config.Dynamic
+	for _, provider := range providers {
+		cfg := configs[provider]
+		merged.Routes = append(merged.Routes, cfg.Routes...)
+		merged.Upstreams = append(merged.Upstreams, cfg.Upstreams...)
+		merged.Plugins = append(merged.Plugins, cfg.Plugins...)
+		merged.StreamRoute = append(merged.StreamRoute, cfg.StreamRoute...)
+	}
+	return merged
+}
@@ -2,24 +2,44 @@ package watcher
 
 import (
 	"context"
+	"fmt"
+	"sync"
 
 	"github.com/Revolyssup/arp/pkg/config"
 	"github.com/Revolyssup/arp/pkg/logger"
 	"github.com/Revolyssup/arp/pkg/provider"
+	"github.com/Revolyssup/arp/pkg/provider/api"
+	"github.com/Revolyssup/arp/pkg/provider/docker"
+	"github.com/Revolyssup/arp/pkg/provider/etcd"
 	"github.com/Revolyssup/arp/pkg/provider/file"
+	httpprovider "github.com/Revolyssup/arp/pkg/provider/http"
 )
 
 // Provider-> Watcher -> Processor
-// Watcher is mainly responsbile for throttling.
+// Watcher is mainly responsbile for throttling, and for merging the configurations of every provider with
+// the names of their objects qualified by the provider name.
 type Processor interface {
 	Process(config.Dynamic)
 }
 
+// validatingProvider is implemented by providers validating the changes they accept before sending them.
+type validatingProvider interface {
+	SetListeners(listeners []config.ListenerConfig)
+	SetDiscoveryReferenceValidator(fn config.DiscoveryReferenceValidator)
+}
+
 type Watcher struct {
-	receiveChan chan config.Dynamic
+	receiveChan chan providerUpdate
 	applyChan   chan config.Dynamic
 	Processor   Processor
 	logger      *logger.Logger
+
+	mu        sync.Mutex
+	validator *config.DynamicValidator
+	// validatingProviders holds the providers validating their own changes, like the api provider
+	validatingProviders []validatingProvider
+	// revalidate is signalled when the listeners change, coalescing the changes not handled yet
+	revalidate chan struct{}
 }
 
 func NewWatcher(providers []config.ProviderConfig, processor Processor, logger *logger.Logger) *Watcher {
@@ -27,10 +47,11 @@ func NewWatcher(providers []config.ProviderConfig, processor Processor, logger *
 		return nil
 	}
 	watcher := &Watcher{
-		receiveChan: make(chan config.Dynamic, 10), // Buffered channel
+		receiveChan: make(chan providerUpdate, 10), // Buffered channel
 		applyChan:   make(chan config.Dynamic, 10), // Buffered channel
 		Processor:   processor,
 		logger:      logger.WithComponent("watcher"),
+		revalidate:  make(chan struct{}, 1),
 	}
 	for _, pCfg := range providers {
 		var p provider.Provider
@@ -38,6 +59,14 @@ func NewWatcher(providers []config.ProviderConfig, processor Processor, logger *
 		switch pCfg.Type {
 		case "file":
 			p, err = file.NewFileProvider(pCfg, logger)
+		case "http":
+			p, err = httpprovider.NewHTTPProvider(pCfg, logger)
+		case "docker":
+			p, err = docker.NewDockerProvider(pCfg, logger)
+		case "api":
+			p, err = api.NewAPIProvider(pCfg, logger)
+		case "etcd":
+			p, err = etcd.NewEtcdProvider(pCfg, logger)
 		default:
 			continue // Unsupported provider type
 		}
@@ -45,11 +74,72 @@ func NewWatcher(providers []config.ProviderConfig, processor Processor, logger *
 			logger.Errorf("Failed to create provider for %s: %v", pCfg.Name, err)
 			continue
 		}
-		go p.Provide(watcher.receiveChan)
+		if vp, ok := p.(validatingProvider); ok {
+			watcher.validatingProviders = append(watcher.validatingProviders, vp)
+		}
+		providerChan := make(chan config.Dynamic, 10)
+		go p.Provide(providerChan)
+		go func(name string) {
+			for dynCfg := range providerChan {
+				watcher.receiveChan <- providerUpdate{provider: name, cfg: dynCfg}
+			}
+		}(pCfg.Name)
 	}
 	return watcher
 }
 
+// SetValidator makes the watcher validate the configuration of every provider on its own, so that an invalid
+// configuration is ignored and the last valid one of its provider is kept, leaving the other providers unaffected.
+// References to objects of other providers are only checked once the configurations are merged.
+func (w *Watcher) SetValidator(validator *config.DynamicValidator) {
+	validator.AllowExternalReferences()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.validator = validator
+}
+
+// SetDiscoveryReferenceValidator makes the providers validating their own changes check the discovery of
+// upstreams with fn.
+func (w *Watcher) SetDiscoveryReferenceValidator(fn config.DiscoveryReferenceValidator) {
+	for _, p := range w.validatingProviders {
+		p.SetDiscoveryReferenceValidator(fn)
+	}
+}
+
+// SetListeners validates the configurations of the providers again against the new static listeners, so that
+// configurations rejected for referencing a listener that didn't exist yet are accepted. Providers validating
+// their own changes check them against the new listeners from now on.
+func (w *Watcher) SetListeners(listeners []config.ListenerConfig) {
+	for _, p := range w.validatingProviders {
+		p.SetListeners(listeners)
+	}
+	w.mu.Lock()
+	if w.validator != nil {
+		w.validator.SetListeners(listeners)
+	}
+	w.mu.Unlock()
+	select {
+	case w.revalidate <- struct{}{}:
+	default:
+	}
+}
+
+// validate checks the configuration of the provider on its own.
+func (w *Watcher) validate(provider string, cfg config.Dynamic) error {
+	if _, err := namespace(cfg, provider); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.validator == nil {
+		return nil
+	}
+	if err := w.validator.Validate(&cfg); err != nil {
+		return fmt.Errorf("invalid config from provider %s: %w", provider, err)
+	}
+	return nil
+}
+
 // Throttling mechanism inspired by configwatcher in Traefik :) (Though a simplified version)
 func (w *Watcher) Watch(ctx context.Context) {
 	go func() {
@@ -59,6 +149,9 @@ func (w *Watcher) Watch(ctx context.Context) {
 	}()
 	var output chan config.Dynamic
 	latestConfiguration := config.Dynamic{}
+	// Last configuration received from every provider, and the last valid one which gets merged
+	received := make(map[string]config.Dynamic)
+	accepted := make(map[string]config.Dynamic)
 	for {
 		select {
 		case <-ctx.Done():
@@ -71,8 +164,33 @@ func (w *Watcher) Watch(ctx context.Context) {
 			case <-ctx.Done():
 				w.logger.Warn("Watcher received shutdown signal")
 				return
-			case dynCfg := <-w.receiveChan:
-				latestConfiguration = dynCfg
+			case update := <-w.receiveChan:
+				received[update.provider] = update.cfg
+				if err := w.validate(update.provider, update.cfg); err != nil {
+					w.logger.Errorf("Ignoring update, keeping the last valid config of provider %s: %v", update.provider, err)
+					continue
+				}
+				accepted[update.provider] = update.cfg
+				latestConfiguration = mergeProviders(accepted)
+				output = w.applyChan
+			case <-w.revalidate:
+				if len(received) == 0 {
+					continue
+				}
+				for provider, cfg := range received {
+					if w.validate(provider, cfg) == nil {
+						accepted[provider] = cfg
+						continue
+					}
+					// The last valid config is dropped as well when it references a removed listener
+					if last, exists := accepted[provider]; exists {
+						if err := w.validate(provider, last); err != nil {
+							w.logger.Errorf("Dropping the config of provider %s, which is no longer valid: %v", provider, err)
+							delete(accepted, provider)
+						}
+					}
+				}
+				latestConfiguration = mergeProviders(accepted)
 				output = w.applyChan
 			case output <- latestConfiguration:
 				output = nil
@@ -1,3 +1,159 @@
 package watcher
 
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Revolyssup/arp/pkg/config"
+	"github.com/Revolyssup/arp/pkg/logger"
+)
+
 //TODO: Test at least the throttling mechanism.
+
+type recordingProcessor struct {
+	configs chan config.Dynamic
+}
+
+func (p *recordingProcessor) Process(cfg config.Dynamic) {
+	p.configs <- cfg
+}
+
+func TestNamespace(t *testing.T) {
+	cfg := config.Dynamic{
+		Routes: []config.RouteConfig{{
+			Name:     "web",
+			Upstream: &config.UpstreamConfig{Name: "backend"},
+			Plugins:  []config.PluginConfig{{Name: "cache"}, {Name: "auth@shared"}},
+		}},
+		Upstreams: []config.UpstreamConfig{{Name: "backend"}},
+		Plugins:   []config.PluginConfig{{Name: "cache"}},
+	}
+	qualified, err := namespace(cfg, "file")
+	if err != nil {
+		t.Fatalf("Failed to namespace config: %v", err)
+	}
+	route := qualified.Routes[0]
+	if route.Name != "web@file" || route.Upstream.Name != "backend@file" {
+		t.Errorf("Expected route and its upstream reference to be qualified, got %+v", route)
+	}
+	if route.Plugins[0].Name != "cache@file" || route.Plugins[1].Name != "auth@shared" {
+		t.Errorf("Expected local plugin qualified and cross-provider reference kept, got %+v", route.Plugins)
+	}
+	if qualified.Upstreams[0].Name != "backend@file" || qualified.Plugins[0].Name != "cache@file" {
+		t.Errorf("Expected objects to be qualified, got %+v", qualified)
+	}
+	if cfg.Routes[0].Upstream.Name != "backend" || cfg.Routes[0].Plugins[0].Name != "cache" {
+		t.Error("Expected the provider config to be left untouched")
+	}
+
+	if _, err := namespace(config.Dynamic{Upstreams: []config.UpstreamConfig{{Name: "backend@other"}}}, "file"); err == nil {
+		t.Error("Expected objects defined with a qualified name to be rejected")
+	}
+}
+
+func TestWatchMergesProviders(t *testing.T) {
+	processor := &recordingProcessor{configs: make(chan config.Dynamic, 10)}
+	w := &Watcher{
+		receiveChan: make(chan providerUpdate, 10),
+		applyChan:   make(chan config.Dynamic, 10),
+		Processor:   processor,
+		logger:      logger.New(logger.LevelInfo),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Watch(ctx)
+
+	expect := func(check func(config.Dynamic) bool) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case cfg := <-processor.configs:
+				if check(cfg) {
+					return
+				}
+			case <-timeout:
+				t.Fatal("Timed out waiting for merged config")
+			}
+		}
+	}
+
+	w.receiveChan <- providerUpdate{provider: "file", cfg: config.Dynamic{Routes: []config.RouteConfig{{Name: "web"}}}}
+	w.receiveChan <- providerUpdate{provider: "http", cfg: config.Dynamic{Routes: []config.RouteConfig{{Name: "web"}}}}
+	expect(func(cfg config.Dynamic) bool {
+		return len(cfg.Routes) == 2 && cfg.Routes[0].Name == "web@file" && cfg.Routes[1].Name == "web@http"
+	})
+
+	// A provider update only replaces its own objects
+	w.receiveChan <- providerUpdate{provider: "file", cfg: config.Dynamic{}}
+	expect(func(cfg config.Dynamic) bool {
+		return len(cfg.Routes) == 1 && cfg.Routes[0].Name == "web@http"
+	})
+}
+
+func TestWatchValidatesProvidersSeparately(t *testing.T) {
+	processor := &recordingProcessor{configs: make(chan config.Dynamic, 10)}
+	w := &Watcher{
+		receiveChan: make(chan providerUpdate, 10),
+		applyChan:   make(chan config.Dynamic, 10),
+		Processor:   processor,
+		logger:      logger.New(logger.LevelInfo),
+		revalidate:  make(chan struct{}, 1),
+	}
+	validator := config.NewDynamicValidator()
+	validator.SetListeners([]config.ListenerConfig{{Name: "http"}})
+	w.SetValidator(validator)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Watch(ctx)
+
+	// Upstreams of other providers are only known once merged
+	route := func(name, listener string) config.Dynamic {
+		return config.Dynamic{Routes: []config.RouteConfig{{
+			Name:     name,
+			Listener: listener,
+			Matches:  []config.Match{{Path: "/"}},
+			Upstream: &config.UpstreamConfig{Name: "backend@shared"},
+		}}}
+	}
+	expect := func(names ...string) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case cfg := <-processor.configs:
+				got := make([]string, 0, len(cfg.Routes))
+				for _, route := range cfg.Routes {
+					got = append(got, route.Name)
+				}
+				if reflect.DeepEqual(got, names) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Timed out waiting for routes %v", names)
+			}
+		}
+	}
+
+	w.receiveChan <- providerUpdate{provider: "file", cfg: route("web", "http")}
+	w.receiveChan <- providerUpdate{provider: "http", cfg: route("api", "https")}
+	expect("web@file")
+
+	// An invalid update keeps the last valid config of its provider only
+	w.receiveChan <- providerUpdate{provider: "http", cfg: route("api", "http")}
+	expect("web@file", "api@http")
+	w.receiveChan <- providerUpdate{provider: "file", cfg: config.Dynamic{Routes: []config.RouteConfig{{Name: "broken"}}}}
+	w.receiveChan <- providerUpdate{provider: "http", cfg: route("admin", "https")}
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case cfg := <-processor.configs:
+		t.Fatalf("Expected invalid updates to be ignored, got %+v", cfg)
+	default:
+	}
+
+	// Configs referencing new listeners are accepted, the ones referencing removed listeners dropped
+	w.SetListeners([]config.ListenerConfig{{Name: "https"}})
+	expect("admin@http")
+}